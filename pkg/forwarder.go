@@ -4,9 +4,9 @@ import (
 	"context"
 	"io"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/VictoriaMetrics/metrics"
 	plugins "github.com/jdamick/dns-forwarder/pkg/plugins"
 	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/miekg/dns"
@@ -15,10 +15,14 @@ import (
 
 type Forwarder struct {
 	configuredPlugins map[string]plugins.Plugin
+	pluginTimings     map[string]*pluginTiming
 }
 
 func NewForwarder() *Forwarder {
-	return &Forwarder{configuredPlugins: make(map[string]plugins.Plugin)}
+	return &Forwarder{
+		configuredPlugins: make(map[string]plugins.Plugin),
+		pluginTimings:     make(map[string]*pluginTiming),
+	}
 }
 
 func (f *Forwarder) PrintHelp(pluginName string, out io.Writer) {
@@ -47,6 +51,7 @@ func (f *Forwarder) Configure(conf []byte) error {
 				return err
 			}
 			f.configuredPlugins[p.Name()] = p
+			f.pluginTimings[p.Name()] = newPluginTiming(p.Name())
 		}
 		return nil
 	})
@@ -105,15 +110,22 @@ func (f *Forwarder) QueryHandler(ctx context.Context, msg *dns.Msg) (*dns.Msg, e
 	log.Debug().Msg("QueryHandler")
 
 	defer utils.SimpleScopeTiming("dns_query_duration")()
-	metrics.GetOrCreateCounter("dns_query_inflight_count").Inc()
-	defer metrics.GetOrCreateCounter("dns_query_inflight_count").Dec()
+	queriesInflight.Inc()
+	defer queriesInflight.Dec()
 
 	ctx = setupHandlerCtx(ctx) // make sure the ctx is setup correctly
+	start := time.Now()
+	plugins.SetQueryStart(ctx, start)
+	defer observeRequest(ctx, msg, start)
+	defer plugins.FinishTrace(ctx)
 	plugins.ResponseMetadata(ctx)[responseHandlerCalled] = false
 	for _, p := range plugins.GetQueryPlugins() {
 		log.Debug().Str("name", p.Name()).Msg("QueryHandler")
 		if f.isPluginConfigured(p.Name()) {
+			start := time.Now()
 			err := p.Query(ctx, msg)
+			f.pluginTimings[p.Name()].query.UpdateDuration(start)
+			traceQueryPlugin(ctx, p.Name(), start, err)
 			log.Debug().Str("name", p.Name()).Err(err).Msg("QueryHandler")
 			if err == plugins.ErrBreakProcessing || plugins.ResponseMetadata(ctx)[responseHandlerCalled].(bool) {
 				return nil, nil
@@ -134,7 +146,10 @@ func (f *Forwarder) ResponseHandler(ctx context.Context, msg *dns.Msg) (*dns.Msg
 	for _, p := range plugins.GetResponsePlugins() {
 		log.Debug().Str("name", p.Name()).Msg("ResponseHandler")
 		if f.isPluginConfigured(p.Name()) {
+			start := time.Now()
 			err := p.Response(ctx, msg)
+			f.pluginTimings[p.Name()].response.UpdateDuration(start)
+			traceResponsePlugin(ctx, p.Name(), start, err)
 			log.Debug().Str("name", p.Name()).Err(err).Msg("ResponseHandler")
 			if err == plugins.ErrBreakProcessing {
 				return nil, nil
@@ -145,6 +160,7 @@ func (f *Forwarder) ResponseHandler(ctx context.Context, msg *dns.Msg) (*dns.Msg
 			}
 		}
 	}
+	observeResponse(ctx, msg)
 	return nil, nil
 }
 
@@ -0,0 +1,99 @@
+package dnsforwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	plugins "github.com/jdamick/dns-forwarder/pkg/plugins"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+)
+
+// pluginTiming is the time spent in a plugin, the plugins answering a query
+// include the processing of the response.
+type pluginTiming struct {
+	query, response *metrics.Histogram
+}
+
+func newPluginTiming(name string) *pluginTiming {
+	return &pluginTiming{
+		query:    metrics.GetOrCreateHistogram(fmt.Sprintf(`dns_plugin_duration_seconds{plugin=%q,phase="query"}`, name)),
+		response: metrics.GetOrCreateHistogram(fmt.Sprintf(`dns_plugin_duration_seconds{plugin=%q,phase="response"}`, name)),
+	}
+}
+
+type serverSeriesKey struct{ server, proto string }
+
+// requestSeries are the series of the server and protocol.
+type requestSeries struct {
+	duration, size *metrics.Histogram
+}
+
+// labeledSeriesKey is the key of a series of the server and protocol with one more label,
+// the qtype of the requests or the rcode of the responses.
+type labeledSeriesKey struct {
+	server, proto, label string
+}
+
+var (
+	// a gauge, the pushed metrics are typed by the exposition
+	queriesInflight = metrics.GetOrCreateGauge("dns_query_inflight_count", nil)
+
+	requestSeriesCache = utils.NewSeriesCache(func(k serverSeriesKey) *requestSeries {
+		return &requestSeries{
+			duration: metrics.GetOrCreateHistogram(fmt.Sprintf(`dns_request_duration_seconds{server=%q,proto=%q}`, k.server, k.proto)),
+			size:     metrics.GetOrCreateHistogram(fmt.Sprintf(`dns_response_size_bytes{server=%q,proto=%q}`, k.server, k.proto)),
+		}
+	})
+	requestCounters = utils.NewSeriesCache(func(k labeledSeriesKey) *metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf(`dns_requests_total{server=%q,proto=%q,qtype=%q}`, k.server, k.proto, k.label))
+	})
+	responseCounters = utils.NewSeriesCache(func(k labeledSeriesKey) *metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf(`dns_responses_total{server=%q,proto=%q,rcode=%q}`, k.server, k.proto, k.label))
+	})
+)
+
+// observeRequest counts a query by server, protocol and qtype with its duration.
+func observeRequest(ctx context.Context, msg *dns.Msg, start time.Time) {
+	server, proto := requestLabels(ctx)
+	qtype := "none"
+	if len(msg.Question) > 0 {
+		qtype = typeLabel(msg.Question[0].Qtype)
+	}
+	requestCounters.Get(labeledSeriesKey{server, proto, qtype}).Inc()
+	requestSeriesCache.Get(serverSeriesKey{server, proto}).duration.UpdateDuration(start)
+}
+
+// observeResponse counts a response by server, protocol and rcode with its size.
+func observeResponse(ctx context.Context, msg *dns.Msg) {
+	server, proto := requestLabels(ctx)
+	rcode, ok := dns.RcodeToString[msg.Rcode]
+	if !ok {
+		rcode = "other"
+	}
+	responseCounters.Get(labeledSeriesKey{server, proto, rcode}).Inc()
+	requestSeriesCache.Get(serverSeriesKey{server, proto}).size.Update(float64(msg.Len()))
+}
+
+func requestLabels(ctx context.Context) (server, proto string) {
+	server, proto = plugins.Server(ctx), "unknown"
+	if server == "" {
+		server = "unknown"
+	}
+	if remote, ok := plugins.QueryMetadata(ctx)["RemoteAddr"].(net.Addr); ok && remote != nil {
+		proto = remote.Network()
+	}
+	return server, proto
+}
+
+// typeLabel is the name of the known types, the others share a label to
+// bound the series.
+func typeLabel(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "other"
+}
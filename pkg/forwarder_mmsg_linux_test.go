@@ -0,0 +1,75 @@
+//go:build linux
+
+package dnsforwarder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	plugins "github.com/jdamick/dns-forwarder/pkg/plugins"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// the responses of each server plugin go through the Response of the others
+func TestForwarderMmsgWithDNSServer(t *testing.T) {
+	f := NewForwarder()
+	assert := assert.New(t)
+
+	plugins.RegisterPlugin(&testAnswerPlugin{name: "test-answer-1"})
+	dnsAddr, mmsgAddr := "127.0.0.1:"+freeUDPPort(t), "127.0.0.1:"+freeUDPPort(t)
+	assert.NoError(f.Configure([]byte(fmt.Sprintf("[dns]\nlisten = [%q]\n[mmsgdns]\nlisten = [%q]\n[test-answer-1]\n", dnsAddr, mmsgAddr))))
+	assert.NoError(f.Start())
+	defer f.Stop()
+
+	for _, addr := range []string{dnsAddr, mmsgAddr, dnsAddr} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		r, err := dns.Exchange(q, addr)
+		if assert.NoError(err, addr) {
+			assert.Equal(dns.RcodeSuccess, r.Rcode, addr)
+			assert.Len(r.Answer, 1, addr)
+		}
+	}
+}
+
+func freeUDPPort(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer pc.Close()
+	return strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// testAnswerPlugin answers every query with an A record.
+type testAnswerPlugin struct {
+	name    string
+	handler plugins.Handler
+}
+
+func (t *testAnswerPlugin) Name() string { return t.name }
+
+func (t *testAnswerPlugin) PrintHelp(out io.Writer) {}
+
+func (t *testAnswerPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	return nil
+}
+
+func (t *testAnswerPlugin) StartClient(ctx context.Context, handler plugins.Handler) error {
+	t.handler = handler
+	return nil
+}
+
+func (t *testAnswerPlugin) StopClient(ctx context.Context) error { return nil }
+
+func (t *testAnswerPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	r := new(dns.Msg)
+	r.SetReply(msg)
+	rr, _ := dns.NewRR(msg.Question[0].Name + " 60 IN A 192.0.2.1")
+	r.Answer = append(r.Answer, rr)
+	_, err := t.handler.Handle(ctx, r)
+	return err
+}
@@ -1,11 +1,19 @@
 package dnsforwarder
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	plugins "github.com/jdamick/dns-forwarder/pkg/plugins"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -82,6 +90,88 @@ func TestForwarderClientPlugin(t *testing.T) {
 	assert.Equal(1, tp.stopCalled, "stop not called")
 }
 
+func TestForwarderMetrics(t *testing.T) {
+	f := NewForwarder()
+	assert := assert.New(t)
+
+	tp := &testClientPlugin{t: t, name: "test-metrics-1"}
+	plugins.RegisterPlugin(tp)
+	assert.NoError(f.Configure([]byte(`["test-metrics-1"]`)))
+
+	ctx := plugins.CreateNewHandlerCtx()
+	plugins.SetServer(ctx, "test-server")
+	plugins.QueryMetadata(ctx)["RemoteAddr"] = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	f.QueryHandler(ctx, q)
+	r := new(dns.Msg)
+	r.SetRcode(q, dns.RcodeNameError)
+	f.ResponseHandler(ctx, r)
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	out := buf.String()
+	assert.Contains(out, `dns_requests_total{server="test-server",proto="udp",qtype="AAAA"} 1`)
+	assert.Contains(out, `dns_request_duration_seconds_count{server="test-server",proto="udp"} 1`)
+	assert.Contains(out, `dns_responses_total{server="test-server",proto="udp",rcode="NXDOMAIN"} 1`)
+	assert.Contains(out, fmt.Sprintf(`dns_response_size_bytes_sum{server="test-server",proto="udp"} %d`, r.Len()))
+	assert.Contains(out, `dns_plugin_duration_seconds_count{plugin="test-metrics-1",phase="query"} 1`)
+	assert.Zero(testing.AllocsPerRun(100, func() { observeRequest(ctx, q, time.Now()) }), "series lookup")
+	assert.Equal("A", typeLabel(dns.TypeA))
+	assert.Equal("other", typeLabel(65280))
+}
+
+func TestForwarderTrace(t *testing.T) {
+	f := NewForwarder()
+	assert := assert.New(t)
+	bodies := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer srv.Close()
+
+	tp := &testClientPlugin{t: t, name: "test-trace-1"}
+	plugins.RegisterPlugin(tp)
+	assert.NoError(f.Configure([]byte(fmt.Sprintf("[trace]\ndomains = [\"example.com\"]\notlpEndpoint = %q\n[test-trace-1]\n", srv.URL))))
+	assert.NoError(f.Start())
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.org.", dns.TypeA)
+	f.QueryHandler(context.Background(), q)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	f.QueryHandler(context.Background(), q)
+	f.Stop()
+
+	body := <-bodies
+	assert.Contains(body, `"name":"dns.query"`)
+	assert.Contains(body, `{"key":"dns.question.name","value":{"stringValue":"www.example.com."}}`)
+	assert.Contains(body, `"name":"trace.query"`)
+	assert.Contains(body, `"name":"test-trace-1.query"`)
+	assert.NotContains(body, "example.org.")
+	assert.Len(bodies, 0)
+
+	// the spans of the plugins, the trace plugin's included, start within the trace
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					Name  string `json:"name"`
+					Start string `json:"startTimeUnixNano"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if assert.NoError(json.Unmarshal([]byte(body), &req)) {
+		spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+		root, _ := strconv.ParseUint(spans[0].Start, 10, 64)
+		for _, span := range spans[1:] {
+			start, _ := strconv.ParseUint(span.Start, 10, 64)
+			assert.GreaterOrEqual(start, root, span.Name)
+		}
+	}
+}
+
 // Mock Plugins
 ///////////////
 
@@ -0,0 +1,42 @@
+package dnsforwarder
+
+import (
+	"context"
+	"time"
+
+	plugins "github.com/jdamick/dns-forwarder/pkg/plugins"
+)
+
+// traceQueryPlugin records the span of a plugin query call when the query is traced.
+func traceQueryPlugin(ctx context.Context, name string, start time.Time, err error) {
+	t := plugins.Trace(ctx)
+	if t == nil {
+		return
+	}
+	decision := plugins.TraceContinue
+	switch {
+	case err == plugins.ErrBreakProcessing:
+		decision, err = plugins.TraceStop, nil
+	case err != nil:
+		decision = plugins.TraceError
+	case plugins.ResponseMetadata(ctx)[responseHandlerCalled] == true:
+		decision = plugins.TraceAnswered
+	}
+	t.AddSpan(plugins.TraceSpan{Name: name + ".query", Start: start, Duration: time.Since(start), Decision: decision, Err: err})
+}
+
+// traceResponsePlugin records the span of a plugin response call when the query is traced.
+func traceResponsePlugin(ctx context.Context, name string, start time.Time, err error) {
+	t := plugins.Trace(ctx)
+	if t == nil {
+		return
+	}
+	decision := plugins.TraceContinue
+	switch {
+	case err == plugins.ErrBreakProcessing:
+		decision, err = plugins.TraceStop, nil
+	case err != nil:
+		decision = plugins.TraceError
+	}
+	t.AddSpan(plugins.TraceSpan{Name: name + ".response", Start: start, Duration: time.Since(start), Decision: decision, Err: err})
+}
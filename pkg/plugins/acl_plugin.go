@@ -0,0 +1,263 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// ACLPlugin allows or denies queries by client network, listener, protocol and
+// query name. Rules are evaluated in order and the first matching rule wins,
+// denied queries are answered with REFUSED (and an Extended DNS Error) or dropped.
+type ACLPlugin struct {
+	config  ACLPluginConfig
+	rules   []*aclRule
+	clients *utils.PrefixTrie[int]
+	handler Handler
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&ACLPlugin{})
+}
+
+func (a *ACLPlugin) Name() string {
+	return "acl"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (a *ACLPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(a.Name(), &a.config, out)
+}
+
+type ACLPluginConfig struct {
+	DefaultAction string          `toml:"defaultAction" comment:"Action when no rule matches (allow, refuse, drop)" default:"refuse"`
+	Rules         []ACLRuleConfig `toml:"rules" comment:"Rules evaluated in order, the first match wins"`
+}
+
+// ACLRuleConfig is a single rule, every criteria set must match, an empty criteria matches all.
+type ACLRuleConfig struct {
+	Name      string   `toml:"name" comment:"Rule name used in the metrics and logs"`
+	Action    string   `toml:"action" comment:"allow, refuse or drop"`
+	Clients   []string `toml:"clients" comment:"Client CIDRs or IPs"`
+	Listeners []string `toml:"listeners" comment:"Local listener addresses (ip:port, :port or ip)"`
+	Protocols []string `toml:"protocols" comment:"Protocols (udp, tcp, unix, unixgram)"`
+	Domains   []string `toml:"domains" comment:"Query name suffixes"`
+}
+
+const (
+	aclAllow  = "allow"
+	aclRefuse = "refuse"
+	aclDrop   = "drop"
+)
+
+type aclRule struct {
+	name      string
+	action    string
+	listeners []aclListener
+	protocols []string
+	domains   []string
+	anyClient bool // no client CIDRs, also matches the unix socket clients
+	matches   *metrics.Counter
+}
+
+// aclListener matches a local address, an invalid addr or zero port match any.
+type aclListener struct {
+	addr netip.Addr
+	port uint16
+}
+
+// Configure the plugin.
+func (a *ACLPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("ACLPlugin.Configure")
+	a.config = ACLPluginConfig{}
+	if err := UnmarshalConfiguration(config, &a.config); err != nil {
+		return err
+	}
+	a.config.DefaultAction = strings.ToLower(a.config.DefaultAction)
+	if !isACLAction(a.config.DefaultAction) {
+		return fmt.Errorf("invalid acl default action: %v", a.config.DefaultAction)
+	}
+
+	rules := make([]*aclRule, 0, len(a.config.Rules)+1)
+	trie := utils.NewPrefixTrie[int]()
+	for i, rc := range a.config.Rules {
+		rule, err := newACLRule(i, rc)
+		if err != nil {
+			return err
+		}
+		clients, err := utils.ParsePrefixes(rc.Clients)
+		if err != nil {
+			return err
+		}
+		if len(clients) == 0 {
+			clients = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+			rule.anyClient = true
+		}
+		for _, c := range clients {
+			trie.Insert(c, i)
+		}
+		rules = append(rules, rule)
+	}
+	rules = append(rules, &aclRule{name: "default", action: a.config.DefaultAction})
+	for _, r := range rules {
+		r.matches = metrics.GetOrCreateCounter(fmt.Sprintf(`dns_acl_matches_total{rule=%q,action=%q}`, r.name, r.action))
+	}
+	a.rules, a.clients = rules, trie
+	log.Debug().Msgf("ACLPlugin: %#v", a.config)
+	return nil
+}
+
+func newACLRule(idx int, rc ACLRuleConfig) (*aclRule, error) {
+	rule := &aclRule{name: rc.Name, action: strings.ToLower(rc.Action)}
+	if rule.name == "" {
+		rule.name = "rule" + strconv.Itoa(idx)
+	}
+	if !isACLAction(rule.action) {
+		return nil, fmt.Errorf("invalid acl action for rule %v: %v", rule.name, rc.Action)
+	}
+	for _, l := range rc.Listeners {
+		listener, err := parseACLListener(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid acl listener for rule %v: %w", rule.name, err)
+		}
+		rule.listeners = append(rule.listeners, listener)
+	}
+	for _, p := range rc.Protocols {
+		rule.protocols = append(rule.protocols, strings.ToLower(p))
+	}
+	for _, d := range rc.Domains {
+		rule.domains = append(rule.domains, dns.CanonicalName(d))
+	}
+	return rule, nil
+}
+
+func isACLAction(action string) bool {
+	return action == aclAllow || action == aclRefuse || action == aclDrop
+}
+
+func parseACLListener(s string) (aclListener, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return aclListener{addr: addr.Unmap()}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return aclListener{}, err
+	}
+	l := aclListener{}
+	if host != "" {
+		if l.addr, err = netip.ParseAddr(host); err != nil {
+			return aclListener{}, err
+		}
+		l.addr = l.addr.Unmap()
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	l.port = uint16(p)
+	return l, err
+}
+
+func (l aclListener) match(local netip.AddrPort) bool {
+	return (!l.addr.IsValid() || l.addr == local.Addr()) && (l.port == 0 || l.port == local.Port())
+}
+
+// Start the protocol plugin.
+func (a *ACLPlugin) StartClient(ctx context.Context, handler Handler) error {
+	a.handler = handler
+	return nil
+}
+
+// Stop the protocol plugin.
+func (a *ACLPlugin) StopClient(ctx context.Context) error {
+	return nil
+}
+
+func (a *ACLPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	rule := a.match(ctx, msg)
+	rule.matches.Inc()
+	switch rule.action {
+	case aclAllow:
+		return nil
+	case aclDrop:
+		log.Debug().Str("rule", rule.name).Msg("query dropped by acl")
+		reportBlockedQuery(msg)
+		DropResponse(ctx)
+		return ErrBreakProcessing
+	default:
+		log.Debug().Str("rule", rule.name).Msg("query refused by acl")
+		reportBlockedQuery(msg)
+		_, err := a.handler.Handle(ctx, refusedResponse(msg))
+		return err
+	}
+}
+
+// match finds the first rule matching the query, or the default rule.
+func (a *ACLPlugin) match(ctx context.Context, msg *dns.Msg) *aclRule {
+	var client netip.Addr
+	var proto string
+	if remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr); ok {
+		client, _ = utils.AddrToNetIP(remote)
+		proto = remote.Network()
+	}
+	var local netip.AddrPort
+	if addr, ok := QueryMetadata(ctx)["LocalAddr"].(net.Addr); ok {
+		local, _ = netip.ParseAddrPort(addr.String())
+		local = netip.AddrPortFrom(local.Addr().Unmap().WithZone(""), local.Port())
+	}
+	qname := ""
+	if len(msg.Question) > 0 {
+		qname = dns.CanonicalName(msg.Question[0].Name)
+	}
+
+	best := len(a.rules) - 1
+	if !client.IsValid() {
+		// unix socket clients have no address
+		for _, r := range a.rules[:best] {
+			if r.anyClient && r.matchQuery(local, proto, qname) {
+				return r
+			}
+		}
+		return a.rules[best]
+	}
+	a.clients.Match(client, func(idx int) bool {
+		if idx < best && a.rules[idx].matchQuery(local, proto, qname) {
+			best = idx
+		}
+		return true
+	})
+	return a.rules[best]
+}
+
+func (r *aclRule) matchQuery(local netip.AddrPort, proto, qname string) bool {
+	if len(r.listeners) > 0 && !slices.ContainsFunc(r.listeners, func(l aclListener) bool { return l.match(local) }) {
+		return false
+	}
+	if len(r.protocols) > 0 && !slices.Contains(r.protocols, proto) {
+		return false
+	}
+	if len(r.domains) > 0 && !slices.ContainsFunc(r.domains, func(d string) bool { return qname != "" && dns.IsSubDomain(d, qname) }) {
+		return false
+	}
+	return true
+}
+
+// refusedResponse is REFUSED with the Prohibited Extended DNS Error (RFC 8914),
+// the EDE is only added when the client sent EDNS.
+func refusedResponse(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeRefused)
+	if req.IsEdns0() != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited})
+	}
+	return resp
+}
@@ -0,0 +1,121 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestACL(t *testing.T, config map[string]interface{}) (*ACLPlugin, *[]*dns.Msg) {
+	a := &ACLPlugin{}
+	assert.NoError(t, a.Configure(context.Background(), config))
+	responses := []*dns.Msg{}
+	a.StartClient(context.Background(), HandlerFunc(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		responses = append(responses, m)
+		return nil, nil
+	}))
+	return a, &responses
+}
+
+func aclQuery(remote, local net.Addr, name string) (context.Context, *dns.Msg) {
+	ctx := CreateNewHandlerCtx()
+	QueryMetadata(ctx)["RemoteAddr"] = remote
+	QueryMetadata(ctx)["LocalAddr"] = local
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	return ctx, m
+}
+
+func TestACLPlugin(t *testing.T) {
+	assert := assert.New(t)
+	a, responses := newTestACL(t, map[string]interface{}{
+		"rules": []map[string]interface{}{
+			{"name": "blocked", "action": "drop", "clients": []string{"10.9.0.0/16"}},
+			{"name": "internal", "action": "allow", "clients": []string{"10.0.0.0/8", "fd00::/8"}},
+			{"name": "corp", "action": "allow", "domains": []string{"Corp.Example"}, "protocols": []string{"tcp"}},
+			{"name": "local", "action": "allow", "listeners": []string{"127.0.0.1:5353"}},
+		},
+	})
+	local := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+
+	ctx, m := aclQuery(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, local, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+	ctx, m = aclQuery(&net.UDPAddr{IP: net.ParseIP("fd12::1")}, local, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+
+	// the earlier rule wins
+	ctx, m = aclQuery(&net.UDPAddr{IP: net.ParseIP("10.9.2.3")}, local, "example.com.")
+	assert.Equal(ErrBreakProcessing, a.Query(ctx, m))
+	assert.True(ResponseMetadata(ctx)[responseWritten].(bool))
+	assert.Empty(*responses)
+
+	// domain and protocol
+	ctx, m = aclQuery(&net.TCPAddr{IP: net.ParseIP("198.51.100.1")}, local, "www.corp.example.")
+	assert.NoError(a.Query(ctx, m))
+	assert.Empty(*responses)
+	ctx, m = aclQuery(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, local, "www.corp.example.")
+	assert.NoError(a.Query(ctx, m))
+	assert.Len(*responses, 1)
+
+	// listener
+	ctx, m = aclQuery(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+	assert.Len(*responses, 1)
+
+	// refused by default, with an EDE when the client uses EDNS
+	ctx, m = aclQuery(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, local, "example.com.")
+	m.SetEdns0(1232, false)
+	assert.NoError(a.Query(ctx, m))
+	if assert.Len(*responses, 2) {
+		resp := (*responses)[1]
+		assert.Equal(dns.RcodeRefused, resp.Rcode)
+		assert.Equal(m.Id, resp.Id)
+		if assert.NotNil(resp.IsEdns0()) {
+			ede := resp.IsEdns0().Option[0].(*dns.EDNS0_EDE)
+			assert.Equal(dns.ExtendedErrorCodeProhibited, ede.InfoCode)
+		}
+		assert.Nil((*responses)[0].IsEdns0())
+	}
+}
+
+func TestACLPluginConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	a := &ACLPlugin{}
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"defaultAction": "maybe"}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{
+		"rules": []map[string]interface{}{{"action": "allow", "clients": []string{"10.0.0.0/33"}}},
+	}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{
+		"rules": []map[string]interface{}{{"action": "allow", "listeners": []string{"localhost"}}},
+	}))
+
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"defaultAction": "Allow"}))
+	ctx, m := aclQuery(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, nil, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+}
+
+func TestACLPluginUnixClients(t *testing.T) {
+	assert := assert.New(t)
+	a, responses := newTestACL(t, map[string]interface{}{
+		"rules": []map[string]interface{}{
+			{"name": "internal", "action": "drop", "clients": []string{"10.0.0.0/8"}},
+			{"name": "sockets", "action": "allow", "protocols": []string{"unix"}},
+		},
+	})
+	local := &net.UnixAddr{Name: "/run/dns.sock", Net: "unix"}
+
+	// only the rules without clients apply to unix socket clients
+	ctx, m := aclQuery(utils.NewUnixPeerAddr("unix", ""), local, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+	assert.Empty(*responses)
+
+	ctx, m = aclQuery(utils.NewUnixPeerAddr("unixgram", "/tmp/client.sock"), local, "example.com.")
+	assert.NoError(a.Query(ctx, m))
+	if assert.Len(*responses, 1) {
+		assert.Equal(dns.RcodeRefused, (*responses)[0].Rcode)
+	}
+}
@@ -0,0 +1,211 @@
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	rpprof "runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/rs/zerolog/log"
+)
+
+// The diagnostics endpoints of the admin API, served when debug is enabled.
+const (
+	debugPprofPath      = "/debug/pprof/"
+	debugGoroutinesPath = "/debug/goroutines"
+	debugRuntimePath    = "/debug/runtime"
+	debugGCPath         = "/debug/gc"
+	debugCPUProfilePath = "/debug/cpuprofile"
+
+	// maxCPUProfile is the longest CPU profile captured by the API.
+	maxCPUProfile = 10 * time.Minute
+)
+
+// debugHandlers returns the diagnostics endpoints by path, the CPU profiles
+// captured by the API are written in dir.
+func debugHandlers(dir string) map[string]http.Handler {
+	pprofMux := http.NewServeMux()
+	pprofMux.HandleFunc(debugPprofPath, pprof.Index)
+	pprofMux.HandleFunc(debugPprofPath+"cmdline", pprof.Cmdline)
+	pprofMux.HandleFunc(debugPprofPath+"profile", pprof.Profile)
+	pprofMux.HandleFunc(debugPprofPath+"symbol", pprof.Symbol)
+	pprofMux.HandleFunc(debugPprofPath+"trace", pprof.Trace)
+	return map[string]http.Handler{
+		debugPprofPath:      pprofMux,
+		debugGoroutinesPath: http.HandlerFunc(serveGoroutines),
+		debugRuntimePath:    http.HandlerFunc(serveRuntimeMetrics),
+		debugGCPath:         http.HandlerFunc(serveGCStats),
+		debugCPUProfilePath: &cpuProfiler{dir: dir},
+	}
+}
+
+// serveGoroutines dumps the stacks of all the goroutines, as on a panic.
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// serveRuntimeMetrics returns the scalar runtime/metrics, and the counts of
+// the histograms.
+func serveRuntimeMetrics(w http.ResponseWriter, r *http.Request) {
+	descs := metrics.All()
+	samples := make([]metrics.Sample, len(descs))
+	for i, d := range descs {
+		samples[i].Name = d.Name
+	}
+	metrics.Read(samples)
+	values := make(map[string]any, len(samples))
+	for _, s := range samples {
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			values[s.Name] = s.Value.Uint64()
+		case metrics.KindFloat64:
+			values[s.Name] = s.Value.Float64()
+		case metrics.KindFloat64Histogram:
+			var count uint64
+			for _, c := range s.Value.Float64Histogram().Counts {
+				count += c
+			}
+			values[s.Name] = map[string]uint64{"count": count}
+		}
+	}
+	writeAdminJSON(w, values)
+}
+
+type gcStats struct {
+	NumGC         int64     `json:"numGC"`
+	LastGC        time.Time `json:"lastGC"`
+	PauseTotal    string    `json:"pauseTotal"`
+	RecentPauses  []string  `json:"recentPauses"`
+	GCCPUFraction float64   `json:"gcCPUFraction"`
+	HeapAlloc     uint64    `json:"heapAlloc"`
+	HeapSys       uint64    `json:"heapSys"`
+	HeapObjects   uint64    `json:"heapObjects"`
+	NextGC        uint64    `json:"nextGC"`
+	Sys           uint64    `json:"sys"`
+	GOGC          uint64    `json:"gogc"`
+	MemoryLimit   uint64    `json:"memoryLimit"`
+	Goroutines    int       `json:"goroutines"`
+}
+
+// serveGCStats returns the GC and heap stats, with the GOGC and memory limit
+// as tuned by the memory plugin.
+func serveGCStats(w http.ResponseWriter, r *http.Request) {
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	tuning := []metrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}}
+	metrics.Read(tuning)
+	stats := gcStats{
+		NumGC:         gc.NumGC,
+		LastGC:        gc.LastGC,
+		PauseTotal:    gc.PauseTotal.String(),
+		GCCPUFraction: mem.GCCPUFraction,
+		HeapAlloc:     mem.HeapAlloc,
+		HeapSys:       mem.HeapSys,
+		HeapObjects:   mem.HeapObjects,
+		NextGC:        mem.NextGC,
+		Sys:           mem.Sys,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	if tuning[0].Value.Kind() == metrics.KindUint64 {
+		stats.GOGC = tuning[0].Value.Uint64()
+	}
+	if tuning[1].Value.Kind() == metrics.KindUint64 {
+		stats.MemoryLimit = tuning[1].Value.Uint64()
+	}
+	for _, p := range gc.Pause[:min(len(gc.Pause), 10)] {
+		stats.RecentPauses = append(stats.RecentPauses, p.String())
+	}
+	writeAdminJSON(w, stats)
+}
+
+// cpuProfiler captures a CPU profile to a file for some seconds, like
+// -cpuprofile, on a POST. A GET returns the running or last capture.
+type cpuProfiler struct {
+	dir     string
+	mu      sync.Mutex
+	current cpuProfile
+}
+
+type cpuProfile struct {
+	File    string    `json:"file,omitempty"`
+	Start   time.Time `json:"start,omitempty"`
+	Seconds int       `json:"seconds,omitempty"`
+	Running bool      `json:"running"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (c *cpuProfiler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		c.mu.Lock()
+		current := c.current
+		c.mu.Unlock()
+		writeAdminJSON(w, current)
+	case http.MethodPost:
+		seconds := 30
+		if v := r.URL.Query().Get("seconds"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || time.Duration(n)*time.Second > maxCPUProfile {
+				http.Error(w, fmt.Sprintf("invalid seconds: %v", v), http.StatusBadRequest)
+				return
+			}
+			seconds = n
+		}
+		profile, err := c.start(seconds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeAdminJSON(w, profile)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// start begins a capture, the profile is stopped and closed after seconds.
+func (c *cpuProfiler) start(seconds int) (cpuProfile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current.Running {
+		return cpuProfile{}, fmt.Errorf("CPU profile already running: %v", c.current.File)
+	}
+	start := time.Now()
+	name := filepath.Join(c.dir, fmt.Sprintf("cpu-%v.pprof", start.UTC().Format("20060102T150405")))
+	f, err := os.Create(name)
+	if err != nil {
+		return cpuProfile{}, err
+	}
+	if err := rpprof.StartCPUProfile(f); err != nil {
+		// profiled by /debug/pprof/profile
+		f.Close()
+		os.Remove(name)
+		return cpuProfile{}, err
+	}
+	c.current = cpuProfile{File: name, Start: start, Seconds: seconds, Running: true}
+	log.Info().Str("file", name).Int("seconds", seconds).Msg("CPU profile started")
+	time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		rpprof.StopCPUProfile()
+		err := f.Close()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.current.Running = false
+		if err != nil {
+			c.current.Error = err.Error()
+		}
+		log.Info().Str("file", name).Err(err).Msg("CPU profile written")
+	})
+	return c.current, nil
+}
@@ -0,0 +1,76 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminDebug(t *testing.T) {
+	assert := assert.New(t)
+	a := &AdminPlugin{}
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"token": "secret", "debug": true, "profileDir": t.TempDir()}))
+	for path, h := range debugHandlers(a.config.ProfileDir) {
+		registerAdminHandler(path, h)
+		defer registerAdminHandler(path, nil)
+	}
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+	r := httptest.NewRequest(http.MethodGet, debugGoroutinesPath, nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	assert.Contains(do(http.MethodGet, debugPprofPath).Body.String(), "goroutine")
+	w = do(http.MethodGet, debugPprofPath+"heap?debug=1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "heap profile")
+	assert.Contains(do(http.MethodGet, debugGoroutinesPath).Body.String(), "TestAdminDebug")
+	assert.Contains(do(http.MethodGet, debugRuntimePath).Body.String(), `"/gc/heap/goal:bytes"`)
+
+	var gc gcStats
+	assert.NoError(json.NewDecoder(do(http.MethodGet, debugGCPath).Body).Decode(&gc))
+	assert.NotZero(gc.HeapAlloc)
+	assert.NotZero(gc.Goroutines)
+
+	assert.Equal(http.StatusBadRequest, do(http.MethodPost, debugCPUProfilePath+"?seconds=0").Code)
+	assert.Equal(http.StatusBadRequest, do(http.MethodPost, debugCPUProfilePath+"?seconds=3600").Code)
+	w = do(http.MethodPost, debugCPUProfilePath+"?seconds=1")
+	assert.Equal(http.StatusAccepted, w.Code)
+	var profile cpuProfile
+	assert.NoError(json.NewDecoder(w.Body).Decode(&profile))
+	assert.True(profile.Running)
+	assert.Equal(http.StatusConflict, do(http.MethodPost, debugCPUProfilePath).Code)
+	assert.Eventually(func() bool {
+		var current cpuProfile
+		json.NewDecoder(do(http.MethodGet, debugCPUProfilePath).Body).Decode(&current)
+		return !current.Running
+	}, 5*time.Second, 50*time.Millisecond)
+	info, err := os.Stat(profile.File)
+	assert.NoError(err)
+	assert.NotZero(info.Size())
+}
+
+func TestAdminDebugRequiresToken(t *testing.T) {
+	assert := assert.New(t)
+	a := &AdminPlugin{}
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"debug": true}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"debug": true, "listen": "[::1]:8081"}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"debug": true, "listen": "localhost:8081"}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"debug": true, "listen": ":8081", "token": "secret"}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"listen": ":8081"}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"debug": true, "listen": ":8081"}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"debug": true, "listen": "192.0.2.1:8081"}))
+}
@@ -0,0 +1,192 @@
+package plugins
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// AdminPlugin serves the admin API of the other plugins over HTTP, they add
+// their endpoints with registerAdminHandler while they run. The API is only
+// served to the clients with the token, when one is set. With debug, it also
+// serves the pprof and runtime diagnostics.
+type AdminPlugin struct {
+	config AdminPluginConfig
+	server *http.Server
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&AdminPlugin{})
+}
+
+func (a *AdminPlugin) Name() string {
+	return "admin"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (a *AdminPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(a.Name(), &a.config, out)
+}
+
+type AdminPluginConfig struct {
+	Listen     string `toml:"listen" comment:"Admin API HTTP address" default:"127.0.0.1:8081"`
+	Token      string `toml:"token" comment:"Bearer token required by the API, none when empty"`
+	Debug      bool   `toml:"debug" comment:"Serve /debug/pprof/, the goroutine dumps, the runtime metrics, the GC stats and the CPU profile captures, requires a token unless listening on loopback"`
+	ProfileDir string `toml:"profileDir" comment:"Directory of the CPU profiles captured with /debug/cpuprofile, the temp directory when empty"`
+}
+
+// Configure the plugin.
+func (a *AdminPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Msg("AdminPlugin.Configure")
+	a.config = AdminPluginConfig{}
+	if err := UnmarshalConfiguration(config, &a.config); err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(a.config.Listen)
+	if err != nil {
+		return err
+	}
+	// the debug endpoints expose the process internals and can stall it
+	if a.config.Debug && a.config.Token == "" && !isLoopbackHost(host) {
+		return fmt.Errorf("admin debug requires a token when listening on %v", a.config.Listen)
+	}
+	if a.config.ProfileDir == "" {
+		a.config.ProfileDir = os.TempDir()
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// Start the protocol plugin.
+func (a *AdminPlugin) StartClient(ctx context.Context, handler Handler) error {
+	ln, err := net.Listen("tcp", a.config.Listen)
+	if err != nil {
+		return err
+	}
+	if a.config.Debug {
+		for path, h := range debugHandlers(a.config.ProfileDir) {
+			registerAdminHandler(path, h)
+		}
+	}
+	a.server = &http.Server{Handler: a, ReadHeaderTimeout: 10 * time.Second}
+	log.Info().Str("addr", ln.Addr().String()).Msg("Starting Admin API")
+	go func() {
+		if err := a.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("admin api")
+		}
+	}()
+	return nil
+}
+
+// Stop the protocol plugin.
+func (a *AdminPlugin) StopClient(ctx context.Context) error {
+	if a.server == nil {
+		return nil
+	}
+	if a.config.Debug {
+		for path := range debugHandlers(a.config.ProfileDir) {
+			registerAdminHandler(path, nil)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := a.server.Shutdown(ctx)
+	a.server = nil
+	return err
+}
+
+func (a *AdminPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	return nil
+}
+
+func (a *AdminPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.config.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.URL.Path == "/" {
+		writeAdminJSON(w, adminPaths())
+		return
+	}
+	if h := adminHandler(r.URL.Path); h != nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// adminHandlers are the endpoints of the admin API by path.
+var (
+	adminHandlersMutex sync.RWMutex
+	adminHandlers      = map[string]http.Handler{}
+)
+
+// registerAdminHandler adds an endpoint to the admin API, a nil handler removes
+// it. A path ending with / also serves the paths below it.
+func registerAdminHandler(path string, h http.Handler) {
+	adminHandlersMutex.Lock()
+	defer adminHandlersMutex.Unlock()
+	if h == nil {
+		delete(adminHandlers, path)
+		return
+	}
+	adminHandlers[path] = h
+}
+
+func adminHandler(path string) http.Handler {
+	adminHandlersMutex.RLock()
+	defer adminHandlersMutex.RUnlock()
+	if h, ok := adminHandlers[path]; ok {
+		return h
+	}
+	for p, h := range adminHandlers {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return h
+		}
+	}
+	return nil
+}
+
+func adminPaths() []string {
+	adminHandlersMutex.RLock()
+	defer adminHandlersMutex.RUnlock()
+	paths := make([]string, 0, len(adminHandlers))
+	for p := range adminHandlers {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug().Err(err).Msg("admin api response")
+	}
+}
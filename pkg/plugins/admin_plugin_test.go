@@ -0,0 +1,43 @@
+package plugins
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminPlugin(t *testing.T) {
+	assert := assert.New(t)
+	a := &AdminPlugin{}
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"listen": "8081"}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"token": "secret"}))
+	assert.Equal("127.0.0.1:8081", a.config.Listen)
+
+	registerAdminHandler("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, "ok")
+	}))
+	defer registerAdminHandler("/test", nil)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(http.StatusUnauthorized, get("/test", "").Code)
+	assert.Equal(http.StatusUnauthorized, get("/test", "wrong").Code)
+	w := get("/test", "secret")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("\"ok\"\n", w.Body.String())
+	assert.Contains(get("/", "secret").Body.String(), `"/test"`)
+	assert.Equal(http.StatusNotFound, get("/nope", "secret").Code)
+
+	registerAdminHandler("/test", nil)
+	assert.Equal(http.StatusNotFound, get("/test", "secret").Code)
+}
@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// AnonymizerPlugin replaces the client addresses in the query logs, dnstap and
+// the stats, the same mode is used by all of them. The queries and the access
+// control still see the real addresses.
+type AnonymizerPlugin struct {
+	config     AnonymizerPluginConfig
+	anonymizer utils.IPAnonymizer
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&AnonymizerPlugin{})
+}
+
+func (a *AnonymizerPlugin) Name() string {
+	return "anonymizer"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (a *AnonymizerPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(a.Name(), &a.config, out)
+}
+
+type AnonymizerPluginConfig struct {
+	Mode        string        `toml:"mode" comment:"Anonymization of the client addresses (truncate, hmac, cryptopan)" default:"truncate"`
+	IPv4Prefix  int           `toml:"ipv4Prefix" comment:"IPv4 prefix length kept by truncate" default:"24"`
+	IPv6Prefix  int           `toml:"ipv6Prefix" comment:"IPv6 prefix length kept by truncate" default:"48"`
+	Key         string        `toml:"key" comment:"Secret of hmac, or the 32 bytes hex key of cryptopan, random when empty"`
+	KeyRotation time.Duration `toml:"keyRotation" comment:"Interval of the hmac key rotation, 0 never rotates" default:"24h"`
+}
+
+const (
+	anonymizeTruncate  = "truncate"
+	anonymizeHMAC      = "hmac"
+	anonymizeCryptoPAn = "cryptopan"
+)
+
+// Configure the plugin.
+func (a *AnonymizerPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Msg("AnonymizerPlugin.Configure")
+	a.config = AnonymizerPluginConfig{}
+	if err := UnmarshalConfiguration(config, &a.config); err != nil {
+		return err
+	}
+	anonymizer, err := newClientAnonymizer(a.config)
+	if err != nil {
+		return err
+	}
+	a.anonymizer = anonymizer
+	return nil
+}
+
+func newClientAnonymizer(config AnonymizerPluginConfig) (utils.IPAnonymizer, error) {
+	switch strings.ToLower(config.Mode) {
+	case anonymizeTruncate:
+		if config.IPv4Prefix < 0 || config.IPv4Prefix > 32 || config.IPv6Prefix < 0 || config.IPv6Prefix > 128 {
+			return nil, fmt.Errorf("invalid anonymizer prefix lengths: %v, %v", config.IPv4Prefix, config.IPv6Prefix)
+		}
+		return &utils.TruncateAnonymizer{V4Bits: config.IPv4Prefix, V6Bits: config.IPv6Prefix}, nil
+	case anonymizeHMAC:
+		if config.KeyRotation < 0 {
+			return nil, fmt.Errorf("invalid anonymizer key rotation: %v", config.KeyRotation)
+		}
+		return utils.NewHMACAnonymizer([]byte(config.Key), config.KeyRotation), nil
+	case anonymizeCryptoPAn:
+		key := make([]byte, utils.CryptoPAnKeySize)
+		if config.Key == "" {
+			rand.Read(key)
+		} else if _, err := hex.Decode(key, []byte(config.Key)); err != nil || len(config.Key) != 2*utils.CryptoPAnKeySize {
+			return nil, fmt.Errorf("invalid anonymizer key: %w", utils.ErrCryptoPAnKeySize)
+		}
+		return utils.NewCryptoPAn(key)
+	}
+	return nil, fmt.Errorf("invalid anonymizer mode: %v", config.Mode)
+}
+
+// Start the protocol plugin.
+func (a *AnonymizerPlugin) StartClient(ctx context.Context, handler Handler) error {
+	setClientAnonymizer(a.anonymizer)
+	return nil
+}
+
+// Stop the protocol plugin.
+func (a *AnonymizerPlugin) StopClient(ctx context.Context) error {
+	setClientAnonymizer(nil)
+	return nil
+}
+
+func (a *AnonymizerPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	return nil
+}
+
+// clientAnonymizer is set while the anonymizer plugin runs.
+var (
+	clientAnonymizerMutex sync.RWMutex
+	clientAnonymizer      utils.IPAnonymizer
+)
+
+func setClientAnonymizer(anonymizer utils.IPAnonymizer) {
+	clientAnonymizerMutex.Lock()
+	defer clientAnonymizerMutex.Unlock()
+	clientAnonymizer = anonymizer
+}
+
+// anonymizeClientAddr returns the address to log for a client, the unix socket
+// peers are returned as is.
+func anonymizeClientAddr(addr net.Addr) net.Addr {
+	clientAnonymizerMutex.RLock()
+	anonymizer := clientAnonymizer
+	clientAnonymizerMutex.RUnlock()
+	if anonymizer == nil {
+		return addr
+	}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(anonymizeIP(anonymizer, a.IP), uint16(a.Port)))
+	case *net.TCPAddr:
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(anonymizeIP(anonymizer, a.IP), uint16(a.Port)))
+	}
+	return addr
+}
+
+func anonymizeIP(anonymizer utils.IPAnonymizer, ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return anonymizer.Anonymize(addr.Unmap())
+}
+
+// clientAddr is the address of the client to log, anonymized, or nil.
+func clientAddr(ctx context.Context) net.Addr {
+	remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr)
+	if !ok || remote == nil {
+		return nil
+	}
+	return anonymizeClientAddr(remote)
+}
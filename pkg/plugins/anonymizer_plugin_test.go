@@ -0,0 +1,54 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestAnonymizer(t *testing.T, config map[string]interface{}) {
+	a := &AnonymizerPlugin{}
+	assert.NoError(t, a.Configure(context.Background(), config))
+	assert.NoError(t, a.StartClient(context.Background(), nil))
+	t.Cleanup(func() { a.StopClient(context.Background()) })
+}
+
+func TestAnonymizerConfigure(t *testing.T) {
+	assert := assert.New(t)
+	a := &AnonymizerPlugin{}
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"mode": "scramble"}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"ipv4Prefix": 33}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"mode": "cryptopan", "key": "abcd"}))
+	assert.Error(a.Configure(context.Background(), map[string]interface{}{"mode": "hmac", "keyRotation": "-1h"}))
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{"mode": "CryptoPAn"}))
+	assert.IsType(&utils.CryptoPAn{}, a.anonymizer)
+	assert.NoError(a.Configure(context.Background(), map[string]interface{}{}))
+	assert.Equal(&utils.TruncateAnonymizer{V4Bits: 24, V6Bits: 48}, a.anonymizer)
+}
+
+func TestAnonymizedOutputs(t *testing.T) {
+	assert := assert.New(t)
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.123"), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, "example.com.")
+	_, addr := remoteAddr(ctx)
+	assert.Equal("192.0.2.123:5353", addr)
+
+	startTestAnonymizer(t, map[string]interface{}{"mode": "truncate"})
+	_, addr = remoteAddr(ctx)
+	assert.Equal("192.0.2.0:5353", addr)
+	tmpl, _ := parseQueryLogTemplate("{remote}")
+	assert.Equal("192.0.2.0", string(tmpl.format(nil, ctx, q)))
+	d := &DnstapPlugin{}
+	assert.Equal(netip.MustParseAddrPort("192.0.2.0:5353"), d.clientMessage(ctx, dnstapClientQuery).queryAddr)
+
+	// the unix socket peers have no address
+	ctx, _ = aclQuery(&utils.UnixPeerAddr{Net: "unix", PID: 7, UID: -1, GID: -1}, nil, "example.com.")
+	_, addr = remoteAddr(ctx)
+	assert.Equal("pid=7", addr)
+
+	tcp := anonymizeClientAddr(&net.TCPAddr{IP: net.ParseIP("2001:db8:1:2::5"), Port: 853})
+	assert.Equal("[2001:db8:1::]:853", tcp.String())
+}
@@ -2,10 +2,12 @@ package plugins
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/maypok86/otter"
 	"github.com/miekg/dns"
@@ -28,9 +30,21 @@ func IsNoCache(ctx context.Context) bool {
 	return ResponseMetadata(ctx)[noCacheKey] == true
 }
 
+// SetServedFromCache marks the response as answered from the cache, fresh ("hit") or "stale".
+func SetServedFromCache(ctx context.Context, from string) {
+	ResponseMetadata(ctx)[servedFromCacheKey] = from
+}
+func ServedFromCache(ctx context.Context) string {
+	from, _ := ResponseMetadata(ctx)[servedFromCacheKey].(string)
+	return from
+}
+
+var errNoQuestion = errors.New("message without a single question can't be cached")
+
 // Default configuration values.
 const (
-	noCacheKey = "NoCacheKey"
+	noCacheKey         = "NoCacheKey"
+	servedFromCacheKey = "ServedFromCache"
 )
 
 type CachePluginConfig struct {
@@ -42,6 +56,12 @@ type CachePluginConfig struct {
 	NegativeAnswers  bool          `toml:"negativeAnswers" comment:"Enable Negative Answers Caching" default:"false"`
 }
 
+var (
+	cacheHits   = metrics.GetOrCreateCounter(`dns_cache_lookups_total{result="hit"}`)
+	cacheMisses = metrics.GetOrCreateCounter(`dns_cache_lookups_total{result="miss"}`)
+	cacheStale  = metrics.GetOrCreateCounter(`dns_cache_lookups_total{result="stale"}`)
+)
+
 // Register this plugin with the DNS Forwarder.
 func init() {
 	RegisterPlugin(&CachePlugin{})
@@ -64,10 +84,6 @@ func (c *CachePlugin) Configure(ctx context.Context, config map[string]interface
 		return err
 	}
 
-	if c.CacheKey == nil {
-		c.CacheKey = defaultCacheKeyFunc
-	}
-
 	cache, err := otter.MustBuilder[string, *msgCacheEntry](c.config.MaxElements).
 		CollectStats().
 		WithTTL(c.config.StaleDuration).
@@ -85,33 +101,80 @@ func (c *CachePlugin) Configure(ctx context.Context, config map[string]interface
 func (c *CachePlugin) StartClient(ctx context.Context, handler Handler) error {
 	log.Info().Msg("Starting Cache Plugin")
 	c.handler = handler
+	if c.CacheKey == nil {
+		setCachedQueryProbe(c.isCached)
+	}
+	setPluginMetricsWriter(c.Name(), c.writeMetrics)
 	return nil
 }
 
 // Stop the protocol plugin.
 func (c *CachePlugin) StopClient(ctx context.Context) error {
+	setPluginMetricsWriter(c.Name(), nil)
+	setCachedQueryProbe(nil)
 	c.cache.Clear()
 	return nil
 }
 
 func (c *CachePlugin) Query(ctx context.Context, msg *dns.Msg) error {
-	key, err := c.CacheKey(ctx, msg)
+	if len(msg.Question) != 1 {
+		return nil // not cacheable
+	}
+	key, err := c.cacheKey(ctx, msg)
 	if err != nil {
 		return err
 	}
 	if resp := getCacheMsg(c.cache.Extension(), key, false, c.config.StaleTTL); resp != nil {
 		log.Debug().Str("key", key).Msg("Cache hit")
+		cacheHits.Inc()
 		SetNoCache(ctx, true)
+		SetServedFromCache(ctx, "hit")
 		respMsg := resp.Copy()
 		respMsg.SetReply(msg)
 		_, err = c.handler.Handle(ctx, respMsg)
 	} else {
 		log.Debug().Str("key", key).Msg("Cache miss")
+		cacheMisses.Inc()
 	}
 
 	return err
 }
 
+// cacheKey returns the key of the query, with defaultCacheKeyFunc unless CacheKey is set.
+func (c *CachePlugin) cacheKey(ctx context.Context, msg *dns.Msg) (string, error) {
+	if c.CacheKey != nil {
+		return c.CacheKey(ctx, msg)
+	}
+	return defaultCacheKeyFunc(ctx, msg)
+}
+
+// isCached reports if there's a fresh cached response for the query, without using it.
+// The servers probe before the query has a context, so it only runs with the
+// default key func: a custom CacheKey may depend on the query metadata.
+func (c *CachePlugin) isCached(msg *dns.Msg) bool {
+	if len(msg.Question) != 1 {
+		return false
+	}
+	key, err := defaultCacheKeyFunc(context.Background(), msg)
+	if err != nil {
+		return false
+	}
+	if entry, found := c.cache.Extension().GetEntryQuietly(key); found {
+		return time.Since(entry.Value().received) < entry.Value().ttl
+	}
+	return false
+}
+
+// writeMetrics writes the statistics collected by the cache, the lookups are
+// counted by the plugin as the stale entries are only expired by the plugin.
+func (c *CachePlugin) writeMetrics(w io.Writer) {
+	stats := c.cache.Stats()
+	metrics.WriteCounterUint64(w, `dns_cache_evictions_total`, uint64(stats.EvictedCount()))
+	metrics.WriteCounterUint64(w, `dns_cache_rejected_sets_total`, uint64(stats.RejectedSets()))
+	metrics.WriteGaugeUint64(w, `dns_cache_entries`, uint64(c.cache.Size()))
+	metrics.WriteGaugeUint64(w, `dns_cache_capacity`, uint64(c.cache.Capacity()))
+}
+
 type msgCacheEntry struct {
 	received time.Time
 	ttl      time.Duration
@@ -138,16 +201,21 @@ func getCacheMsg(cacheExt otter.Extension[string, *msgCacheEntry], key string, a
 
 func (c *CachePlugin) Response(ctx context.Context, msg *dns.Msg) error {
 	log.Debug().Msg("Cache Plugin Response")
+	if len(msg.Question) != 1 {
+		return nil // not cacheable
+	}
 
 	// Check stale cache if it's a failure response
 	if c.config.StaleCache && msg.Rcode == dns.RcodeServerFailure {
-		key, err := c.CacheKey(ctx, msg)
+		key, err := c.cacheKey(ctx, msg)
 		if err != nil {
 			return err
 		}
 		if resp := getCacheMsg(c.cache.Extension(), key, c.config.StaleCache, c.config.StaleTTL); resp != nil {
 			log.Debug().Str("key", key).Msg("Stale Cache hit")
+			cacheStale.Inc()
 			SetNoCache(ctx, true)
+			SetServedFromCache(ctx, "stale")
 			respMsg := resp.Copy()
 			respMsg.SetReply(msg)
 			respMsg.CopyTo(msg)
@@ -174,11 +242,12 @@ func (c *CachePlugin) Response(ctx context.Context, msg *dns.Msg) error {
 		return nil
 	}
 
-	key, err := c.CacheKey(ctx, msg)
+	key, err := c.cacheKey(ctx, msg)
 	if err != nil {
 		return err
 	}
-	if c.cache.Set(key, &msgCacheEntry{msg: msg, received: time.Now(), ttl: ttl}) {
+	// store a copy, the plugins after the cache may still change the response.
+	if c.cache.Set(key, &msgCacheEntry{msg: msg.Copy(), received: time.Now(), ttl: ttl}) {
 		log.Debug().Str("key", key).Stringer("ttl", ttl).Msg("Cache set")
 	} else {
 		log.Debug().Str("key", key).Stringer("ttl", ttl).Msg("Cache set failed")
@@ -187,6 +256,9 @@ func (c *CachePlugin) Response(ctx context.Context, msg *dns.Msg) error {
 }
 
 func defaultCacheKeyFunc(ctx context.Context, msg *dns.Msg) (string, error) {
+	if len(msg.Question) != 1 {
+		return "", errNoQuestion
+	}
 	qname := msg.Question[0].Name
 	qclass := msg.Question[0].Qclass
 	qtype := msg.Question[0].Qtype
@@ -0,0 +1,73 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePluginMetrics(t *testing.T) {
+	assert := assert.New(t)
+	c := &CachePlugin{}
+	assert.NoError(c.Configure(context.Background(), map[string]interface{}{"maxElements": 100}))
+	answered := 0
+	assert.NoError(c.StartClient(context.Background(), HandlerFunc(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		answered++
+		return nil, nil
+	})))
+	hits, misses := cacheHits.Get(), cacheMisses.Get()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	assert.NoError(c.Query(CreateNewHandlerCtx(), q))
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}})
+	assert.NoError(c.Response(CreateNewHandlerCtx(), r))
+	assert.NoError(c.Query(CreateNewHandlerCtx(), q))
+	assert.Equal(1, answered)
+	assert.Equal(hits+1, cacheHits.Get())
+	assert.Equal(misses+1, cacheMisses.Get())
+
+	var buf bytes.Buffer
+	writePluginMetrics(&buf)
+	assert.Contains(buf.String(), "dns_cache_entries 1\n")
+	assert.Contains(buf.String(), "dns_cache_evictions_total 0\n")
+
+	assert.NoError(c.StopClient(context.Background()))
+	buf.Reset()
+	writePluginMetrics(&buf)
+	assert.NotContains(buf.String(), "dns_cache_entries")
+}
+
+func TestCachePluginProbe(t *testing.T) {
+	assert := assert.New(t)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}})
+
+	c := &CachePlugin{}
+	assert.NoError(c.Configure(context.Background(), map[string]interface{}{"maxElements": 100}))
+	assert.NoError(c.StartClient(context.Background(), HandlerFunc(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) { return nil, nil })))
+	assert.False(isCachedQuery(q))
+	assert.NoError(c.Response(CreateNewHandlerCtx(), r))
+	assert.True(isCachedQuery(q))
+	assert.NoError(c.StopClient(context.Background()))
+	assert.False(isCachedQuery(q))
+
+	// a custom key may use the query metadata, which the probe doesn't have
+	c = &CachePlugin{CacheKey: func(ctx context.Context, m *dns.Msg) (string, error) {
+		QueryMetadata(ctx)["keyed"] = true
+		return defaultCacheKeyFunc(ctx, m)
+	}}
+	assert.NoError(c.Configure(context.Background(), map[string]interface{}{"maxElements": 100}))
+	assert.NoError(c.StartClient(context.Background(), HandlerFunc(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) { return nil, nil })))
+	defer c.StopClient(context.Background())
+	assert.NoError(c.Response(CreateNewHandlerCtx(), r))
+	assert.False(isCachedQuery(q))
+}
@@ -2,6 +2,7 @@ package plugins
 
 import (
 	"context"
+	"time"
 )
 
 // Context Metadata
@@ -26,8 +27,41 @@ type metadataKeyType string
 const (
 	responseMetadataKey = metadataKeyType("responseMetadata")
 	queryMetadataKey    = metadataKeyType("queryMetadata")
+
+	upstreamKey   = "Upstream"
+	serverKey     = "Server"
+	queryStartKey = "QueryStart"
 )
 
+// SetUpstream records the upstream nameserver that answered the query.
+func SetUpstream(ctx context.Context, upstream string) {
+	if metadata := ResponseMetadata(ctx); metadata != nil {
+		metadata[upstreamKey] = upstream
+	}
+}
+func Upstream(ctx context.Context) string {
+	upstream, _ := ResponseMetadata(ctx)[upstreamKey].(string)
+	return upstream
+}
+
+// SetServer records the name of the server plugin that received the query.
+func SetServer(ctx context.Context, server string) {
+	QueryMetadata(ctx)[serverKey] = server
+}
+func Server(ctx context.Context) string {
+	server, _ := QueryMetadata(ctx)[serverKey].(string)
+	return server
+}
+
+// SetQueryStart records when the forwarder started processing the query.
+func SetQueryStart(ctx context.Context, start time.Time) {
+	QueryMetadata(ctx)[queryStartKey] = start
+}
+func QueryStart(ctx context.Context) time.Time {
+	start, _ := QueryMetadata(ctx)[queryStartKey].(time.Time)
+	return start
+}
+
 func CreateNewHandlerCtx() context.Context {
 	return ResponseCtx(QueryCtx(context.Background()))
 }
@@ -0,0 +1,312 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+)
+
+// dnstap messages (https://dnstap.info/) encoded by hand, see dnstap.proto, and
+// written as Frame Streams (https://github.com/farsightsec/fstrm).
+
+// dnstap Message.Type
+const (
+	dnstapClientQuery       = 5
+	dnstapClientResponse    = 6
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// dnstap SocketFamily and SocketProtocol
+const (
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	return append(binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v))), v...)
+}
+
+func appendFixed32Field(b []byte, field int, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(appendTag(b, field, wireFixed32), v)
+}
+
+// dnstapMessage is a dnstap Message, the query is sent from queryAddr to responseAddr.
+type dnstapMessage struct {
+	typ          int
+	protocol     string // net.Addr network
+	queryAddr    netip.AddrPort
+	responseAddr netip.AddrPort
+	queryTime    time.Time
+	queryMsg     []byte
+	responseTime time.Time
+	responseMsg  []byte
+}
+
+func (m *dnstapMessage) appendMessage(b []byte) []byte {
+	b = appendVarintField(b, 1, uint64(m.typ))
+	switch {
+	case m.queryAddr.Addr().Is4() || m.responseAddr.Addr().Is4():
+		b = appendVarintField(b, 2, dnstapFamilyINET)
+	case m.queryAddr.IsValid() || m.responseAddr.IsValid():
+		b = appendVarintField(b, 2, dnstapFamilyINET6)
+	}
+	switch m.protocol {
+	case protoUDP:
+		b = appendVarintField(b, 3, dnstapProtocolUDP)
+	case protoTCP:
+		b = appendVarintField(b, 3, dnstapProtocolTCP)
+	}
+	if m.queryAddr.IsValid() {
+		b = appendBytesField(b, 4, m.queryAddr.Addr().AsSlice())
+	}
+	if m.responseAddr.IsValid() {
+		b = appendBytesField(b, 5, m.responseAddr.Addr().AsSlice())
+	}
+	if m.queryAddr.IsValid() {
+		b = appendVarintField(b, 6, uint64(m.queryAddr.Port()))
+	}
+	if m.responseAddr.IsValid() {
+		b = appendVarintField(b, 7, uint64(m.responseAddr.Port()))
+	}
+	if !m.queryTime.IsZero() {
+		b = appendVarintField(b, 8, uint64(m.queryTime.Unix()))
+		b = appendFixed32Field(b, 9, uint32(m.queryTime.Nanosecond()))
+	}
+	if m.queryMsg != nil {
+		b = appendBytesField(b, 10, m.queryMsg)
+	}
+	if !m.responseTime.IsZero() {
+		b = appendVarintField(b, 12, uint64(m.responseTime.Unix()))
+		b = appendFixed32Field(b, 13, uint32(m.responseTime.Nanosecond()))
+	}
+	if m.responseMsg != nil {
+		b = appendBytesField(b, 14, m.responseMsg)
+	}
+	return b
+}
+
+// frame encodes the Dnstap message as a Frame Streams data frame.
+func (m *dnstapMessage) frame(identity, version []byte) []byte {
+	msg := m.appendMessage(make([]byte, 0, 64+len(m.queryMsg)+len(m.responseMsg)))
+	b := make([]byte, 4, 4+len(msg)+len(identity)+len(version)+16)
+	if len(identity) > 0 {
+		b = appendBytesField(b, 1, identity)
+	}
+	if len(version) > 0 {
+		b = appendBytesField(b, 2, version)
+	}
+	b = appendBytesField(b, 14, msg)
+	b = appendVarintField(b, 15, 1) // Dnstap.Type MESSAGE
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+// dnstapAddrPort converts the TCP and UDP addresses, the others are invalid.
+func dnstapAddrPort(addr net.Addr) netip.AddrPort {
+	ip, ok := utils.AddrToNetIP(addr)
+	if !ok {
+		return netip.AddrPort{}
+	}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return netip.AddrPortFrom(ip, uint16(a.Port))
+	case *net.TCPAddr:
+		return netip.AddrPortFrom(ip, uint16(a.Port))
+	}
+	return netip.AddrPortFrom(ip, 0)
+}
+
+// Frame Streams control frames
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+
+	fstrmMaxControlSize = 512
+)
+
+// fstrmControlFrame encodes an escaped control frame with an optional content type.
+func fstrmControlFrame(control uint32, contentType string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0) // escape
+	size := 4
+	if contentType != "" {
+		size += 8 + len(contentType)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = binary.BigEndian.AppendUint32(b, control)
+	if contentType != "" {
+		b = binary.BigEndian.AppendUint32(b, fstrmFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+	return b
+}
+
+// readFstrmControlFrame reads a control frame, returning its type and content types.
+func readFstrmControlFrame(r io.Reader) (uint32, []string, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	if binary.BigEndian.Uint32(hdr) != 0 {
+		return 0, nil, errors.New("frame streams: expected a control frame")
+	}
+	size := binary.BigEndian.Uint32(hdr[4:])
+	if size < 4 || size > fstrmMaxControlSize {
+		return 0, nil, fmt.Errorf("frame streams: invalid control frame size %d", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	control, b := binary.BigEndian.Uint32(b), b[4:]
+	types := []string{}
+	for len(b) >= 8 {
+		field, n := binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+		if uint32(len(b)-8) < n {
+			return 0, nil, errors.New("frame streams: truncated control field")
+		}
+		if field == fstrmFieldContentType {
+			types = append(types, string(b[8:8+n]))
+		}
+		b = b[8+n:]
+	}
+	return control, types, nil
+}
+
+// dnstapOutput receives batches of complete data frames.
+type dnstapOutput interface {
+	io.Writer
+	// close ends the stream.
+	close() error
+}
+
+// openDnstapOutput opens unix:///path, tcp://host:port or file:///path.
+func openDnstapOutput(output string, timeout time.Duration, maxSize int64, maxBackups int) (dnstapOutput, error) {
+	scheme, addr, ok := strings.Cut(output, "://")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("invalid dnstap output: %v", output)
+	}
+	switch scheme {
+	case protoUnix, protoTCP:
+		c, err := dialFstrm(scheme, addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "file":
+		f := &utils.RotatingFile{Path: addr, MaxSize: maxSize, MaxBackups: maxBackups,
+			Header: fstrmControlFrame(fstrmControlStart, dnstapContentType),
+			Footer: fstrmControlFrame(fstrmControlStop, "")}
+		if err := f.Open(); err != nil {
+			return nil, err
+		}
+		return &fstrmFile{f}, nil
+	}
+	return nil, fmt.Errorf("invalid dnstap output: %v", output)
+}
+
+func validDnstapOutput(output string) error {
+	scheme, addr, ok := strings.Cut(output, "://")
+	if !ok || addr == "" || (scheme != protoUnix && scheme != protoTCP && scheme != "file") {
+		return fmt.Errorf("invalid dnstap output: %v", output)
+	}
+	return nil
+}
+
+type fstrmFile struct {
+	*utils.RotatingFile
+}
+
+func (f *fstrmFile) close() error {
+	return f.RotatingFile.Close()
+}
+
+// fstrmConn is a bidirectional Frame Streams connection to a collector.
+type fstrmConn struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// dialFstrm connects and negotiates the dnstap content type.
+func dialFstrm(network, addr string, timeout time.Duration) (*fstrmConn, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &fstrmConn{conn: conn, timeout: timeout}
+	if err := c.handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *fstrmConn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(fstrmControlFrame(fstrmControlReady, dnstapContentType)); err != nil {
+		return err
+	}
+	control, types, err := readFstrmControlFrame(c.conn)
+	if err != nil {
+		return err
+	}
+	if control != fstrmControlAccept || !slices.Contains(types, dnstapContentType) {
+		return fmt.Errorf("frame streams: %v not accepted by the collector", dnstapContentType)
+	}
+	_, err = c.conn.Write(fstrmControlFrame(fstrmControlStart, dnstapContentType))
+	return err
+}
+
+func (c *fstrmConn) Write(b []byte) (int, error) {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.conn.Write(b)
+}
+
+// close sends STOP and waits for the FINISH of the collector.
+func (c *fstrmConn) close() error {
+	defer c.conn.Close()
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(fstrmControlFrame(fstrmControlStop, "")); err != nil {
+		return err
+	}
+	control, _, err := readFstrmControlFrame(c.conn)
+	if err == nil && control != fstrmControlFinish {
+		err = errors.New("frame streams: expected FINISH")
+	}
+	return err
+}
@@ -0,0 +1,289 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// DnstapPlugin logs the client queries and responses, and the queries forwarded
+// upstream with their responses, as dnstap messages. The messages are written
+// as Frame Streams to a collector on a unix socket or tcp, or to a rotating
+// file. Logging never blocks the queries, messages over the buffer are dropped.
+type DnstapPlugin struct {
+	config   DnstapPluginConfig
+	identity []byte
+	version  []byte
+	frames   chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&DnstapPlugin{})
+}
+
+func (p *DnstapPlugin) Name() string {
+	return "dnstap"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (p *DnstapPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(p.Name(), &p.config, out)
+}
+
+type DnstapPluginConfig struct {
+	Output             string        `toml:"output" comment:"Frame Streams output: unix:///path, tcp://host:port or file:///path" default:"unix:///var/run/dnstap.sock"`
+	Identity           string        `toml:"identity" comment:"Server identity, the hostname when empty"`
+	Version            string        `toml:"version" comment:"Server version" default:"dns-forwarder"`
+	ClientQueries      bool          `toml:"clientQueries" comment:"Log CLIENT_QUERY messages" default:"true"`
+	ClientResponses    bool          `toml:"clientResponses" comment:"Log CLIENT_RESPONSE messages" default:"true"`
+	ForwarderQueries   bool          `toml:"forwarderQueries" comment:"Log FORWARDER_QUERY messages" default:"true"`
+	ForwarderResponses bool          `toml:"forwarderResponses" comment:"Log FORWARDER_RESPONSE messages" default:"true"`
+	BufferSize         int           `toml:"bufferSize" comment:"Max messages waiting to be written, more are dropped" default:"10000"`
+	Timeout            time.Duration `toml:"timeout" comment:"Timeout connecting and writing to a collector" default:"2s"`
+	ReconnectInterval  time.Duration `toml:"reconnectInterval" comment:"Wait before reconnecting to a collector or reopening the file" default:"5s"`
+	FileMaxSize        int           `toml:"fileMaxSizeMB" comment:"Rotate the file at this size in MB, 0 never rotates" default:"100"`
+	FileMaxBackups     int           `toml:"fileMaxBackups" comment:"Rotated files kept" default:"5"`
+}
+
+var (
+	dnstapSent             = metrics.GetOrCreateCounter(`dns_dnstap_sent_total`)
+	dnstapDroppedFull      = metrics.GetOrCreateCounter(`dns_dnstap_dropped_total{reason="buffer_full"}`)
+	dnstapDroppedWriteFail = metrics.GetOrCreateCounter(`dns_dnstap_dropped_total{reason="write_error"}`)
+)
+
+const (
+	dnstapQueryTimeKey = "dnstapQueryTime"
+
+	// dnstapBatchSize is the size of the writes, when enough frames are waiting.
+	dnstapBatchSize = 64 * 1024
+)
+
+// Configure the plugin.
+func (p *DnstapPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("DnstapPlugin.Configure")
+	p.config = DnstapPluginConfig{}
+	if err := UnmarshalConfiguration(config, &p.config); err != nil {
+		return err
+	}
+	if err := validDnstapOutput(p.config.Output); err != nil {
+		return err
+	}
+	if p.config.BufferSize < 1 {
+		return fmt.Errorf("invalid dnstap buffer size: %v", p.config.BufferSize)
+	}
+	identity := p.config.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	p.identity, p.version = []byte(identity), []byte(p.config.Version)
+	log.Debug().Msgf("DnstapPlugin: %#v", p.config)
+	return nil
+}
+
+// Start the protocol plugin.
+func (p *DnstapPlugin) StartClient(ctx context.Context, handler Handler) error {
+	p.frames = make(chan []byte, p.config.BufferSize)
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go p.run(p.frames, p.done)
+	if p.config.ForwarderQueries || p.config.ForwarderResponses {
+		setForwarderTap(p.Name(), p.tapForwarder)
+	}
+	return nil
+}
+
+// Stop the protocol plugin, the queued messages are written first.
+func (p *DnstapPlugin) StopClient(ctx context.Context) error {
+	setForwarderTap(p.Name(), nil)
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+		p.done = nil
+	}
+	return nil
+}
+
+func (p *DnstapPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	now := time.Now()
+	QueryMetadata(ctx)[dnstapQueryTimeKey] = now
+	if !p.config.ClientQueries {
+		return nil
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	m := p.clientMessage(ctx, dnstapClientQuery)
+	m.queryTime, m.queryMsg = now, wire
+	p.emit(m)
+	return nil
+}
+
+func (p *DnstapPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	if !p.config.ClientResponses {
+		return nil
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	m := p.clientMessage(ctx, dnstapClientResponse)
+	m.queryTime, _ = QueryMetadata(ctx)[dnstapQueryTimeKey].(time.Time)
+	m.responseTime, m.responseMsg = time.Now(), wire
+	p.emit(m)
+	return nil
+}
+
+// clientMessage is a message between the client and the listener of the query.
+func (p *DnstapPlugin) clientMessage(ctx context.Context, typ int) *dnstapMessage {
+	m := &dnstapMessage{typ: typ}
+	if remote := clientAddr(ctx); remote != nil {
+		m.protocol = remote.Network()
+		m.queryAddr = dnstapAddrPort(remote)
+	}
+	if local, ok := QueryMetadata(ctx)["LocalAddr"].(net.Addr); ok && local != nil {
+		m.responseAddr = dnstapAddrPort(local)
+	}
+	return m
+}
+
+func (p *DnstapPlugin) tapForwarder(ctx context.Context, m *dnstapMessage, resp []byte) {
+	if p.config.ForwarderQueries {
+		q := *m
+		q.typ = dnstapForwarderQuery
+		p.emit(&q)
+	}
+	if resp != nil && p.config.ForwarderResponses {
+		r := *m
+		r.typ = dnstapForwarderResponse
+		r.responseTime, r.responseMsg = time.Now(), resp
+		p.emit(&r)
+	}
+}
+
+// emit queues the message without blocking, it is dropped when the buffer is full.
+func (p *DnstapPlugin) emit(m *dnstapMessage) {
+	select {
+	case p.frames <- m.frame(p.identity, p.version):
+	default:
+		dnstapDroppedFull.Inc()
+	}
+}
+
+// run writes the frames to the output, reconnecting after the errors.
+func (p *DnstapPlugin) run(frames chan []byte, done chan struct{}) {
+	defer p.wg.Done()
+	batch := make([]byte, 0, dnstapBatchSize)
+	for {
+		out, err := openDnstapOutput(p.config.Output, p.config.Timeout, int64(p.config.FileMaxSize)<<20, p.config.FileMaxBackups)
+		if err == nil {
+			log.Info().Str("output", p.config.Output).Msg("dnstap output opened")
+			stopped := p.write(out, frames, done, batch)
+			if err := out.close(); err != nil {
+				log.Debug().Err(err).Str("output", p.config.Output).Msg("dnstap output close")
+			}
+			if stopped {
+				return
+			}
+		} else {
+			log.Warn().Err(err).Str("output", p.config.Output).Msg("dnstap output unavailable")
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(p.config.ReconnectInterval):
+		}
+	}
+}
+
+// write sends the queued frames in batches, it returns true once stopped and
+// the queue is empty, false after a write error.
+func (p *DnstapPlugin) write(out dnstapOutput, frames chan []byte, done chan struct{}, batch []byte) bool {
+	stopped := false
+	for {
+		n := 0
+		batch = batch[:0]
+		select {
+		case f := <-frames:
+			batch = append(batch, f...)
+			n++
+		case <-done:
+			stopped = true
+		}
+	fill:
+		for len(batch) < dnstapBatchSize {
+			select {
+			case f := <-frames:
+				batch = append(batch, f...)
+				n++
+			default:
+				break fill
+			}
+		}
+		if n > 0 {
+			if _, err := out.Write(batch); err != nil {
+				dnstapDroppedWriteFail.Add(n)
+				log.Warn().Err(err).Str("output", p.config.Output).Msg("dnstap write failed")
+				return false
+			}
+			dnstapSent.Add(n)
+		}
+		if stopped && len(frames) == 0 {
+			return true
+		}
+	}
+}
+
+// forwarderTaps receive the queries sent upstream with their responses, nil
+// when the exchange failed, by plugin name. They are set while the dnstap and
+// pcap plugins run.
+var (
+	forwarderTapsMutex sync.RWMutex
+	forwarderTaps      = map[string]func(ctx context.Context, m *dnstapMessage, resp []byte){}
+)
+
+// setForwarderTap adds the tap of a plugin, a nil tap removes it.
+func setForwarderTap(name string, tap func(ctx context.Context, m *dnstapMessage, resp []byte)) {
+	forwarderTapsMutex.Lock()
+	defer forwarderTapsMutex.Unlock()
+	if tap == nil {
+		delete(forwarderTaps, name)
+		return
+	}
+	forwarderTaps[name] = tap
+}
+
+// tapForwarderExchange reports a query sent to the upstream with its response.
+func tapForwarderExchange(ctx context.Context, proto string, local net.Addr, upstream string, query []byte, sent time.Time, resp []byte, err error) {
+	forwarderTapsMutex.RLock()
+	defer forwarderTapsMutex.RUnlock()
+	if len(forwarderTaps) == 0 {
+		return
+	}
+	m := &dnstapMessage{protocol: proto, queryAddr: dnstapAddrPort(local), queryTime: sent, queryMsg: query}
+	if m.queryAddr.Addr().IsUnspecified() {
+		// the wildcard bind address isn't the source address
+		m.queryAddr = netip.AddrPort{}
+	}
+	if up, perr := netip.ParseAddrPort(upstream); perr == nil {
+		m.responseAddr = netip.AddrPortFrom(up.Addr().Unmap(), up.Port())
+	}
+	if err != nil {
+		resp = nil
+	}
+	for _, tap := range forwarderTaps {
+		tap(ctx, m, resp)
+	}
+}
@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// protoFields decodes a protobuf message, the varint and fixed32 values are
+// returned as uint64 and the bytes as []byte.
+func protoFields(t *testing.T, b []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if !assert.Greater(t, n, 0) {
+			return fields
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], v)
+			b = b[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		case wireFixed32:
+			fields[field] = append(fields[field], uint64(binary.LittleEndian.Uint32(b)))
+			b = b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// readDnstapFrames reads the data frames up to the STOP control frame.
+func readDnstapFrames(t *testing.T, r io.Reader) [][]byte {
+	frames := [][]byte{}
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); !assert.NoError(t, err) {
+			return frames
+		}
+		if size == 0 {
+			// control frame: length and type
+			hdr := make([]byte, 8)
+			if _, err := io.ReadFull(r, hdr); !assert.NoError(t, err) {
+				return frames
+			}
+			io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(hdr))-4)
+			if binary.BigEndian.Uint32(hdr[4:]) == fstrmControlStop {
+				return frames
+			}
+			continue
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); !assert.NoError(t, err) {
+			return frames
+		}
+		frames = append(frames, b)
+	}
+}
+
+// dnstapMessages returns the decoded Message of each Dnstap frame.
+func dnstapMessages(t *testing.T, frames [][]byte) []map[int][]interface{} {
+	msgs := []map[int][]interface{}{}
+	for _, f := range frames {
+		d := protoFields(t, f)
+		assert.Equal(t, []byte("test"), d[1][0])
+		assert.Equal(t, []byte("v1"), d[2][0])
+		assert.Equal(t, uint64(1), d[15][0])
+		msgs = append(msgs, protoFields(t, d[14][0].([]byte)))
+	}
+	return msgs
+}
+
+func newTestDnstap(t *testing.T, config map[string]interface{}) *DnstapPlugin {
+	config["identity"], config["version"] = "test", "v1"
+	p := &DnstapPlugin{}
+	assert.NoError(t, p.Configure(context.Background(), config))
+	assert.NoError(t, p.StartClient(context.Background(), nil))
+	return p
+}
+
+func dnstapExchange(t *testing.T, p *DnstapPlugin) {
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, "example.com.")
+	assert.NoError(t, p.Query(ctx, q))
+	wire, _ := q.Pack()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rwire, _ := r.Pack()
+	tapForwarderExchange(ctx, protoUDP, &net.UDPAddr{IP: net.IPv4zero, Port: 40000}, "198.51.100.1:53", wire, time.Now(), rwire, nil)
+	tapForwarderExchange(ctx, protoTCP, nil, "198.51.100.2:53", wire, time.Now(), nil, io.EOF)
+	assert.NoError(t, p.Response(ctx, r))
+}
+
+func assertDnstapExchange(t *testing.T, msgs []map[int][]interface{}) {
+	assert := assert.New(t)
+	if !assert.GreaterOrEqual(len(msgs), 4) {
+		return
+	}
+	types := []uint64{}
+	for _, m := range msgs[:4] {
+		types = append(types, m[1][0].(uint64))
+	}
+	assert.Equal([]uint64{dnstapClientQuery, dnstapForwarderQuery, dnstapForwarderResponse, dnstapForwarderQuery}, types)
+
+	cq := msgs[0]
+	assert.Equal(uint64(dnstapFamilyINET), cq[2][0])
+	assert.Equal(uint64(dnstapProtocolUDP), cq[3][0])
+	assert.Equal([]byte{192, 0, 2, 1}, cq[4][0])
+	assert.Equal([]byte{192, 0, 2, 53}, cq[5][0])
+	assert.Equal(uint64(5353), cq[6][0])
+	assert.Equal(uint64(53), cq[7][0])
+	q := new(dns.Msg)
+	assert.NoError(q.Unpack(cq[10][0].([]byte)))
+	assert.Equal("example.com.", q.Question[0].Name)
+
+	// the wildcard source address is left out
+	fr := msgs[2]
+	assert.Nil(fr[4])
+	assert.Equal([]byte{198, 51, 100, 1}, fr[5][0])
+	assert.NotNil(fr[14])
+	// a failed exchange has no response
+	assert.Equal(uint64(dnstapProtocolTCP), msgs[3][3][0])
+	assert.Nil(msgs[3][14])
+}
+
+func TestDnstapUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", path)
+	assert.NoError(err)
+	defer l.Close()
+
+	received := make(chan [][]byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if !assert.NoError(err) {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		control, types, err := readFstrmControlFrame(conn)
+		assert.NoError(err)
+		assert.Equal(uint32(fstrmControlReady), control)
+		assert.Contains(types, dnstapContentType)
+		conn.Write(fstrmControlFrame(fstrmControlAccept, dnstapContentType))
+		control, _, err = readFstrmControlFrame(conn)
+		assert.NoError(err)
+		assert.Equal(uint32(fstrmControlStart), control)
+		frames := readDnstapFrames(t, conn)
+		conn.Write(fstrmControlFrame(fstrmControlFinish, ""))
+		received <- frames
+	}()
+
+	p := newTestDnstap(t, map[string]interface{}{"output": "unix://" + path})
+	dnstapExchange(t, p)
+	assert.NoError(p.StopClient(context.Background()))
+
+	select {
+	case frames := <-received:
+		msgs := dnstapMessages(t, frames)
+		assertDnstapExchange(t, msgs)
+		if assert.Len(msgs, 5) {
+			assert.Equal(uint64(dnstapClientResponse), msgs[4][1][0])
+			assert.NotNil(msgs[4][8])
+			assert.NotNil(msgs[4][14])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frames received")
+	}
+}
+
+func TestDnstapFile(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	p := newTestDnstap(t, map[string]interface{}{"output": "file://" + path, "clientResponses": false})
+	dnstapExchange(t, p)
+	assert.NoError(p.StopClient(context.Background()))
+
+	f, err := os.Open(path)
+	assert.NoError(err)
+	defer f.Close()
+	control, types, err := readFstrmControlFrame(f)
+	assert.NoError(err)
+	assert.Equal(uint32(fstrmControlStart), control)
+	assert.Equal([]string{dnstapContentType}, types)
+	msgs := dnstapMessages(t, readDnstapFrames(t, f))
+	assertDnstapExchange(t, msgs)
+	assert.Len(msgs, 4)
+
+	// the forwarder isn't tapped once stopped
+	tapForwarderExchange(context.Background(), protoUDP, nil, "198.51.100.1:53", nil, time.Now(), nil, nil)
+}
+
+func TestDnstapDropsWhenFull(t *testing.T) {
+	assert := assert.New(t)
+	// nothing listens, the messages wait in the buffer
+	p := newTestDnstap(t, map[string]interface{}{
+		"output":     "unix://" + filepath.Join(t.TempDir(), "none.sock"),
+		"bufferSize": 2,
+	})
+	defer p.StopClient(context.Background())
+	dropped := dnstapDroppedFull.Get()
+	dnstapExchange(t, p)
+	assert.Equal(uint64(3), dnstapDroppedFull.Get()-dropped)
+}
+
+func TestDnstapConfigure(t *testing.T) {
+	assert := assert.New(t)
+	p := &DnstapPlugin{}
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"output": "/var/run/dnstap.sock"}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"output": "udp://127.0.0.1:6000"}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"bufferSize": 0}))
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{}))
+	assert.Equal("unix:///var/run/dnstap.sock", p.config.Output)
+	assert.NotEmpty(p.identity)
+	assert.True(p.config.ForwarderResponses)
+}
@@ -3,6 +3,7 @@ package plugins
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	iradix "github.com/hashicorp/go-immutable-radix/v2"
 	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/miekg/dns"
@@ -21,6 +23,7 @@ type DO53ClientPlugin struct {
 	baseConfig DO53ClientPluginConfig
 	handler    Handler
 	clients    *iradix.Tree[*do53client]
+	udpPool    udpConnPool
 }
 
 type DO53ClientPluginConfig struct {
@@ -28,8 +31,9 @@ type DO53ClientPluginConfig struct {
 	Upstream           []string `toml:"upstream" comment:"Address and Port of upstream nameserver"`
 	UdpConnPoolSize    int      `toml:"udpConnectionPoolSize" comment:"UDP Connection Pool Size" default:"8000"`
 	Timeout            string   `toml:"timeout" comment:"Timeout duration" default:"2s"`
+	MaxUDPPayload      int      `toml:"maxUDPPayloadSize" comment:"Max UDP response size advertised upstream with EDNS" default:"1232"`
+	PMTUDiscovery      string   `toml:"pmtuDiscovery" comment:"Path MTU discovery on the udp sockets (default, omit, dont, do), omit avoids fragmentation attacks, not per domain" default:"omit"`
 	timeoutDuration    time.Duration
-	//UDPSize            uint16   `toml:"udpsize" comment:"Max size of UDP response" default:"1232"`
 }
 
 // Register this plugin with the DNS Forwarder.
@@ -56,6 +60,9 @@ func (d *DO53ClientPlugin) Configure(ctx context.Context, config map[string]inte
 	if err := UnmarshalConfiguration(config, &d.baseConfig); err != nil {
 		return err
 	}
+	if err := utils.ValidPMTUMode(d.baseConfig.PMTUDiscovery); err != nil {
+		return err
+	}
 	log.Debug().Any("base config", d.baseConfig).Msg("DO53ClientPlugin.Configure")
 
 	// get each domain configured
@@ -68,6 +75,10 @@ func (d *DO53ClientPlugin) Configure(ctx context.Context, config map[string]inte
 
 		client := &do53client{domain: domain}
 
+		// the domains share the udp sockets of the base config
+		if _, ok := cfg.(map[string]interface{})["pmtuDiscovery"]; ok {
+			return fmt.Errorf("pmtuDiscovery can't be set for the domain %v, only in the base config", domain)
+		}
 		if err := UnmarshalConfiguration(cfg.(map[string]interface{}), &client.config); err != nil {
 			return err
 		}
@@ -106,7 +117,7 @@ func (d *DO53ClientPlugin) StartClient(ctx context.Context, handler Handler) err
 	tries := 0
 ConnFill:
 	for i := udpPool.Len(); i < udpPool.Cap(); i++ {
-		conn := createUDPConn()
+		conn := createUDPConn(d.baseConfig.PMTUDiscovery)
 		if conn == nil {
 			if tries < 3 {
 				tries++
@@ -122,6 +133,8 @@ ConnFill:
 	}
 
 	d.handler = handler
+	d.udpPool = udpPool
+	setPluginMetricsWriter(d.Name(), d.writeMetrics)
 	it := d.clients.Root().Iterator()
 	for k, client, ok := it.Next(); ok; k, client, ok = it.Next() {
 		log.Debug().Str("domain", string(k)).Msg("Starting DO53 Client")
@@ -132,16 +145,13 @@ ConnFill:
 	return nil
 }
 
-func createUDPConn() *net.UDPConn {
-	lAddr, err := net.ResolveUDPAddr(udpProto, ":0")
-	if err != nil {
-		log.Error().Err(err).Msg("ResolveUDPAddr failed")
-	}
-	conn, err := net.ListenUDP(udpProto, lAddr)
+func createUDPConn(pmtuMode string) *net.UDPConn {
+	conn, err := udpListenConfig(pmtuMode).ListenPacket(context.Background(), udpProto, ":0")
 	if err != nil {
 		log.Error().Err(err).Msg("ListenUDP failed")
+		return nil
 	}
-	return conn
+	return conn.(*net.UDPConn)
 }
 
 /*
@@ -157,8 +167,16 @@ func createTCPConn() *net.TCPConn {
 	return conn
 }
 */
+// writeMetrics writes the use of the udp connection pool shared by the upstreams.
+func (d *DO53ClientPlugin) writeMetrics(w io.Writer) {
+	idle := d.udpPool.Len()
+	metrics.WriteGaugeUint64(w, `dns_upstream_udp_conns{state="idle"}`, idle)
+	metrics.WriteGaugeUint64(w, `dns_upstream_udp_conns{state="in_use"}`, d.udpPool.Cap()-min(idle, d.udpPool.Cap()))
+}
+
 // Stop the protocol plugin.
 func (d *DO53ClientPlugin) StopClient(ctx context.Context) error {
+	setPluginMetricsWriter(d.Name(), nil)
 	it := d.clients.Root().Iterator()
 	for k, client, ok := it.Next(); ok; k, client, ok = it.Next() {
 		log.Debug().Str("domain", string(k)).Msg("Stopping DO53 Client")
@@ -213,42 +231,57 @@ func (d *do53client) StopClient(ctx context.Context) error {
 
 func (d *do53client) Query(ctx context.Context, msg *dns.Msg) error {
 	//log.Debug().Msgf("DO53ClientPlugin.Query: %v\n", msg)
+	msg = capEDNSUDPSize(msg, d.config.MaxUDPPayload)
 	msg.Compress = true
 	q, err := msg.Pack()
 	if err != nil {
 		return err
 	}
 
-	var resp []byte
 	up := d.config.pickUpstream()
 	log.Debug().Msgf("sending udp query to upstream: %v", up)
 	c := d.udpConn()
 	if c == nil {
+		countUpstreamError(up, protoUDP, "no_conn")
 		return fmt.Errorf("no udp connections available")
 	}
 	defer d.udpPool.Enqueue(c)
-	resp, _ /*rtt*/, err = udpQuery(c, up, d.config.timeoutDuration, q)
+	sent := time.Now()
+	resp, rtt, err := udpQuery(c, up, d.config.timeoutDuration, q)
+	tapForwarderExchange(ctx, protoUDP, c.LocalAddr(), up, q, sent, resp, err)
+	observeUpstream(up, protoUDP, rtt, err)
 
 	respMsg := &dns.Msg{}
 	respMsg.Compress = true
 	if err == nil {
-		err = respMsg.Unpack(resp)
+		if err = respMsg.Unpack(resp); err != nil {
+			countUpstreamError(up, protoUDP, "malformed")
+		}
 	}
+	traceUpstream(ctx, protoUDP, up, sent, respMsg, err)
 
 	if respMsg.Truncated || (d.config.AlwaysRetryOverTcp && err != nil) {
 		log.Debug().Msgf("sending tcp query to upstream: %v due to truncation? %v", up, respMsg.Truncated)
 		// is resp is truncated or some udp error, try tcp..
-		resp, _ /*rtt*/, err = tcpQuery(up, d.config.timeoutDuration, q)
+		sent = time.Now()
+		resp, rtt, err = tcpQuery(up, d.config.timeoutDuration, q)
+		tapForwarderExchange(ctx, protoTCP, nil, up, q, sent, resp, err)
+		observeUpstream(up, protoTCP, rtt, err)
 		if err != nil {
+			traceUpstream(ctx, protoTCP, up, sent, nil, err)
 			return fmt.Errorf("upstream: %v tcp error: %w", up, err)
 		}
 		if err = respMsg.Unpack(resp); err != nil {
+			countUpstreamError(up, protoTCP, "malformed")
+			traceUpstream(ctx, protoTCP, up, sent, nil, err)
 			return fmt.Errorf("upstream: %v unpack error: %w", up, err)
 		}
+		traceUpstream(ctx, protoTCP, up, sent, respMsg, nil)
 	}
 	if err != nil {
 		return fmt.Errorf("upstream: %v %w", up, err)
 	}
+	SetUpstream(ctx, up)
 	// send back through the handler..
 	if d.handler != nil {
 		_, err = d.handler.Handle(ctx, respMsg)
@@ -256,6 +289,61 @@ func (d *do53client) Query(ctx context.Context, msg *dns.Msg) error {
 	return err
 }
 
+// capEDNSUDPSize lowers the EDNS udp size sent upstream to maxPayload, so large
+// responses come back truncated and are retried over tcp instead of being
+// fragmented. The query is copied when changed, it is shared with the other plugins.
+func capEDNSUDPSize(msg *dns.Msg, maxPayload int) *dns.Msg {
+	opt := msg.IsEdns0()
+	if opt == nil || maxPayload <= 0 || int(opt.UDPSize()) <= maxPayload {
+		return msg
+	}
+	msg = msg.Copy()
+	msg.IsEdns0().SetUDPSize(uint16(max(maxPayload, dns.MinMsgSize)))
+	return msg
+}
+
+type upstreamSeriesKey struct{ upstream, proto string }
+
+// upstreamSeries are the series of an upstream and protocol.
+type upstreamSeries struct {
+	requests *metrics.Counter
+	rtt      *metrics.Histogram
+}
+
+type upstreamErrorKey struct{ upstream, proto, reason string }
+
+var (
+	upstreamSeriesCache = utils.NewSeriesCache(func(k upstreamSeriesKey) *upstreamSeries {
+		return &upstreamSeries{
+			requests: metrics.GetOrCreateCounter(fmt.Sprintf(`dns_upstream_requests_total{upstream=%q,proto=%q}`, k.upstream, k.proto)),
+			rtt:      metrics.GetOrCreateHistogram(fmt.Sprintf(`dns_upstream_rtt_seconds{upstream=%q,proto=%q}`, k.upstream, k.proto)),
+		}
+	})
+	upstreamErrors = utils.NewSeriesCache(func(k upstreamErrorKey) *metrics.Counter {
+		return metrics.GetOrCreateCounter(fmt.Sprintf(`dns_upstream_errors_total{upstream=%q,proto=%q,reason=%q}`, k.upstream, k.proto, k.reason))
+	})
+)
+
+// observeUpstream counts an exchange with an upstream, with the rtt when it answered.
+func observeUpstream(upstream, proto string, rtt time.Duration, err error) {
+	series := upstreamSeriesCache.Get(upstreamSeriesKey{upstream, proto})
+	series.requests.Inc()
+	if err != nil {
+		reason := "error"
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			reason = "timeout"
+		}
+		countUpstreamError(upstream, proto, reason)
+		return
+	}
+	series.rtt.Update(rtt.Seconds())
+}
+
+func countUpstreamError(upstream, proto, reason string) {
+	upstreamErrors.Get(upstreamErrorKey{upstream, proto, reason}).Inc()
+}
+
 const (
 	maxUDPPacketSize = 4096
 	udpProto         = "udp"
@@ -0,0 +1,66 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	iradix "github.com/hashicorp/go-immutable-radix/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDO53ClientDomainPMTU(t *testing.T) {
+	assert := assert.New(t)
+	d := &DO53ClientPlugin{clients: iradix.New[*do53client]()}
+	assert.NoError(d.Configure(context.Background(), map[string]interface{}{
+		"pmtuDiscovery": "do",
+		"example.com":   map[string]interface{}{"upstream": []string{"192.0.2.53:53"}},
+	}))
+	assert.Equal("do", d.baseConfig.PMTUDiscovery)
+
+	d = &DO53ClientPlugin{clients: iradix.New[*do53client]()}
+	assert.Error(d.Configure(context.Background(), map[string]interface{}{
+		"example.com": map[string]interface{}{"upstream": []string{"192.0.2.53:53"}, "pmtuDiscovery": "do"},
+	}))
+}
+
+func TestCapEDNSUDPSize(t *testing.T) {
+	assert := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.Same(req, capEDNSUDPSize(req, 1232))
+
+	req.SetEdns0(4096, false)
+	capped := capEDNSUDPSize(req, 1232)
+	assert.NotSame(req, capped)
+	assert.Equal(uint16(1232), capped.IsEdns0().UDPSize())
+	assert.Equal(uint16(4096), req.IsEdns0().UDPSize())
+
+	req.IsEdns0().SetUDPSize(1000)
+	assert.Same(req, capEDNSUDPSize(req, 1232))
+	assert.Same(req, capEDNSUDPSize(req, 0))
+}
+
+func TestObserveUpstream(t *testing.T) {
+	assert := assert.New(t)
+	up := "192.0.2.99:53"
+	observeUpstream(up, protoUDP, 5*time.Millisecond, nil)
+	observeUpstream(up, protoUDP, 0, os.ErrDeadlineExceeded)
+	observeUpstream(up, protoTCP, 0, errors.New("connection refused"))
+	countUpstreamError(up, protoUDP, "malformed")
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	out := buf.String()
+	assert.Contains(out, `dns_upstream_requests_total{upstream="192.0.2.99:53",proto="udp"} 2`)
+	assert.Contains(out, `dns_upstream_rtt_seconds_count{upstream="192.0.2.99:53",proto="udp"} 1`)
+	assert.NotContains(out, `dns_upstream_rtt_seconds_count{upstream="192.0.2.99:53",proto="tcp"}`)
+	assert.Contains(out, `dns_upstream_errors_total{upstream="192.0.2.99:53",proto="udp",reason="timeout"} 1`)
+	assert.Contains(out, `dns_upstream_errors_total{upstream="192.0.2.99:53",proto="udp",reason="malformed"} 1`)
+	assert.Contains(out, `dns_upstream_errors_total{upstream="192.0.2.99:53",proto="tcp",reason="error"} 1`)
+}
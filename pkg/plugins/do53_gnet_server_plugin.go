@@ -3,16 +3,18 @@ package plugins
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
 	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/miekg/dns"
-	ants "github.com/panjf2000/ants/v2"
 	"github.com/panjf2000/gnet/v2"
 	"github.com/panjf2000/gnet/v2/pkg/logging"
 	"github.com/rs/zerolog"
@@ -21,11 +23,13 @@ import (
 
 type DO53GnetServerPlugin struct {
 	config     DO53GnetServerPluginConfig
-	udpPool    *ants.MultiPoolWithFunc
-	tcpPool    *ants.MultiPoolWithFunc
+	udpQueue   *queryQueue
+	tcpQueue   *queryQueue
 	engines    []gnet.Engine
 	mutex      sync.Mutex
 	startMutex sync.Mutex
+	tcpConns   *tcpConnTracker
+	pmtuFds    sync.Map
 }
 
 // Register this plugin with the DNS Forwarder.
@@ -35,6 +39,7 @@ func init() {
 	s.config.TcpEventLoopCount = runtime.NumCPU()
 	s.config.UdpEventLoopCount = runtime.NumCPU()
 	RegisterPlugin(s)
+	tcpFramePool.New = newTCPFrame
 }
 
 func (d *DO53GnetServerPlugin) Name() string {
@@ -47,16 +52,31 @@ func (d *DO53GnetServerPlugin) PrintHelp(out io.Writer) {
 }
 
 type DO53GnetServerPluginConfig struct {
-	Listen            string        `toml:"listen" comment:"Listen Address and Port" default:"53"`
-	PoolSizeTCP       int           `toml:"tcpPoolSize" comment:"Worker Pool Size" default:"10"`
-	PoolSizeUDP       int           `toml:"udpPoolSize" comment:"Worker Pool Size" default:"10"`
-	TcpEventLoopCount int           `toml:"tcpEventLoopCount" comment:"Count of TCP Event Loops"`
-	UdpEventLoopCount int           `toml:"udpEventLoopCount" comment:"Count of TCP Event Loops"`
-	TcpBufferSize     int           `toml:"tcpBufferSize" comment:"Size TCP socket buffers" default:"10240"`
-	UdpBufferSize     int           `toml:"udpBufferSize" comment:"Size UDP socket buffers" default:"10240"`
-	MaxQueriesPerTCP  int           `toml:"maxQueriesPerTCPStream" comment:"Size UDP socket buffers" default:"50"`
-	TcpKeepAlive      time.Duration `toml:"tcpKeepAlive" comment:"time to maintain tcp keep-alive" default:"10s"`
-	EnableLogging     bool          `toml:"enableLogging" comment:"Enable Logging on gnet" default:"false"`
+	Listen            ListenAddrs      `toml:"listen" comment:"Listen Addresses and Ports, 53 when no listen or listeners are set"`
+	Listeners         []ListenerConfig `toml:"listeners" comment:"Listeners with interface, family or protocol selection"`
+	PoolSizeTCP       int              `toml:"tcpPoolSize" comment:"Worker Pool Size" default:"10"`
+	PoolSizeUDP       int              `toml:"udpPoolSize" comment:"Worker Pool Size" default:"10"`
+	TcpEventLoopCount int              `toml:"tcpEventLoopCount" comment:"Count of TCP Event Loops"`
+	UdpEventLoopCount int              `toml:"udpEventLoopCount" comment:"Count of TCP Event Loops"`
+	TcpBufferSize     int              `toml:"tcpBufferSize" comment:"Size TCP socket buffers" default:"10240"`
+	UdpBufferSize     int              `toml:"udpBufferSize" comment:"Size UDP socket buffers" default:"10240"`
+	MaxQueriesPerTCP  int              `toml:"maxQueriesPerTCPStream" comment:"Max pipelined queries read from a TCP stream at once" default:"50"`
+	TcpKeepAlive      time.Duration    `toml:"tcpKeepAlive" comment:"time to maintain tcp keep-alive" default:"10s"`
+	EnableLogging     bool             `toml:"enableLogging" comment:"Enable Logging on gnet" default:"false"`
+	MaxUDPPayload     int              `toml:"maxUDPPayloadSize" comment:"Max UDP response size, smaller client EDNS sizes are honored" default:"1232"`
+	PMTUDiscovery     string           `toml:"pmtuDiscovery" comment:"Path MTU discovery on the udp sockets (default, omit, dont, do), omit avoids fragmentation attacks" default:"omit"`
+
+	QueueSize           int    `toml:"queueSize" comment:"Max queries waiting for a worker, per protocol, the overload action applies beyond it" default:"1000"`
+	OverloadAction      string `toml:"overloadAction" comment:"Action for the queries over the queue size (refuse, servfail, drop)" default:"refuse"`
+	PrioritizeCacheHits bool   `toml:"prioritizeCacheHits" comment:"Process queries answered from the cache ahead of the others, not with a custom cache key, TCP has its own workers" default:"false"`
+
+	TcpIdleTimeout       time.Duration `toml:"tcpIdleTimeout" comment:"Close TCP connections idle this long, advertised with edns-tcp-keepalive" default:"10s"`
+	MaxTCPConns          int           `toml:"maxTCPConnections" comment:"Max concurrent TCP connections, the oldest idle is closed at the limit (0 is unlimited)" default:"1000"`
+	MaxTCPConnsPerClient int           `toml:"maxTCPConnectionsPerClient" comment:"Max concurrent TCP connections per client address (0 is unlimited)" default:"20"`
+
+	ProxyProtocol        bool     `toml:"proxyProtocol" comment:"Accept PROXY protocol v1/v2 headers on TCP connections" default:"false"`
+	ProxyProtocolTrusted []string `toml:"proxyProtocolTrusted" comment:"Source CIDRs allowed to send PROXY protocol headers, required with proxyProtocol"`
+	proxyTrusted         []netip.Prefix
 }
 
 // Configure the plugin.
@@ -66,15 +86,35 @@ func (d *DO53GnetServerPlugin) Configure(ctx context.Context, config map[string]
 	if err := UnmarshalConfiguration(config, &d.config); err != nil {
 		return err
 	}
+	var err error
+	if d.config.proxyTrusted, err = utils.ParsePrefixes(d.config.ProxyProtocolTrusted); err != nil {
+		return err
+	}
+	if d.config.ProxyProtocol && len(d.config.proxyTrusted) == 0 {
+		// any client could choose its address otherwise
+		return errNoProxyTrusted
+	}
+	if err = validOverloadAction(d.config.OverloadAction); err != nil {
+		return err
+	}
+	if err = utils.ValidPMTUMode(d.config.PMTUDiscovery); err != nil {
+		return err
+	}
+	if d.config.MaxQueriesPerTCP < 1 {
+		return fmt.Errorf("invalid max queries per TCP stream: %v", d.config.MaxQueriesPerTCP)
+	}
 	log.Debug().Msgf("DO53GnetServerPlugin: %#v", d.config)
 	return nil
 }
 
 type gReqResp struct {
 	req        *dns.Msg
+	errResp    *dns.Msg
 	localAddr  net.Addr
 	remoteAddr net.Addr
 	conn       gnet.Conn
+	tcp        bool
+	tracked    *tcpConnEntry
 }
 
 // type responseKeyType string
@@ -90,11 +130,20 @@ func (d *DO53GnetServerPlugin) StartServer(sctx context.Context, handler Handler
 
 	poolJob := func(input interface{}) {
 		r := input.(*gReqResp)
-		qctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, r.conn)
+		qctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, r)
 
 		// todo make part of CreateNewHandlerCtx?
 		QueryMetadata(qctx)["LocalAddr"] = r.localAddr
 		QueryMetadata(qctx)["RemoteAddr"] = r.remoteAddr
+		SetServer(qctx, d.Name())
+		if r.errResp != nil {
+			// rejected by the validation, answered without the plugins
+			d.Response(qctx, r.errResp)
+			r.tracked.touch()
+			return
+		}
+		QueryMetadata(qctx)[udpSizeKey] = requestUDPSize(r.req)
+		QueryMetadata(qctx)[tcpKeepaliveKey] = r.tcp && requestsTCPKeepalive(r.req)
 
 		ResponseMetadata(qctx)[responseWritten] = false
 
@@ -103,36 +152,73 @@ func (d *DO53GnetServerPlugin) StartServer(sctx context.Context, handler Handler
 		if !ResponseMetadata(qctx)[responseWritten].(bool) {
 			d.Response(qctx, utils.SynthesizeErrorResponse(r.req))
 		}
+		r.tracked.touch()
 	}
 
-	udpPool, err := ants.NewMultiPoolWithFunc(10, d.config.PoolSizeUDP, poolJob, ants.LeastTasks, ants.WithPreAlloc(true))
-	if err != nil {
-		return err
-	}
-	d.udpPool = udpPool
-
-	tcpPool, err := ants.NewMultiPoolWithFunc(10, d.config.PoolSizeTCP, poolJob, ants.LeastTasks, ants.WithPreAlloc(true))
-	if err != nil {
-		return err
-	}
-	d.tcpPool = tcpPool
+	d.udpQueue = newQueryQueue(d.Name()+"-udp", d.config.PoolSizeUDP, d.config.QueueSize, poolJob)
+	d.tcpQueue = newQueryQueue(d.Name()+"-tcp", d.config.PoolSizeTCP, d.config.QueueSize, poolJob)
+	d.tcpConns = newTCPConnTracker(d.config.MaxTCPConns, d.config.MaxTCPConnsPerClient)
+	d.pmtuFds.Range(func(fd, _ any) bool {
+		d.pmtuFds.Delete(fd)
+		return true
+	})
 
 	// start listeners
-	err = d.ListenTCP()
+	endpoints, err := resolveListenEndpoints(d.config.Listen, d.config.Listeners)
 	if err != nil {
 		d.StopServer(sctx)
 		return err
 	}
+	tcpAddrs, udpAddrs, unixEndpoints := []string{}, []string{}, []listenEndpoint{}
+	for _, ep := range endpoints {
+		switch ep.proto {
+		case protoTCP:
+			tcpAddrs = append(tcpAddrs, ep.String())
+		case protoUnix:
+			if ep.address != strings.ToLower(ep.address) {
+				// gnet lowercases the listen addresses
+				d.StopServer(sctx)
+				return fmt.Errorf("gnetdns unix socket paths must be lowercase: %s", ep)
+			}
+			unixEndpoints = append(unixEndpoints, ep)
+		case protoUnixgram:
+			d.StopServer(sctx)
+			return fmt.Errorf("gnetdns doesn't support unix datagram sockets: %s", ep)
+		default:
+			udpAddrs = append(udpAddrs, ep.String())
+		}
+	}
 
-	log.Info().Msgf("Started DO53 TCP Server on %s", d.config.Listen)
+	if len(tcpAddrs) > 0 {
+		err = d.ListenTCP(tcpAddrs)
+		if err != nil {
+			d.StopServer(sctx)
+			return err
+		}
+		log.Info().Msgf("Started DO53 TCP Server on %s", strings.Join(tcpAddrs, ", "))
+	}
 
-	err = d.ListenUDP()
-	if err != nil {
-		d.StopServer(sctx)
-		return err
+	if len(udpAddrs) > 0 {
+		err = d.ListenUDP(udpAddrs)
+		if err != nil {
+			d.StopServer(sctx)
+			return err
+		}
+		log.Info().Msgf("Started DO53 UDP Server on %s", strings.Join(udpAddrs, ", "))
 	}
 
-	log.Info().Msgf("Started DO53 UDP Server on %s", d.config.Listen)
+	if len(unixEndpoints) > 0 {
+		err = d.ListenUnix(unixEndpoints)
+		if err != nil {
+			d.StopServer(sctx)
+			return err
+		}
+		unixAddrs := []string{}
+		for _, ep := range unixEndpoints {
+			unixAddrs = append(unixAddrs, ep.String())
+		}
+		log.Info().Msgf("Started DO53 Unix Server on %s", strings.Join(unixAddrs, ", "))
+	}
 
 	return nil
 }
@@ -149,29 +235,41 @@ func (d *DO53GnetServerPlugin) StopServer(ctx context.Context) error {
 		e.Stop(ctx)
 	}
 
-	d.udpPool.ReleaseTimeout(1 * time.Millisecond)
-	d.tcpPool.ReleaseTimeout(1 * time.Millisecond)
+	d.udpQueue.stop()
+	d.udpQueue = nil
+	d.tcpQueue.stop()
+	d.tcpQueue = nil
 	return nil
 }
 
 func (d *DO53GnetServerPlugin) Response(ctx context.Context, msg *dns.Msg) error {
 	log.Debug().Msgf("Response: %v", msg)
 	// get the response key and writer and write to it.
+	r, ok := ctx.Value(responseWriterKey).(*gReqResp)
+	if !ok {
+		// received by another server plugin
+		return nil
+	}
 	ResponseMetadata(ctx)[responseWritten] = true
 	msg.Compress = true
-	// todo use a buffer pool
-	out, err := msg.Pack()
+	c := r.conn
+	if r.tcp {
+		if QueryMetadata(ctx)[tcpKeepaliveKey] == true {
+			msg = addTCPKeepalive(msg, d.config.TcpIdleTimeout)
+		}
+		return d.writeTCP(c, msg)
+	}
+
+	buf := getPackBuffer()
+	defer putPackBuffer(buf)
+	out, err := msg.PackBuffer(*buf)
 	if err != nil {
 		return err
 	}
-	c := ctx.Value(responseWriterKey).(gnet.Conn)
-	if isTcp(c) {
-		lenPrefix := make([]byte, 2)
-		binary.BigEndian.PutUint16(lenPrefix, uint16(len(out)))
-		n, err := c.Write(lenPrefix)
-		if n != 2 {
-			log.Error().Err(err).Msgf("response write error")
-			return fmt.Errorf("response write error")
+	// packing first saves computing the length of the responses that fit
+	if len(out) > udpResponseSize(ctx, d.config.MaxUDPPayload) {
+		if out, err = truncateUDPResponse(ctx, msg, d.config.MaxUDPPayload).PackBuffer(*buf); err != nil {
+			return err
 		}
 	}
 	n, err := c.Write(out)
@@ -183,6 +281,50 @@ func (d *DO53GnetServerPlugin) Response(ctx context.Context, msg *dns.Msg) error
 	return err
 }
 
+// tcpFrame is a pooled buffer for a length prefixed tcp response, done returns
+// it to the pool once gnet wrote it.
+type tcpFrame struct {
+	buf  []byte
+	done gnet.AsyncCallback
+}
+
+var tcpFramePool sync.Pool // New is set in init, it refers to the pool
+
+func newTCPFrame() any {
+	f := &tcpFrame{buf: make([]byte, 2+packBufferSize)}
+	f.done = func(gnet.Conn, error) error {
+		tcpFramePool.Put(f)
+		return nil
+	}
+	return f
+}
+
+// writeTCP packs the response after room for the length prefix in the pooled buffer,
+// then queues the frame as one write on the event loop. This keeps pipelined
+// responses written by concurrent workers from interleaving and the worker never
+// blocks on the socket. The buffer is returned to the pool once written.
+func (d *DO53GnetServerPlugin) writeTCP(c gnet.Conn, msg *dns.Msg) error {
+	f := tcpFramePool.Get().(*tcpFrame)
+	out, err := msg.PackBuffer(f.buf[2:])
+	if err != nil {
+		tcpFramePool.Put(f)
+		return err
+	}
+	prefix := f.buf[:2]
+	binary.BigEndian.PutUint16(prefix, uint16(len(out)))
+	if &out[0] == &f.buf[2] {
+		err = c.AsyncWrite(f.buf[:2+len(out)], f.done)
+	} else {
+		// too large for the pooled buffer, write the prefix and the message together
+		err = c.AsyncWritev([][]byte{prefix, out}, f.done)
+	}
+	if err != nil {
+		tcpFramePool.Put(f)
+		log.Error().Err(err).Msgf("response write error")
+	}
+	return err
+}
+
 // Gnet Events
 func (d *DO53GnetServerPlugin) OnBoot(eng gnet.Engine) (action gnet.Action) {
 	d.startMutex.Unlock()
@@ -204,79 +346,189 @@ func (d *DO53GnetServerPlugin) OnShutdown(eng gnet.Engine) {
 	}
 }
 
+// gnetConnState is the per connection state of a tcp connection.
+type gnetConnState struct {
+	proxyPending bool
+	remoteAddr   net.Addr
+	tracked      *tcpConnEntry
+}
+
 func (d *DO53GnetServerPlugin) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
+	if isStream(c) {
+		state := &gnetConnState{}
+		remote := c.RemoteAddr()
+		if _, unix := c.LocalAddr().(*net.UnixAddr); unix {
+			state.remoteAddr = unixFdPeer(c.Fd())
+			remote = state.remoteAddr
+		} else {
+			state.proxyPending = d.config.ProxyProtocol && utils.IsTrustedAddr(remote, d.config.proxyTrusted)
+		}
+		if state.proxyPending {
+			// charged to the client of the PROXY header once read
+			remote = nil
+		}
+		if state.tracked = d.tcpConns.open(remote, func() { c.Close() }); state.tracked == nil {
+			return nil, gnet.Close
+		}
+		c.SetContext(state)
+	}
 	return
 }
 
+// readProxyHeader consumes a PROXY protocol header at the start of the connection,
+// it returns false when more data is needed or the connection must close.
+func (d *DO53GnetServerPlugin) readProxyHeader(c gnet.Conn, state *gnetConnState) (ready bool, action gnet.Action) {
+	buf, err := c.Peek(-1)
+	if err != nil {
+		return false, gnet.None
+	}
+	hdr, n, err := utils.ParseProxyHeader(buf)
+	switch {
+	case errors.Is(err, utils.ErrProxyHeaderIncomplete):
+		return false, gnet.None
+	case errors.Is(err, utils.ErrNoProxyHeader):
+	case err != nil:
+		log.Error().Err(err).Stringer("remote", c.RemoteAddr()).Msg("invalid PROXY protocol header")
+		return false, gnet.Close
+	default:
+		c.Discard(n)
+		if hdr.Source != nil {
+			state.remoteAddr = hdr.Source
+		}
+	}
+	state.proxyPending = false
+	remote := c.RemoteAddr()
+	if state.remoteAddr != nil {
+		remote = state.remoteAddr
+	}
+	if !d.tcpConns.assign(state.tracked, remote) {
+		return false, gnet.Close
+	}
+	return true, gnet.None
+}
+
 func (d *DO53GnetServerPlugin) OnClose(c gnet.Conn, err error) (action gnet.Action) {
+	if state, ok := c.Context().(*gnetConnState); ok {
+		d.tcpConns.release(state.tracked)
+	}
 	return
 }
 
-func isTcp(c gnet.Conn) bool {
-	_, tcp := c.LocalAddr().(*net.TCPAddr)
-	return tcp
+// isStream reports a tcp or unix stream connection.
+func isStream(c gnet.Conn) bool {
+	_, udp := c.LocalAddr().(*net.UDPAddr)
+	return !udp
 }
 
 func (d *DO53GnetServerPlugin) OnTraffic(c gnet.Conn) (action gnet.Action) {
 	log.Debug().Msgf("OnTraffic: %v", c)
-	in := []byte{}
-	var err error
-	tcp := isTcp(c)
-	if tcp {
-		// could be multiple queries in one packet
-		for i := 0; c.InboundBuffered() > 0 && i < d.config.MaxQueriesPerTCP; i++ {
-			in, err = c.Peek(2)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to read length")
-				return
-			}
-			inLen := binary.BigEndian.Uint16(in)
-			if c.InboundBuffered() >= int(2+inLen) {
-				c.Discard(2)
-				in, err = c.Next(int(inLen))
-			} else {
-				log.Error().Uint16("inLen", inLen).Msg("failed to read")
-				return
+	if !isStream(c) {
+		in, err := c.Next(-1)
+		if err != nil || len(in) == 0 {
+			return
+		}
+		d.configureUDPSocket(c)
+		d.dispatch(c, in, c.RemoteAddr(), nil, d.udpQueue)
+		return
+	}
+
+	remote := c.RemoteAddr()
+	var tracked *tcpConnEntry
+	if state, ok := c.Context().(*gnetConnState); ok {
+		tracked = state.tracked
+		tracked.touch()
+		if state.proxyPending {
+			if ready, action := d.readProxyHeader(c, state); !ready {
+				return action
 			}
 		}
-	} else {
-		in, err = c.Next(-1)
+		if state.remoteAddr != nil {
+			remote = state.remoteAddr
+		}
+	}
+
+	// RFC 7766 pipelining, each framed query is dispatched on its own and
+	// partial frames stay buffered until the rest arrives.
+	for i := 0; i < d.config.MaxQueriesPerTCP; i++ {
+		inLen, ok := nextTCPFrameLen(c)
+		if !ok {
+			return
+		}
+		if inLen == 0 {
+			return gnet.Close
+		}
+		c.Discard(2)
+		in, err := c.Next(inLen)
+		if err != nil {
+			log.Error().Err(err).Int("inLen", inLen).Msg("failed to read")
+			return gnet.Close
+		}
+		d.dispatch(c, in, remote, tracked, d.tcpQueue)
+	}
+
+	// more complete queries are waiting, come back after the other connections had a turn.
+	if _, ok := nextTCPFrameLen(c); ok {
+		c.Wake(nil)
 	}
+	return
+}
 
-	if err != nil || len(in) == 0 {
+// configureUDPSocket sets the path MTU discovery mode of the listening socket on its
+// first query, gnet creates the udp sockets without a hook to set options.
+func (d *DO53GnetServerPlugin) configureUDPSocket(c gnet.Conn) {
+	fd := c.Fd()
+	if _, done := d.pmtuFds.LoadOrStore(fd, struct{}{}); done {
 		return
 	}
+	if err := setPMTUDiscovery(uintptr(fd), d.config.PMTUDiscovery); err != nil {
+		log.Warn().Err(err).Int("fd", fd).Msg("failed to set the path MTU discovery mode")
+	}
+}
 
-	req := new(dns.Msg)
-	err = req.Unpack(in)
+// nextTCPFrameLen returns the length of the next message when it is completely buffered.
+func nextTCPFrameLen(c gnet.Conn) (int, bool) {
+	if c.InboundBuffered() < 2 {
+		return 0, false
+	}
+	lenBuf, err := c.Peek(2)
 	if err != nil {
-		log.Error().Err(err).Msg("Unpack")
+		return 0, false
+	}
+	inLen := int(binary.BigEndian.Uint16(lenBuf))
+	return inLen, c.InboundBuffered() >= 2+inLen
+}
+
+func (d *DO53GnetServerPlugin) dispatch(c gnet.Conn, in []byte, remote net.Addr, tracked *tcpConnEntry, queue *queryQueue) {
+	req, errResp := unpackQuery(in)
+	if req == nil && errResp == nil {
 		return
 	}
 
-	jobParam := &gReqResp{req: req, conn: c,
-		remoteAddr: utils.DeepCopyAddr(c.RemoteAddr()),
+	// the protocol is kept with the query, gnet releases a udp conn once OnTraffic returns.
+	jobParam := &gReqResp{req: req, errResp: errResp, conn: c, tcp: isStream(c), tracked: tracked,
+		remoteAddr: utils.DeepCopyAddr(remote),
 		localAddr:  utils.DeepCopyAddr(c.LocalAddr())}
 
-	if tcp {
-		d.tcpPool.Invoke(jobParam)
-	} else {
-		d.udpPool.Invoke(jobParam)
+	if queue.submit(jobParam, d.config.PrioritizeCacheHits && isCachedQuery(req)) {
+		return
+	}
+	// overloaded, answer right away from the event loop
+	resp := errResp
+	if req != nil {
+		resp = shedResponse(d.Name(), req, d.config.OverloadAction)
+	}
+	if resp != nil {
+		d.Response(context.WithValue(CreateNewHandlerCtx(), responseWriterKey, jobParam), resp)
 	}
-
-	return
 }
 
+// OnTick only runs on the tcp and unix engines, it closes the idle connections.
 func (d *DO53GnetServerPlugin) OnTick() (delay time.Duration, action gnet.Action) {
-	return
+	d.tcpConns.closeIdle(d.config.TcpIdleTimeout)
+	return max(d.config.TcpIdleTimeout/4, 100*time.Millisecond), gnet.None
 }
 
-func (d *DO53GnetServerPlugin) ListenTCP() error {
-	//addr := ":0"
-	proto := "tcp"
-	// if proto == "tcp6" {
-	// 	addr = "[::]:0"
-	// }
+func (d *DO53GnetServerPlugin) ListenTCP(addrs []string) error {
 	lvl := logging.FatalLevel
 	if d.config.EnableLogging {
 		lvl = mapCurentLogLevelToGnet()
@@ -286,7 +538,7 @@ func (d *DO53GnetServerPlugin) ListenTCP() error {
 	d.startMutex.Lock()
 	defer d.startMutex.Unlock()
 	go func() {
-		err = gnet.Run(d, proto+"://"+d.config.Listen,
+		err = gnet.Rotate(d, addrs,
 			gnet.WithLogger(&gnetLogAdapter{}),
 			gnet.WithLogLevel(lvl),
 			gnet.WithEdgeTriggeredIO(true),
@@ -295,7 +547,8 @@ func (d *DO53GnetServerPlugin) ListenTCP() error {
 			gnet.WithReuseAddr(true),
 			gnet.WithReadBufferCap(d.config.TcpBufferSize),
 			gnet.WithSocketRecvBuffer(d.config.TcpBufferSize),
-			gnet.WithTCPKeepAlive(d.config.TcpKeepAlive))
+			gnet.WithTCPKeepAlive(d.config.TcpKeepAlive),
+			gnet.WithTicker(d.config.TcpIdleTimeout > 0))
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to start TCP server")
 			d.startMutex.Unlock()
@@ -305,14 +558,51 @@ func (d *DO53GnetServerPlugin) ListenTCP() error {
 	return err
 }
 
-func (d *DO53GnetServerPlugin) ListenUDP() error {
+// ListenUnix serves the unix stream sockets on their own engine, gnet disables
+// SO_REUSEPORT for all the listeners of an engine with a unix socket.
+func (d *DO53GnetServerPlugin) ListenUnix(endpoints []listenEndpoint) error {
+	lvl := logging.FatalLevel
+	if d.config.EnableLogging {
+		lvl = mapCurentLogLevelToGnet()
+	}
+	addrs := []string{}
+	for _, ep := range endpoints {
+		if err := removeStaleSocket(ep.address); err != nil {
+			return err
+		}
+		addrs = append(addrs, ep.String())
+	}
+
+	var err error
+	d.startMutex.Lock()
+	go func() {
+		err = gnet.Rotate(d, addrs,
+			gnet.WithLogger(&gnetLogAdapter{}),
+			gnet.WithLogLevel(lvl),
+			gnet.WithEdgeTriggeredIO(true),
+			gnet.WithNumEventLoop(d.config.TcpEventLoopCount),
+			gnet.WithReadBufferCap(d.config.TcpBufferSize),
+			gnet.WithSocketRecvBuffer(d.config.TcpBufferSize),
+			gnet.WithTicker(d.config.TcpIdleTimeout > 0))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to start Unix server")
+			d.startMutex.Unlock()
+		}
+	}()
+	d.startMutex.Lock()
+	d.startMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		if err := setSocketAccess(ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	//	net.ResolveUDPAddr("udp", d.config.Listen)
-	// addr := ":0"
-	proto := "udp"
-	// if proto == "udp6" {
-	// 	addr = "[::]:0"
-	// }
+func (d *DO53GnetServerPlugin) ListenUDP(addrs []string) error {
 	lvl := logging.FatalLevel
 	if d.config.EnableLogging {
 		lvl = mapCurentLogLevelToGnet()
@@ -322,9 +612,7 @@ func (d *DO53GnetServerPlugin) ListenUDP() error {
 	d.startMutex.Lock()
 	defer d.startMutex.Unlock()
 	go func() {
-		// TODO: IP_PMTUDISC_OMIT
-		// https://github.com/PowerDNS/pdns/issues/7619 & https://github.com/PowerDNS/pdns/pull/7410/files
-		err = gnet.Run(d, proto+"://"+d.config.Listen,
+		err = gnet.Rotate(d, addrs,
 			gnet.WithLogger(&gnetLogAdapter{}),
 			gnet.WithLogLevel(lvl),
 			gnet.WithEdgeTriggeredIO(true),
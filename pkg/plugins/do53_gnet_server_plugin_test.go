@@ -0,0 +1,190 @@
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/panjf2000/gnet/v2"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func freePort(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func newTestGnetServer(t *testing.T, config map[string]interface{}) *DO53GnetServerPlugin {
+	s := &DO53GnetServerPlugin{}
+	s.config.TcpEventLoopCount = 1
+	s.config.UdpEventLoopCount = 1
+	assert.NoError(t, s.Configure(context.Background(), config))
+	return s
+}
+
+func startTestServer(t *testing.T, s ProtocolServerPlugin, handler HandlerFunc) {
+	assert.NoError(t, s.StartServer(context.Background(), handler))
+	t.Cleanup(func() { s.StopServer(context.Background()) })
+}
+
+func TestGnetServerConfigure(t *testing.T) {
+	assert := assert.New(t)
+	s := &DO53GnetServerPlugin{}
+	// no query would ever be read from the TCP streams
+	assert.Error(s.Configure(context.Background(), map[string]interface{}{"maxQueriesPerTCPStream": 0}))
+	assert.NoError(s.Configure(context.Background(), map[string]interface{}{"maxQueriesPerTCPStream": 1}))
+}
+
+func TestGnetServerTCPPipelining(t *testing.T) {
+	assert := assert.New(t)
+	addr := "127.0.0.1:" + freePort(t)
+
+	s := newTestGnetServer(t, map[string]interface{}{"listen": addr})
+	startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		// answer the first query last
+		time.Sleep(time.Duration(5-m.Id) * 20 * time.Millisecond)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return nil, s.Response(ctx, r)
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	assert.NoError(err)
+	defer conn.Close()
+
+	frames := []byte{}
+	for id := uint16(1); id <= 4; id++ {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Id = id
+		buf, err := m.Pack()
+		assert.NoError(err)
+		frames = binary.BigEndian.AppendUint16(frames, uint16(len(buf)))
+		frames = append(frames, buf...)
+	}
+	// three whole queries and a partial one, then the rest of it
+	split := len(frames) - 5
+	_, err = conn.Write(frames[:split])
+	assert.NoError(err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = conn.Write(frames[split:])
+	assert.NoError(err)
+
+	dc := &dns.Conn{Conn: conn}
+	assert.NoError(dc.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	ids := []uint16{}
+	for i := 0; i < 4; i++ {
+		r, err := dc.ReadMsg()
+		if !assert.NoError(err) {
+			break
+		}
+		ids = append(ids, r.Id)
+	}
+	assert.ElementsMatch([]uint16{1, 2, 3, 4}, ids)
+	assert.NotEqual(uint16(1), ids[0], "responses should be written as they complete")
+}
+
+// benchConn is a gnet.Conn completing every write right away.
+type benchConn struct {
+	gnet.Conn
+}
+
+func (c *benchConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *benchConn) AsyncWrite(b []byte, callback gnet.AsyncCallback) error {
+	if callback != nil {
+		callback(c, nil)
+	}
+	return nil
+}
+
+func (c *benchConn) AsyncWritev(bs [][]byte, callback gnet.AsyncCallback) error {
+	if callback != nil {
+		callback(c, nil)
+	}
+	return nil
+}
+
+func BenchmarkGnetResponse(b *testing.B) {
+	level := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer zerolog.SetGlobalLevel(level)
+
+	s := &DO53GnetServerPlugin{}
+	s.config.MaxUDPPayload = 1232
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 1; i <= 4; i++ {
+		rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2." + strconv.Itoa(i))
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	for _, proto := range []string{protoUDP, protoTCP} {
+		b.Run(proto, func(b *testing.B) {
+			ctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, &gReqResp{conn: &benchConn{}, tcp: proto == protoTCP})
+			QueryMetadata(ctx)[udpSizeKey] = 1232
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := s.Response(ctx, resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// the previous Response, packing into new buffers, for comparison
+	for _, proto := range []string{protoUDP, protoTCP} {
+		b.Run(proto+"-unpooled", func(b *testing.B) {
+			ctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, &gReqResp{conn: &benchConn{}, tcp: proto == protoTCP})
+			QueryMetadata(ctx)[udpSizeKey] = 1232
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := unpooledGnetResponse(s, ctx, resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// unpooledGnetResponse is DO53GnetServerPlugin.Response before the pack buffer pool.
+func unpooledGnetResponse(d *DO53GnetServerPlugin, ctx context.Context, msg *dns.Msg) error {
+	log.Debug().Msgf("Response: %v", msg)
+	ResponseMetadata(ctx)[responseWritten] = true
+	msg.Compress = true
+	r := ctx.Value(responseWriterKey).(*gReqResp)
+	c := r.conn
+	if !r.tcp {
+		msg = truncateUDPResponse(ctx, msg, d.config.MaxUDPPayload)
+	} else if QueryMetadata(ctx)[tcpKeepaliveKey] == true {
+		msg = addTCPKeepalive(msg, d.config.TcpIdleTimeout)
+	}
+	out, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if r.tcp {
+		frame := make([]byte, 2+len(out))
+		binary.BigEndian.PutUint16(frame, uint16(len(out)))
+		copy(frame[2:], out)
+		return c.AsyncWrite(frame, nil)
+	}
+	n, err := c.Write(out)
+	if n != len(out) {
+		return fmt.Errorf("response write error")
+	}
+	return err
+}
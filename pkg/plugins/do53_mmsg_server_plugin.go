@@ -0,0 +1,186 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// DO53MmsgServerPlugin is a udp only DNS server reading and writing batches of
+// datagrams with recvmmsg/sendmmsg, each listen address is sharded over several
+// SO_REUSEPORT sockets. It is only supported on Linux, serve tcp with the dns or
+// gnetdns plugins.
+type DO53MmsgServerPlugin struct {
+	config  DO53MmsgServerPluginConfig
+	queue   *queryQueue
+	sockets []*mmsgSocket
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	s := &DO53MmsgServerPlugin{}
+	// set dynamic defaults.
+	s.config.SocketsPerAddr = runtime.NumCPU()
+	RegisterPlugin(s)
+}
+
+func (d *DO53MmsgServerPlugin) Name() string {
+	return "mmsgdns"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (d *DO53MmsgServerPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(d.Name(), &d.config, out)
+}
+
+type DO53MmsgServerPluginConfig struct {
+	Listen         ListenAddrs      `toml:"listen" comment:"Listen Addresses and Ports, 53 when no listen or listeners are set"`
+	Listeners      []ListenerConfig `toml:"listeners" comment:"Listeners with interface or family selection, only udp is served"`
+	SocketsPerAddr int              `toml:"socketsPerAddress" comment:"SO_REUSEPORT sockets per listen address, each with its own reader"`
+	BatchSize      int              `toml:"batchSize" comment:"Max datagrams per recvmmsg/sendmmsg call" default:"32"`
+	ReadBufferSize int              `toml:"readBufferSize" comment:"Size of each datagram read buffer, larger queries are dropped" default:"4096"`
+	MaxUDPPayload  int              `toml:"maxUDPPayloadSize" comment:"Max UDP response size, smaller client EDNS sizes are honored" default:"1232"`
+	PMTUDiscovery  string           `toml:"pmtuDiscovery" comment:"Path MTU discovery on the udp sockets (default, omit, dont, do), omit avoids fragmentation attacks" default:"omit"`
+
+	PoolSize            int    `toml:"workerPoolSize" comment:"Worker Pool Size" default:"10"`
+	QueueSize           int    `toml:"queueSize" comment:"Max queries waiting for a worker, the overload action applies beyond it" default:"1000"`
+	OverloadAction      string `toml:"overloadAction" comment:"Action for the queries over the queue size (refuse, servfail, drop)" default:"refuse"`
+	PrioritizeCacheHits bool   `toml:"prioritizeCacheHits" comment:"Process queries answered from the cache ahead of the others, not with a custom cache key" default:"false"`
+}
+
+// Configure the plugin.
+func (d *DO53MmsgServerPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("DO53MmsgServerPlugin.Configure")
+	if err := UnmarshalConfiguration(config, &d.config); err != nil {
+		return err
+	}
+	if d.config.BatchSize < 1 || d.config.SocketsPerAddr < 1 || d.config.ReadBufferSize < headerSize {
+		return fmt.Errorf("invalid mmsgdns batch size, sockets or read buffer size")
+	}
+	if err := validOverloadAction(d.config.OverloadAction); err != nil {
+		return err
+	}
+	if err := utils.ValidPMTUMode(d.config.PMTUDiscovery); err != nil {
+		return err
+	}
+	log.Debug().Msgf("DO53MmsgServerPlugin: %#v", d.config)
+	return nil
+}
+
+type mmsgReqResp struct {
+	req        *dns.Msg
+	errResp    *dns.Msg
+	sock       *mmsgSocket
+	peer       *mmsgPeer
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// Start the protocol plugin.
+func (d *DO53MmsgServerPlugin) StartServer(sctx context.Context, handler Handler) error {
+	log.Info().Msg("Starting DO53 mmsg Servers")
+	d.queue = newQueryQueue(d.Name(), d.config.PoolSize, d.config.QueueSize, func(input interface{}) {
+		r := input.(*mmsgReqResp)
+		qctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, r)
+		QueryMetadata(qctx)["LocalAddr"] = r.localAddr
+		QueryMetadata(qctx)["RemoteAddr"] = r.remoteAddr
+		SetServer(qctx, d.Name())
+		if r.errResp != nil {
+			// rejected by the validation, answered without the plugins
+			d.Response(qctx, r.errResp)
+			return
+		}
+		QueryMetadata(qctx)[udpSizeKey] = requestUDPSize(r.req)
+
+		ResponseMetadata(qctx)[responseWritten] = false
+		handler.Handle(qctx, r.req)
+		if !ResponseMetadata(qctx)[responseWritten].(bool) {
+			d.Response(qctx, utils.SynthesizeErrorResponse(r.req))
+		}
+	})
+
+	endpoints, err := resolveListenEndpoints(d.config.Listen, d.config.Listeners)
+	if err != nil {
+		d.StopServer(sctx)
+		return err
+	}
+	addrs := []string{}
+	for _, ep := range endpoints {
+		if ep.proto != protoUDP {
+			continue
+		}
+		for i := 0; i < d.config.SocketsPerAddr; i++ {
+			sock, err := listenMmsg(ep.network, ep.address, d.config.BatchSize, d.config.ReadBufferSize, d.config.PMTUDiscovery)
+			if err != nil {
+				d.StopServer(sctx)
+				return err
+			}
+			d.sockets = append(d.sockets, sock)
+			sock.serve(d.dispatch)
+		}
+		addrs = append(addrs, ep.String())
+	}
+	log.Info().Msgf("Started DO53 mmsg Server on %s", strings.Join(addrs, ", "))
+	return nil
+}
+
+// Stop the protocol plugin.
+func (d *DO53MmsgServerPlugin) StopServer(ctx context.Context) error {
+	for _, sock := range d.sockets {
+		sock.close()
+	}
+	d.sockets = nil
+	d.queue.stop()
+	d.queue = nil
+	return nil
+}
+
+// dispatch runs on the socket reader, in is only valid during the call.
+func (d *DO53MmsgServerPlugin) dispatch(sock *mmsgSocket, in []byte, peer *mmsgPeer) {
+	req, errResp := unpackQuery(in)
+	if req == nil && errResp == nil {
+		return
+	}
+	jobParam := &mmsgReqResp{req: req, errResp: errResp, sock: sock, peer: peer,
+		remoteAddr: peer.udpAddr(),
+		localAddr:  sock.localAddr()}
+
+	if d.queue.submit(jobParam, d.config.PrioritizeCacheHits && isCachedQuery(req)) {
+		return
+	}
+	resp := errResp
+	if req != nil {
+		resp = shedResponse(d.Name(), req, d.config.OverloadAction)
+	}
+	if resp != nil {
+		d.Response(context.WithValue(CreateNewHandlerCtx(), responseWriterKey, jobParam), resp)
+	}
+}
+
+func (d *DO53MmsgServerPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	log.Debug().Msgf("Response: %v", msg)
+	r, ok := ctx.Value(responseWriterKey).(*mmsgReqResp)
+	if !ok {
+		// received by another server plugin
+		return nil
+	}
+	ResponseMetadata(ctx)[responseWritten] = true
+	msg.Compress = true
+	msg = truncateUDPResponse(ctx, msg, d.config.MaxUDPPayload)
+
+	buf := getPackBuffer()
+	out, err := msg.PackBuffer(*buf)
+	if err != nil {
+		putPackBuffer(buf)
+		return err
+	}
+	// the buffer is returned to the pool once the batch is sent
+	return r.sock.send(out, buf, r.peer)
+}
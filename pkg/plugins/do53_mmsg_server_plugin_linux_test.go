@@ -0,0 +1,154 @@
+//go:build linux
+
+package plugins
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func newTestMmsgServer(t testing.TB, config map[string]interface{}) *DO53MmsgServerPlugin {
+	s := &DO53MmsgServerPlugin{}
+	s.config.SocketsPerAddr = 2
+	assert.NoError(t, s.Configure(context.Background(), config))
+	assert.NoError(t, s.StartServer(context.Background(), HandlerFunc(func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		rr, _ := dns.NewRR(m.Question[0].Name + " 300 IN A 192.0.2.1")
+		r.Answer = append(r.Answer, rr)
+		return nil, s.Response(ctx, r)
+	})))
+	t.Cleanup(func() { s.StopServer(context.Background()) })
+	return s
+}
+
+func TestMmsgServer(t *testing.T) {
+	assert := assert.New(t)
+	port := freePort(t)
+	s := newTestMmsgServer(t, map[string]interface{}{"listen": []string{"127.0.0.1:" + port, "[::1]:" + port}})
+	assert.Len(s.sockets, 4)
+
+	for _, addr := range []string{"127.0.0.1:" + port, "[::1]:" + port} {
+		c := &dns.Client{Net: "udp", Timeout: time.Second}
+		for i := 0; i < 5; i++ {
+			m := new(dns.Msg)
+			m.SetQuestion("example"+strconv.Itoa(i)+".com.", dns.TypeA)
+			r, _, err := c.Exchange(m, addr)
+			if assert.NoError(err, addr) {
+				assert.Equal(m.Id, r.Id)
+				assert.Len(r.Answer, 1)
+			}
+		}
+	}
+
+	// rejected by the validation
+	conn, err := net.Dial("udp", "127.0.0.1:"+port)
+	assert.NoError(err)
+	defer conn.Close()
+	dc := &dns.Conn{Conn: conn}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Opcode = dns.OpcodeUpdate
+	assert.NoError(dc.WriteMsg(m))
+	dc.SetReadDeadline(time.Now().Add(time.Second))
+	r, err := dc.ReadMsg()
+	if assert.NoError(err) {
+		assert.Equal(dns.RcodeNotImplemented, r.Rcode)
+	}
+}
+
+func TestMmsgPeerAddr(t *testing.T) {
+	assert := assert.New(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(err)
+	defer conn.Close()
+
+	sock, err := listenMmsg("udp", "127.0.0.1:0", 4, 512, utils.PMTUOmit)
+	assert.NoError(err)
+	peers := make(chan *mmsgPeer, 1)
+	sock.serve(func(s *mmsgSocket, in []byte, peer *mmsgPeer) {
+		assert.Equal("ping", string(in))
+		peers <- peer
+	})
+	defer sock.close()
+
+	_, err = conn.WriteTo([]byte("ping"), sock.localAddr())
+	assert.NoError(err)
+	select {
+	case peer := <-peers:
+		assert.Equal(conn.LocalAddr().String(), peer.udpAddr().String())
+	case <-time.After(time.Second):
+		assert.Fail("no datagram read")
+	}
+}
+
+// BenchmarkMmsgServer sends bursts of queries and reports the syscalls made
+// per query, a batch size of 1 is the same as one datagram per syscall.
+func BenchmarkMmsgServer(b *testing.B) {
+	for _, batch := range []int{1, 8, 32} {
+		b.Run("batch"+strconv.Itoa(batch), func(b *testing.B) {
+			addr := "127.0.0.1:" + freePort(b)
+			newTestMmsgServer(b, map[string]interface{}{"listen": addr, "batchSize": batch, "socketsPerAddress": 1, "workerPoolSize": 4})
+
+			conn, err := net.Dial("udp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			m := new(dns.Msg)
+			m.SetQuestion("example.com.", dns.TypeA)
+			query, _ := m.Pack()
+			resp := make([]byte, 512)
+
+			const burst = 64
+			recvCalls, sendCalls := recvmmsgCalls.Get(), sendmmsgCalls.Get()
+			b.ResetTimer()
+			for i := 0; i < b.N; i += burst {
+				n := min(burst, b.N-i)
+				for j := 0; j < n; j++ {
+					conn.Write(query)
+				}
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				for j := 0; j < n; j++ {
+					if _, err := conn.Read(resp); err != nil {
+						break // dropped by the kernel
+					}
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(recvmmsgCalls.Get()-recvCalls)/float64(b.N), "recvmmsg/query")
+			b.ReportMetric(float64(sendmmsgCalls.Get()-sendCalls)/float64(b.N), "sendmmsg/query")
+		})
+	}
+}
+
+func TestMmsgRetry(t *testing.T) {
+	assert := assert.New(t)
+	done := make(chan struct{})
+	r := &mmsgRetry{}
+	failed := recvmmsgErrors.Get()
+
+	assert.True(r.wait(unix.ENOMEM, done))
+	assert.Equal(mmsgRetryMin, r.delay)
+	assert.True(r.wait(unix.ENOMEM, done))
+	assert.Equal(2*mmsgRetryMin, r.delay)
+	assert.Equal(1, r.suppressed, "logged once per interval")
+	r.reset()
+	assert.True(r.wait(unix.ENOMEM, done))
+	assert.Equal(mmsgRetryMin, r.delay)
+	r.delay = mmsgRetryMax
+	close(done)
+	assert.False(r.wait(unix.ENOMEM, done), "closing")
+	assert.Equal(mmsgRetryMax, r.delay)
+
+	assert.False((&mmsgRetry{}).wait(unix.EBADF, make(chan struct{})), "unrecoverable")
+	assert.Equal(failed+5, recvmmsgErrors.Get())
+}
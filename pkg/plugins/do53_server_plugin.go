@@ -3,20 +3,21 @@ package plugins
 import (
 	"context"
 	"io"
+	"net"
+	"net/netip"
 	"sync"
 	"time"
 
 	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/miekg/dns"
-	ants "github.com/panjf2000/ants/v2"
 	log "github.com/rs/zerolog/log"
 )
 
 type DO53ServerPlugin struct {
-	config    DO53ServerPluginConfig
-	pool      *ants.MultiPoolWithFunc
-	tcpServer *dns.Server
-	udpServer *dns.Server
+	config   DO53ServerPluginConfig
+	queue    *queryQueue
+	servers  []*dns.Server
+	tcpConns *tcpConnTracker
 }
 
 // Register this plugin with the DNS Forwarder.
@@ -34,8 +35,25 @@ func (d *DO53ServerPlugin) PrintHelp(out io.Writer) {
 }
 
 type DO53ServerPluginConfig struct {
-	Listen   string `toml:"listen" comment:"Listen Address and Port" default:"53"`
-	PoolSize int    `toml:"workerPoolSize" comment:"Worker Pool Size" default:"10"`
+	Listen              ListenAddrs      `toml:"listen" comment:"Listen Addresses and Ports, 53 when no listen or listeners are set"`
+	Listeners           []ListenerConfig `toml:"listeners" comment:"Listeners with interface, family or protocol selection"`
+	PoolSize            int              `toml:"workerPoolSize" comment:"Worker Pool Size" default:"10"`
+	QueueSize           int              `toml:"queueSize" comment:"Max queries waiting for a worker, the overload action applies beyond it" default:"1000"`
+	OverloadAction      string           `toml:"overloadAction" comment:"Action for the queries over the queue size (refuse, servfail, drop)" default:"refuse"`
+	PrioritizeTCP       bool             `toml:"prioritizeTCP" comment:"Process TCP queries ahead of UDP queries" default:"true"`
+	PrioritizeCacheHits bool             `toml:"prioritizeCacheHits" comment:"Process queries answered from the cache ahead of the others, not with a custom cache key" default:"false"`
+	MaxUDPPayload       int              `toml:"maxUDPPayloadSize" comment:"Max UDP response size, smaller client EDNS sizes are honored" default:"1232"`
+	PMTUDiscovery       string           `toml:"pmtuDiscovery" comment:"Path MTU discovery on the udp sockets (default, omit, dont, do), omit avoids fragmentation attacks" default:"omit"`
+
+	ReadTimeout          time.Duration `toml:"readTimeout" comment:"Timeout reading a query" default:"1s"`
+	WriteTimeout         time.Duration `toml:"writeTimeout" comment:"Timeout writing a response" default:"1s"`
+	TcpIdleTimeout       time.Duration `toml:"tcpIdleTimeout" comment:"Close TCP connections idle this long, advertised with edns-tcp-keepalive" default:"10s"`
+	MaxTCPConns          int           `toml:"maxTCPConnections" comment:"Max concurrent TCP connections, the oldest idle is closed at the limit (0 is unlimited)" default:"1000"`
+	MaxTCPConnsPerClient int           `toml:"maxTCPConnectionsPerClient" comment:"Max concurrent TCP connections per client address (0 is unlimited)" default:"20"`
+
+	ProxyProtocol        bool     `toml:"proxyProtocol" comment:"Accept PROXY protocol v1/v2 headers on TCP connections" default:"false"`
+	ProxyProtocolTrusted []string `toml:"proxyProtocolTrusted" comment:"Source CIDRs allowed to send PROXY protocol headers, required with proxyProtocol"`
+	proxyTrusted         []netip.Prefix
 }
 
 // Configure the plugin.
@@ -44,6 +62,20 @@ func (d *DO53ServerPlugin) Configure(ctx context.Context, config map[string]inte
 	if err := UnmarshalConfiguration(config, &d.config); err != nil {
 		return err
 	}
+	var err error
+	if d.config.proxyTrusted, err = utils.ParsePrefixes(d.config.ProxyProtocolTrusted); err != nil {
+		return err
+	}
+	if err = validOverloadAction(d.config.OverloadAction); err != nil {
+		return err
+	}
+	if err = utils.ValidPMTUMode(d.config.PMTUDiscovery); err != nil {
+		return err
+	}
+	if d.config.ProxyProtocol && len(d.config.proxyTrusted) == 0 {
+		// any client could choose its address otherwise
+		return errNoProxyTrusted
+	}
 	log.Debug().Msgf("DO53ServerPluginConfig: %#v", d.config)
 	return nil
 }
@@ -54,7 +86,8 @@ type reqResp struct {
 }
 type responseKeyType string
 
-var (
+// constants, so looking them up doesn't allocate.
+const (
 	responseWriterKey = responseKeyType("responseWriter")
 	responseWritten   = "responseWritten"
 )
@@ -62,13 +95,16 @@ var (
 // Start the protocol plugin.
 func (d *DO53ServerPlugin) StartServer(sctx context.Context, handler Handler) error {
 	log.Info().Msg("Starting DO53 Servers")
-	p, err := ants.NewMultiPoolWithFunc(10, d.config.PoolSize, func(input interface{}) {
+	d.queue = newQueryQueue(d.Name(), d.config.PoolSize, d.config.QueueSize, func(input interface{}) {
 		r := input.(*reqResp)
 		qctx := context.WithValue(CreateNewHandlerCtx(), responseWriterKey, r.resp)
 
 		// todo make part of CreateNewHandlerCtx?
 		QueryMetadata(qctx)["LocalAddr"] = r.resp.LocalAddr()
 		QueryMetadata(qctx)["RemoteAddr"] = r.resp.RemoteAddr()
+		SetServer(qctx, d.Name())
+		QueryMetadata(qctx)[udpSizeKey] = requestUDPSize(r.req)
+		QueryMetadata(qctx)[tcpKeepaliveKey] = isStreamProto(r.resp.RemoteAddr().Network()) && requestsTCPKeepalive(r.req)
 
 		ResponseMetadata(qctx)[responseWritten] = false
 		handler.Handle(qctx, r.req)
@@ -76,75 +112,121 @@ func (d *DO53ServerPlugin) StartServer(sctx context.Context, handler Handler) er
 			d.Response(qctx, utils.SynthesizeErrorResponse(r.req))
 		}
 
-	}, ants.LeastTasks, ants.WithPreAlloc(true))
-	if err != nil {
-		return err
-	}
-	d.pool = p
+	})
+	d.tcpConns = newTCPConnTracker(d.config.MaxTCPConns, d.config.MaxTCPConnsPerClient)
 
 	// start listeners
-	tcpSrvr, err := d.ListenTCP()
+	endpoints, err := resolveListenEndpoints(d.config.Listen, d.config.Listeners)
 	if err != nil {
-		d.pool.ReleaseTimeout(1 * time.Millisecond)
+		d.queue.stop()
 		return err
 	}
-	d.tcpServer = tcpSrvr
-	log.Info().Msgf("Started DO53 TCP Server on %s", d.config.Listen)
-
-	udpSrvr, err := d.ListenUDP()
-	if err != nil {
-		tcpSrvr.Shutdown()
-		d.pool.ReleaseTimeout(1 * time.Millisecond)
-		return err
+	d.servers = nil
+	for _, ep := range endpoints {
+		var srvr *dns.Server
+		switch ep.proto {
+		case protoTCP:
+			srvr, err = d.ListenTCP(ep.network, ep.address)
+		case protoUnix:
+			srvr, err = d.ListenUnix(ep)
+		case protoUnixgram:
+			srvr, err = d.ListenUnixgram(ep)
+		default:
+			srvr, err = d.ListenUDP(ep.network, ep.address)
+		}
+		if err != nil {
+			d.StopServer(sctx)
+			return err
+		}
+		d.servers = append(d.servers, srvr)
+		log.Info().Msgf("Started DO53 Server on %s", ep)
 	}
-	d.udpServer = udpSrvr
-	log.Info().Msgf("Started DO53 UDP Server on %s", d.config.Listen)
 
 	return nil
 }
 
 // Stop the protocol plugin.
 func (d *DO53ServerPlugin) StopServer(ctx context.Context) error {
-	d.tcpServer.Shutdown()
-	d.udpServer.Shutdown()
-	d.pool.ReleaseTimeout(1 * time.Millisecond)
+	for _, srvr := range d.servers {
+		srvr.Shutdown()
+	}
+	d.servers = nil
+	d.queue.stop()
+	d.queue = nil
 	return nil
 }
 
 func (d *DO53ServerPlugin) Response(ctx context.Context, msg *dns.Msg) error {
 	log.Debug().Msgf("Response: %v", msg)
 	// get the response key and writer and write to it.
+	w, ok := ctx.Value(responseWriterKey).(dns.ResponseWriter)
+	if !ok {
+		// received by another server plugin
+		return nil
+	}
 	ResponseMetadata(ctx)[responseWritten] = true
 	msg.Compress = true
-	return ctx.Value(responseWriterKey).(dns.ResponseWriter).WriteMsg(msg)
+	if !isStreamProto(w.RemoteAddr().Network()) {
+		msg = truncateUDPResponse(ctx, msg, d.config.MaxUDPPayload)
+	} else if QueryMetadata(ctx)[tcpKeepaliveKey] == true {
+		msg = addTCPKeepalive(msg, d.config.TcpIdleTimeout)
+	}
+	return w.WriteMsg(msg)
 }
 
 func (d *DO53ServerPlugin) handleIncoming(w dns.ResponseWriter, req *dns.Msg) {
-	d.pool.Invoke(&reqResp{req: req, resp: w})
+	// the header was checked by acceptQueryHeader
+	if errResp := checkQuery(req); errResp != nil {
+		w.WriteMsg(errResp)
+		return
+	}
+	priority := (d.config.PrioritizeTCP && isStreamProto(w.RemoteAddr().Network())) ||
+		(d.config.PrioritizeCacheHits && isCachedQuery(req))
+	if !d.queue.submit(&reqResp{req: req, resp: w}, priority) {
+		if resp := shedResponse(d.Name(), req, d.config.OverloadAction); resp != nil {
+			w.WriteMsg(resp)
+		}
+	}
 }
 
-func (d *DO53ServerPlugin) ListenTCP() (*dns.Server, error) {
+func (d *DO53ServerPlugin) ListenTCP(network, addr string) (*dns.Server, error) {
+	ln, err := serverListenConfig(utils.PMTUDefault).Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.config.ProxyProtocol {
+		ln = &utils.ProxyListener{Listener: ln, Trusted: d.config.proxyTrusted}
+	}
+	return d.serveStream(network, addr, &trackedListener{Listener: ln, tracker: d.tcpConns})
+}
+
+// ListenUnix serves a unix stream socket, the connections count against the tcp limits.
+func (d *DO53ServerPlugin) ListenUnix(ep listenEndpoint) (*dns.Server, error) {
+	ln, err := listenUnixStream(ep)
+	if err != nil {
+		return nil, err
+	}
+	return d.serveStream(ep.network, ep.address, &trackedListener{Listener: ln, tracker: d.tcpConns})
+}
+
+func (d *DO53ServerPlugin) serveStream(network, addr string, ln net.Listener) (*dns.Server, error) {
 	waitLock := sync.Mutex{}
-	//addr := ":0"
-	proto := "tcp"
-	// if proto == "tcp6" {
-	// 	addr = "[::]:0"
-	// }
 	server := &dns.Server{
-		Addr:              d.config.Listen,
-		Net:               proto,
-		ReadTimeout:       time.Second,
-		WriteTimeout:      time.Second,
+		Addr:              addr,
+		Net:               network,
+		ReadTimeout:       d.config.ReadTimeout,
+		WriteTimeout:      d.config.WriteTimeout,
+		IdleTimeout:       func() time.Duration { return d.config.TcpIdleTimeout },
 		NotifyStartedFunc: waitLock.Unlock,
-		ReusePort:         true,
-		ReuseAddr:         true,
-		Handler:           dns.HandlerFunc(d.handleIncoming)}
+		MsgAcceptFunc:     acceptQueryHeader,
+		Handler:           dns.HandlerFunc(d.handleIncoming),
+		Listener:          ln}
 	waitLock.Lock()
 
 	go func() {
-		err := server.ListenAndServe()
+		err := server.ActivateAndServe()
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to start TCP server")
+			log.Fatal().Err(err).Msgf("Failed to start %s server", network)
 			waitLock.Unlock()
 		}
 	}()
@@ -152,31 +234,41 @@ func (d *DO53ServerPlugin) ListenTCP() (*dns.Server, error) {
 	return server, nil
 }
 
-func (d *DO53ServerPlugin) ListenUDP() (*dns.Server, error) {
-	waitLock := sync.Mutex{}
+func (d *DO53ServerPlugin) ListenUDP(network, addr string) (*dns.Server, error) {
+	pc, err := serverListenConfig(d.config.PMTUDiscovery).ListenPacket(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.servePacket(network, addr, pc)
+}
 
-	//	net.ResolveUDPAddr("udp", d.config.Listen)
-	// addr := ":0"
-	proto := "udp"
-	// if proto == "udp6" {
-	// 	addr = "[::]:0"
-	// }
+// ListenUnixgram serves a unix datagram socket, clients must bind their socket to receive the responses.
+func (d *DO53ServerPlugin) ListenUnixgram(ep listenEndpoint) (*dns.Server, error) {
+	pc, err := listenUnixgram(ep)
+	if err != nil {
+		return nil, err
+	}
+	return d.servePacket(ep.network, ep.address, pc)
+}
+
+func (d *DO53ServerPlugin) servePacket(network, addr string, pc net.PacketConn) (*dns.Server, error) {
+	waitLock := sync.Mutex{}
 	server := &dns.Server{
-		Addr:              d.config.Listen,
-		Net:               proto,
-		ReadTimeout:       time.Second,
-		WriteTimeout:      time.Second,
+		Addr:              addr,
+		Net:               network,
+		ReadTimeout:       d.config.ReadTimeout,
+		WriteTimeout:      d.config.WriteTimeout,
 		NotifyStartedFunc: waitLock.Unlock,
-		ReusePort:         true,
-		ReuseAddr:         true,
 		UDPSize:           4096,
-		Handler:           dns.HandlerFunc(d.handleIncoming)}
+		MsgAcceptFunc:     acceptQueryHeader,
+		Handler:           dns.HandlerFunc(d.handleIncoming),
+		PacketConn:        pc}
 	waitLock.Lock()
 
 	go func() {
-		err := server.ListenAndServe()
+		err := server.ActivateAndServe()
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to start UDP server")
+			log.Fatal().Err(err).Msgf("Failed to start %s server", network)
 			waitLock.Unlock()
 		}
 	}()
@@ -0,0 +1,238 @@
+package plugins
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ListenAddrs is a list of listen addresses, configured either as a single
+// string or as an array of strings.
+type ListenAddrs []string
+
+func (l *ListenAddrs) UnmarshalTOML(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		*l = ListenAddrs{v}
+	case []interface{}:
+		addrs := make(ListenAddrs, 0, len(v))
+		for _, a := range v {
+			s, ok := a.(string)
+			if !ok {
+				return fmt.Errorf("invalid listen address: %v", a)
+			}
+			addrs = append(addrs, s)
+		}
+		*l = addrs
+	default:
+		return fmt.Errorf("invalid listen addresses: %v", v)
+	}
+	return nil
+}
+
+// ListenerConfig describes a single listener, use it for interface binding,
+// address family selection or to serve only udp or tcp on an address.
+// Unix domain sockets are configured with a unix:///path (stream) or
+// unixgram:///path (datagram) address, with an optional file mode and owner.
+type ListenerConfig struct {
+	Address   string   `toml:"address" comment:"Listen Address and Port, only the Port when binding an interface, or unix:///path and unixgram:///path"`
+	Interface string   `toml:"interface" comment:"Bind to the addresses of this network interface"`
+	Family    string   `toml:"family" comment:"Address family (ip, ip4, ip6), ip is dual-stack"`
+	Protocols []string `toml:"protocols" comment:"Protocols served on this listener (udp, tcp), empty is both"`
+	Mode      string   `toml:"mode" comment:"File mode of a unix socket, ex: 0660"`
+	Owner     string   `toml:"owner" comment:"Owner of a unix socket, user[:group] names or ids"`
+}
+
+const (
+	familyAny = "ip"
+	familyV4  = "ip4"
+	familyV6  = "ip6"
+
+	protoUDP      = "udp"
+	protoTCP      = "tcp"
+	protoUnix     = "unix"
+	protoUnixgram = "unixgram"
+)
+
+// listenEndpoint is a resolved socket to listen on.
+type listenEndpoint struct {
+	proto   string // udp, tcp, unix or unixgram
+	network string // proto with an optional family suffix, ex: udp6
+	address string // host:port or the unix socket path
+	mode    string // unix socket file mode
+	owner   string // unix socket file owner
+}
+
+func (l listenEndpoint) String() string {
+	return l.network + "://" + l.address
+}
+
+// defaultListen is the listen address when no listen or listeners are set.
+const defaultListen = "53"
+
+// resolveListenEndpoints expands the simple listen addresses and the detailed
+// listeners into the list of sockets to open.
+func resolveListenEndpoints(listen ListenAddrs, listeners []ListenerConfig) ([]listenEndpoint, error) {
+	if len(listen) == 0 && len(listeners) == 0 {
+		listen = ListenAddrs{defaultListen}
+	}
+	all := make([]ListenerConfig, 0, len(listen)+len(listeners))
+	for _, addr := range listen {
+		all = append(all, ListenerConfig{Address: addr})
+	}
+	all = append(all, listeners...)
+
+	endpoints := []listenEndpoint{}
+	for _, l := range all {
+		eps, err := l.endpoints()
+		if err != nil {
+			return nil, err
+		}
+		for _, ep := range eps {
+			if !slices.Contains(endpoints, ep) {
+				endpoints = append(endpoints, ep)
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+func (l *ListenerConfig) endpoints() ([]listenEndpoint, error) {
+	if proto, path, ok := splitUnixAddress(l.Address); ok {
+		return l.unixEndpoints(proto, path)
+	}
+	if l.Mode != "" || l.Owner != "" {
+		return nil, fmt.Errorf("listener mode and owner only apply to unix sockets: %v", l.Address)
+	}
+
+	protos := []string{protoUDP, protoTCP}
+	if len(l.Protocols) > 0 {
+		protos = []string{}
+		for _, p := range l.Protocols {
+			p = strings.ToLower(p)
+			if p != protoUDP && p != protoTCP {
+				return nil, fmt.Errorf("invalid listener protocol: %v", p)
+			}
+			protos = append(protos, p)
+		}
+	}
+
+	family := strings.ToLower(l.Family)
+	switch family {
+	case "":
+		family = familyAny
+	case familyAny, familyV4, familyV6:
+	default:
+		return nil, fmt.Errorf("invalid listener family: %v", l.Family)
+	}
+
+	host, port, err := splitListenAddress(l.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	type hostFamily struct{ host, family string }
+	hosts := []hostFamily{{host, family}}
+	if l.Interface != "" {
+		if host != "" {
+			return nil, fmt.Errorf("listener with interface %v must not specify a host: %v", l.Interface, l.Address)
+		}
+		ips, err := interfaceIPs(l.Interface, family)
+		if err != nil {
+			return nil, err
+		}
+		hosts = hosts[:0]
+		for _, ip := range ips {
+			h, f := ip.String(), familyV4
+			if ip.To4() == nil {
+				f = familyV6
+				if ip.IsLinkLocalUnicast() {
+					h += "%" + l.Interface
+				}
+			}
+			hosts = append(hosts, hostFamily{h, f})
+		}
+	}
+
+	endpoints := []listenEndpoint{}
+	for _, h := range hosts {
+		for _, proto := range protos {
+			network := proto
+			if h.family != familyAny {
+				network += strings.TrimPrefix(h.family, "ip")
+			}
+			endpoints = append(endpoints, listenEndpoint{
+				proto:   proto,
+				network: network,
+				address: net.JoinHostPort(h.host, port),
+			})
+		}
+	}
+	return endpoints, nil
+}
+
+func (l *ListenerConfig) unixEndpoints(proto, path string) ([]listenEndpoint, error) {
+	if path == "" {
+		return nil, fmt.Errorf("invalid listen address %v: missing socket path", l.Address)
+	}
+	if l.Interface != "" || l.Family != "" || len(l.Protocols) > 0 {
+		return nil, fmt.Errorf("unix socket listener %v must not specify an interface, family or protocols", l.Address)
+	}
+	if l.Mode != "" {
+		if _, err := parseSocketMode(l.Mode); err != nil {
+			return nil, err
+		}
+	}
+	return []listenEndpoint{{proto: proto, network: proto, address: path, mode: l.Mode, owner: l.Owner}}, nil
+}
+
+// splitUnixAddress splits unix:///path and unixgram:///path addresses.
+func splitUnixAddress(addr string) (proto, path string, ok bool) {
+	for _, proto := range []string{protoUnixgram, protoUnix} {
+		if path, ok := strings.CutPrefix(addr, proto+"://"); ok {
+			return proto, path, true
+		}
+	}
+	return "", "", false
+}
+
+// splitListenAddress accepts host:port, :port or a bare port.
+func splitListenAddress(addr string) (host, port string, err error) {
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		return "", addr, nil
+	}
+	host, port, err = net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %v: %w", addr, err)
+	}
+	return host, port, nil
+}
+
+func interfaceIPs(name, family string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("listener interface %v: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("listener interface %v: %w", name, err)
+	}
+	ips := []net.IP{}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		v4 := ipNet.IP.To4() != nil
+		if (family == familyV4 && !v4) || (family == familyV6 && v4) {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("listener interface %v has no %v addresses", name, family)
+	}
+	return ips, nil
+}
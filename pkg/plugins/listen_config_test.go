@@ -0,0 +1,124 @@
+package plugins
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenAddrsConfiguration(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DO53ServerPluginConfig{}
+	assert.NoError(UnmarshalConfiguration(map[string]interface{}{}, &config))
+	assert.Empty(config.Listen)
+
+	assert.NoError(UnmarshalConfiguration(map[string]interface{}{"listen": "127.0.0.1:53"}, &config))
+	assert.Equal(ListenAddrs{"127.0.0.1:53"}, config.Listen)
+
+	assert.NoError(UnmarshalConfiguration(map[string]interface{}{
+		"listen": []interface{}{"127.0.0.1:53", "[::1]:53"},
+		"listeners": []map[string]interface{}{
+			{"address": "10.0.0.1:5353", "family": "ip4", "protocols": []string{"udp"}},
+		},
+	}, &config))
+	assert.Equal(ListenAddrs{"127.0.0.1:53", "[::1]:53"}, config.Listen)
+	assert.Len(config.Listeners, 1)
+	assert.Equal("10.0.0.1:5353", config.Listeners[0].Address)
+	assert.Equal([]string{"udp"}, config.Listeners[0].Protocols)
+}
+
+func TestResolveListenEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints, err := resolveListenEndpoints(ListenAddrs{"53", "127.0.0.1:53"}, []ListenerConfig{
+		{Address: "[::1]:5353", Family: "ip6", Protocols: []string{"TCP"}},
+		{Address: "127.0.0.1:53"}, // duplicate
+	})
+	assert.NoError(err)
+	assert.Equal([]listenEndpoint{
+		{proto: "udp", network: "udp", address: ":53"},
+		{proto: "tcp", network: "tcp", address: ":53"},
+		{proto: "udp", network: "udp", address: "127.0.0.1:53"},
+		{proto: "tcp", network: "tcp", address: "127.0.0.1:53"},
+		{proto: "tcp", network: "tcp6", address: "[::1]:5353"},
+	}, endpoints)
+	assert.Equal("tcp6://[::1]:5353", endpoints[4].String())
+
+	// port 53 on all the addresses without listen or listeners only
+	endpoints, err = resolveListenEndpoints(nil, nil)
+	assert.NoError(err)
+	assert.Equal([]listenEndpoint{
+		{proto: "udp", network: "udp", address: ":53"},
+		{proto: "tcp", network: "tcp", address: ":53"},
+	}, endpoints)
+	config := DO53ServerPluginConfig{}
+	assert.NoError(UnmarshalConfiguration(map[string]interface{}{
+		"listeners": []map[string]interface{}{{"address": "127.0.0.1:5353"}},
+	}, &config))
+	endpoints, err = resolveListenEndpoints(config.Listen, config.Listeners)
+	assert.NoError(err)
+	assert.Equal([]listenEndpoint{
+		{proto: "udp", network: "udp", address: "127.0.0.1:5353"},
+		{proto: "tcp", network: "tcp", address: "127.0.0.1:5353"},
+	}, endpoints)
+
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: ":53", Family: "ip5"}})
+	assert.Error(err)
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: ":53", Protocols: []string{"sctp"}}})
+	assert.Error(err)
+	_, err = resolveListenEndpoints(ListenAddrs{"localhost"}, nil)
+	assert.Error(err)
+}
+
+func TestResolveListenEndpointsInterface(t *testing.T) {
+	assert := assert.New(t)
+
+	ifaces, err := net.Interfaces()
+	assert.NoError(err)
+	loopback := ""
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	endpoints, err := resolveListenEndpoints(nil, []ListenerConfig{
+		{Address: "5353", Interface: loopback, Family: "ip4", Protocols: []string{"udp"}},
+	})
+	assert.NoError(err)
+	assert.Contains(endpoints, listenEndpoint{proto: "udp", network: "udp4", address: "127.0.0.1:5353"})
+
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: "127.0.0.1:53", Interface: loopback}})
+	assert.Error(err)
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: "53", Interface: "no-such-interface0"}})
+	assert.Error(err)
+}
+
+func TestResolveListenEndpointsUnix(t *testing.T) {
+	assert := assert.New(t)
+
+	endpoints, err := resolveListenEndpoints(ListenAddrs{"unix:///run/dns.sock"}, []ListenerConfig{
+		{Address: "unixgram:///run/dns-dgram.sock", Mode: "0660", Owner: "root:0"},
+	})
+	assert.NoError(err)
+	assert.Equal([]listenEndpoint{
+		{proto: "unix", network: "unix", address: "/run/dns.sock"},
+		{proto: "unixgram", network: "unixgram", address: "/run/dns-dgram.sock", mode: "0660", owner: "root:0"},
+	}, endpoints)
+	assert.Equal("unixgram:///run/dns-dgram.sock", endpoints[1].String())
+
+	_, err = resolveListenEndpoints(ListenAddrs{"unix://"}, nil)
+	assert.Error(err)
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: "unix:///run/dns.sock", Mode: "rw"}})
+	assert.Error(err)
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: "unix:///run/dns.sock", Protocols: []string{"udp"}}})
+	assert.Error(err)
+	_, err = resolveListenEndpoints(nil, []ListenerConfig{{Address: "127.0.0.1:53", Mode: "0660"}})
+	assert.Error(err)
+}
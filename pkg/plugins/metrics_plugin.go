@@ -5,18 +5,26 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/VictoriaMetrics/metrics"
+	"github.com/miekg/dns"
 	log "github.com/rs/zerolog/log"
 )
 
+// MetricsPlugin serves the metrics to Prometheus, and optionally pushes them
+// to StatsD or Graphite at an interval.
 type MetricsPlugin struct {
 	config MetricsPluginConfig
+	pusher *metricsPusher
 }
 
 // Register this plugin with the DNS Forwarder.
 func init() {
 	RegisterPlugin(&MetricsPlugin{})
+	metrics.RegisterMetricsWriter(writePluginMetrics)
 }
 
 func (q *MetricsPlugin) Name() string {
@@ -29,19 +37,56 @@ func (c *MetricsPlugin) PrintHelp(out io.Writer) {
 }
 
 type MetricsPluginConfig struct {
-	Port int `toml:"port" comment:"Metrics HTTP Port" default:"8080"`
+	Port         int               `toml:"port" comment:"Metrics HTTP Port" default:"8080"`
+	Push         string            `toml:"push" comment:"Push the metrics to statsd://host:port over udp or graphite://host:port over tcp, none when empty"`
+	PushInterval time.Duration     `toml:"pushInterval" comment:"Interval of the metrics pushes" default:"10s"`
+	PushTimeout  time.Duration     `toml:"pushTimeout" comment:"Timeout of a metrics push" default:"5s"`
+	PushPrefix   string            `toml:"pushPrefix" comment:"Prefix of the pushed metric names, e.g. dns.forwarder"`
+	PushTags     map[string]string `toml:"pushTags" comment:"Tags added to the pushed metrics, with their labels"`
 }
 
 // Configure the plugin.
 func (c *MetricsPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
 	log.Debug().Any("config", config).Msg("MetricsPlugin.Configure")
+	c.config = MetricsPluginConfig{}
 	if err := UnmarshalConfiguration(config, &c.config); err != nil {
 		return err
 	}
+	c.pusher = nil
+	if c.config.Push != "" {
+		if c.config.PushInterval <= 0 {
+			return fmt.Errorf("invalid metrics push interval: %v", c.config.PushInterval)
+		}
+		pusher, err := newMetricsPusher(c.config.Push, c.config.PushPrefix, c.config.PushTags, c.config.PushInterval, c.config.PushTimeout)
+		if err != nil {
+			return err
+		}
+		c.pusher = pusher
+	}
 	c.StartHttpEndpoint()
 	return nil
 }
 
+// Start the protocol plugin.
+func (c *MetricsPlugin) StartClient(ctx context.Context, handler Handler) error {
+	if c.pusher != nil {
+		c.pusher.start()
+	}
+	return nil
+}
+
+// Stop the protocol plugin.
+func (c *MetricsPlugin) StopClient(ctx context.Context) error {
+	if c.pusher != nil {
+		c.pusher.stop()
+	}
+	return nil
+}
+
+func (c *MetricsPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	return nil
+}
+
 func (c *MetricsPlugin) StartHttpEndpoint() {
 
 	mux := http.NewServeMux()
@@ -60,3 +105,34 @@ func (c *MetricsPlugin) StartHttpEndpoint() {
 	}()
 
 }
+
+// pluginMetricsWriters write the metrics read from the running plugins at each
+// scrape, by plugin name.
+var (
+	pluginMetricsWritersMutex sync.RWMutex
+	pluginMetricsWriters      = map[string]func(w io.Writer){}
+)
+
+// setPluginMetricsWriter adds the metrics of a plugin, a nil writer removes them.
+func setPluginMetricsWriter(name string, write func(w io.Writer)) {
+	pluginMetricsWritersMutex.Lock()
+	defer pluginMetricsWritersMutex.Unlock()
+	if write == nil {
+		delete(pluginMetricsWriters, name)
+		return
+	}
+	pluginMetricsWriters[name] = write
+}
+
+func writePluginMetrics(w io.Writer) {
+	pluginMetricsWritersMutex.RLock()
+	defer pluginMetricsWritersMutex.RUnlock()
+	names := make([]string, 0, len(pluginMetricsWriters))
+	for name := range pluginMetricsWriters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		pluginMetricsWriters[name](w)
+	}
+}
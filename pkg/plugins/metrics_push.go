@@ -0,0 +1,350 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	log "github.com/rs/zerolog/log"
+)
+
+const (
+	pushStatsD   = "statsd"
+	pushGraphite = "graphite"
+
+	// statsdPacketSize keeps the StatsD datagrams in a single Ethernet frame.
+	statsdPacketSize = 1432
+)
+
+var metricsPushErrors = metrics.GetOrCreateCounter(`dns_metrics_push_errors_total`)
+
+// parseMetricsPush returns the protocol and address of statsd://host:port or
+// graphite://host:port.
+func parseMetricsPush(push string) (proto, addr string, err error) {
+	proto, addr, ok := strings.Cut(push, "://")
+	if !ok || (proto != pushStatsD && proto != pushGraphite) {
+		return "", "", fmt.Errorf("invalid metrics push: %v", push)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid metrics push: %v: %w", push, err)
+	}
+	return proto, addr, nil
+}
+
+// metricTag is a label of a metric, or a tag added to all of them.
+type metricTag struct {
+	name, value string
+}
+
+// metricsPusher sends all the metrics at an interval to StatsD over udp, with
+// the DogStatsD tags, or to Graphite over tcp with the plaintext protocol and
+// its tags. StatsD receives the increments of the counters and the histograms,
+// Graphite their values.
+type metricsPusher struct {
+	proto    string
+	addr     string
+	prefix   string
+	tags     []metricTag
+	interval time.Duration
+	timeout  time.Duration
+	// last are the counter values sent to StatsD, by series
+	last map[string]float64
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newMetricsPusher(push, prefix string, tags map[string]string, interval, timeout time.Duration) (*metricsPusher, error) {
+	proto, addr, err := parseMetricsPush(push)
+	if err != nil {
+		return nil, err
+	}
+	p := &metricsPusher{
+		proto:    proto,
+		addr:     addr,
+		prefix:   strings.TrimSuffix(prefix, "."),
+		interval: interval,
+		timeout:  timeout,
+		last:     map[string]float64{},
+	}
+	for name, value := range tags {
+		p.tags = append(p.tags, metricTag{name, value})
+	}
+	slices.SortFunc(p.tags, func(a, b metricTag) int { return strings.Compare(a.name, b.name) })
+	return p, nil
+}
+
+func (p *metricsPusher) start() {
+	// the # TYPE lines tell the counters from the gauges
+	metrics.ExposeMetadata(true)
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				if err := p.push(); err != nil {
+					metricsPushErrors.Inc()
+					log.Warn().Err(err).Str("addr", p.addr).Msg("metrics push failed")
+				}
+			}
+		}
+	}()
+}
+
+func (p *metricsPusher) stop() {
+	if p.done != nil {
+		close(p.done)
+		p.wg.Wait()
+		p.done = nil
+	}
+}
+
+// push sends the current metrics.
+func (p *metricsPusher) push() error {
+	var exposition bytes.Buffer
+	metrics.WritePrometheus(&exposition, true)
+	if p.proto == pushGraphite {
+		return p.send("tcp", [][]byte{p.graphite(exposition.Bytes(), time.Now())})
+	}
+	return p.send("udp", p.statsd(exposition.Bytes()))
+}
+
+func (p *metricsPusher) send(network string, packets [][]byte) error {
+	if len(packets) == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout(network, p.addr, p.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	for _, packet := range packets {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// graphite returns the metrics in the plaintext protocol, with the labels as tags.
+func (p *metricsPusher) graphite(exposition []byte, now time.Time) []byte {
+	var b []byte
+	forEachMetric(exposition, func(name, _ string, labels []metricTag, value float64) {
+		b = p.appendName(b, name)
+		for _, tags := range [][]metricTag{p.tags, labels} {
+			for _, t := range tags {
+				b = append(b, ';')
+				b = appendMetricToken(b, t.name, ";~= ")
+				b = append(b, '=')
+				b = appendMetricToken(b, t.value, ";~ ")
+			}
+		}
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, value, 'g', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, now.Unix(), 10)
+		b = append(b, '\n')
+	})
+	return b
+}
+
+// statsd returns the datagrams of the metrics: the counters, with the
+// histograms and summaries series, are sent as their increments since the
+// last push and the others as gauges.
+func (p *metricsPusher) statsd(exposition []byte) [][]byte {
+	var packets [][]byte
+	var b, line []byte
+	forEachMetric(exposition, func(name, family string, labels []metricTag, value float64) {
+		typ := "g"
+		if isCounterMetric(name, family) {
+			typ = "c"
+			series := seriesKey(name, labels)
+			value, p.last[series] = value-p.last[series], value
+			if value == 0 {
+				return
+			}
+		}
+		line = line[:0]
+		if typ == "g" && value < 0 {
+			// a signed gauge is a change, it's reset first
+			line = p.appendStatsD(line, name, labels, "0", typ)
+		}
+		line = p.appendStatsD(line, name, labels, strconv.FormatFloat(value, 'g', -1, 64), typ)
+		if len(b) > 0 && len(b)+len(line) > statsdPacketSize {
+			packets = append(packets, b)
+			b = nil
+		}
+		b = append(b, line...)
+	})
+	if len(b) > 0 {
+		packets = append(packets, b)
+	}
+	return packets
+}
+
+func (p *metricsPusher) appendStatsD(b []byte, name string, labels []metricTag, value, typ string) []byte {
+	b = p.appendName(b, name)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, '|')
+	b = append(b, typ...)
+	sep := "|#"
+	for _, tags := range [][]metricTag{p.tags, labels} {
+		for _, t := range tags {
+			b = append(b, sep...)
+			sep = ","
+			b = appendMetricToken(b, t.name, ",|#: ")
+			b = append(b, ':')
+			b = appendMetricToken(b, t.value, ",|# ")
+		}
+	}
+	return append(b, '\n')
+}
+
+func (p *metricsPusher) appendName(b []byte, name string) []byte {
+	if p.prefix != "" {
+		b = append(b, p.prefix...)
+		b = append(b, '.')
+	}
+	return append(b, name...)
+}
+
+// appendMetricToken appends s with the reserved characters replaced by _.
+func appendMetricToken(b []byte, s, reserved string) []byte {
+	if s == "" {
+		return append(b, "none"...)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || strings.IndexByte(reserved, c) >= 0 {
+			c = '_'
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// isCounterMetric reports a cumulative series by the # TYPE of its family,
+// the series without a type are counters when named as such.
+func isCounterMetric(name, family string) bool {
+	switch family {
+	case "counter":
+		return true
+	case "histogram", "summary":
+		return strings.HasSuffix(name, "_count") || strings.HasSuffix(name, "_sum") || strings.HasSuffix(name, "_bucket")
+	case "":
+		return strings.HasSuffix(name, "_total")
+	}
+	return false
+}
+
+func seriesKey(name string, labels []metricTag) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, l := range labels {
+		b.WriteByte(0)
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+	}
+	return b.String()
+}
+
+// forEachMetric parses the Prometheus text exposition, the comments and the
+// invalid lines are skipped. family is the type of the series from the
+// # TYPE line of its family, empty when it has none.
+func forEachMetric(exposition []byte, f func(name, family string, labels []metricTag, value float64)) {
+	scanner := bufio.NewScanner(bytes.NewReader(exposition))
+	scanner.Buffer(nil, 1<<20)
+	var typeName, typ string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if meta, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			typeName, typ, _ = strings.Cut(meta, " ")
+			continue
+		}
+		if name, labels, value, ok := parseMetricLine(line); ok {
+			family := ""
+			if typeName != "" && (name == typeName || (strings.HasPrefix(name, typeName) && name[len(typeName)] == '_')) {
+				family = typ
+			}
+			f(name, family, labels, value)
+		}
+	}
+}
+
+// parseMetricLine parses `name{label="value",...} value`.
+func parseMetricLine(line string) (name string, labels []metricTag, value float64, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, 0, false
+	}
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return "", nil, 0, false
+	}
+	name, line = line[:end], line[end:]
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, ", ")
+			if strings.HasPrefix(line, "}") {
+				line = line[1:]
+				break
+			}
+			eq := strings.Index(line, `="`)
+			if eq <= 0 {
+				return "", nil, 0, false
+			}
+			label := metricTag{name: line[:eq]}
+			line = line[eq+2:]
+			var v strings.Builder
+			closed := false
+			for i := 0; i < len(line); i++ {
+				c := line[i]
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						v.WriteByte('\n')
+					default:
+						v.WriteByte(line[i])
+					}
+					continue
+				}
+				if c == '"' {
+					line, closed = line[i+1:], true
+					break
+				}
+				v.WriteByte(c)
+			}
+			if !closed {
+				return "", nil, 0, false
+			}
+			label.value = v.String()
+			labels = append(labels, label)
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, 0, false
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+	return name, labels, value, true
+}
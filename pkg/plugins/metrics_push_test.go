@@ -0,0 +1,138 @@
+package plugins
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricLine(t *testing.T) {
+	assert := assert.New(t)
+	name, labels, value, ok := parseMetricLine(`dns_requests_total{server="dns",qtype="A \"x\"\\y"} 12`)
+	assert.True(ok)
+	assert.Equal("dns_requests_total", name)
+	assert.Equal([]metricTag{{"server", "dns"}, {"qtype", `A "x"\y`}}, labels)
+	assert.Equal(12.0, value)
+
+	name, labels, value, ok = parseMetricLine(`go_goroutines 7.5`)
+	assert.True(ok)
+	assert.Equal("go_goroutines", name)
+	assert.Empty(labels)
+	assert.Equal(7.5, value)
+
+	for _, line := range []string{"", "# TYPE x counter", `x{a="b} 1`, "x", "x{} nan?"} {
+		_, _, _, ok := parseMetricLine(line)
+		assert.False(ok, line)
+	}
+}
+
+func TestMetricsPusherFormats(t *testing.T) {
+	assert := assert.New(t)
+	for _, push := range []string{"", "statsd://", "http://localhost:8125", "graphite://localhost"} {
+		_, err := newMetricsPusher(push, "", nil, time.Second, time.Second)
+		assert.Error(err, push)
+	}
+
+	exposition := []byte("# comment\n" +
+		`dns_requests_total{server="dns",qtype="A"} 3` + "\n" +
+		`dns_cache_entries 5` + "\n" +
+		`dns_delta -2` + "\n" +
+		`dns_x{v=""} 1` + "\n")
+
+	p, err := newMetricsPusher("graphite://localhost:2003", "dns.", map[string]string{"host": "a;b"}, time.Second, time.Second)
+	assert.NoError(err)
+	assert.Equal("dns.dns_requests_total;host=a_b;server=dns;qtype=A 3 100\n"+
+		"dns.dns_cache_entries;host=a_b 5 100\n"+
+		"dns.dns_delta;host=a_b -2 100\n"+
+		"dns.dns_x;host=a_b;v=none 1 100\n", string(p.graphite(exposition, time.Unix(100, 0))))
+
+	p, err = newMetricsPusher("statsd://localhost:8125", "", map[string]string{"env": "prod"}, time.Second, time.Second)
+	assert.NoError(err)
+	packets := p.statsd(exposition)
+	assert.Len(packets, 1)
+	assert.Equal("dns_requests_total:3|c|#env:prod,server:dns,qtype:A\n"+
+		"dns_cache_entries:5|g|#env:prod\n"+
+		"dns_delta:0|g|#env:prod\n"+
+		"dns_delta:-2|g|#env:prod\n"+
+		"dns_x:1|g|#env:prod,v:none\n", string(packets[0]))
+
+	// the counters are sent as increments, unchanged ones are skipped
+	exposition = []byte(`dns_requests_total{server="dns",qtype="A"} 5` + "\n" +
+		`dns_responses_total 0` + "\n")
+	assert.Equal([][]byte{[]byte("dns_requests_total:2|c|#env:prod,server:dns,qtype:A\n")}, p.statsd(exposition))
+	assert.Empty(p.statsd(exposition))
+
+	// the series are typed by the # TYPE of their family
+	p, err = newMetricsPusher("statsd://localhost:8125", "", nil, time.Second, time.Second)
+	assert.NoError(err)
+	exposition = []byte("# HELP dns_query_inflight_count inflight\n" +
+		"# TYPE dns_query_inflight_count gauge\n" +
+		"dns_query_inflight_count 3\n" +
+		"# TYPE dns_request_duration_seconds histogram\n" +
+		`dns_request_duration_seconds_bucket{vmrange="1e-3"} 4` + "\n" +
+		"dns_request_duration_seconds_sum 0.5\n" +
+		"dns_request_duration_seconds_count 4\n" +
+		"# TYPE dns_failures counter\n" +
+		"dns_failures 2\n")
+	assert.Equal([][]byte{[]byte("dns_query_inflight_count:3|g\n" +
+		"dns_request_duration_seconds_bucket:4|c|#vmrange:1e-3\n" +
+		"dns_request_duration_seconds_sum:0.5|c\n" +
+		"dns_request_duration_seconds_count:4|c\n" +
+		"dns_failures:2|c\n")}, p.statsd(exposition))
+	exposition = bytes.Replace(exposition, []byte("dns_query_inflight_count 3"), []byte("dns_query_inflight_count 1"), 1)
+	assert.Equal([][]byte{[]byte("dns_query_inflight_count:1|g\n")}, p.statsd(exposition), "a gauge is never a delta")
+
+	// the datagrams are split
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		b.WriteString("dns_gauge_with_a_long_name 1\n")
+	}
+	packets = p.statsd([]byte(b.String()))
+	assert.Greater(len(packets), 1)
+	for _, packet := range packets {
+		assert.LessOrEqual(len(packet), statsdPacketSize)
+	}
+}
+
+func TestMetricsPusherSend(t *testing.T) {
+	assert := assert.New(t)
+	metrics.GetOrCreateCounter(`dns_metrics_push_test_total`).Inc()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer udp.Close()
+	p, err := newMetricsPusher("statsd://"+udp.LocalAddr().String(), "fwd", nil, time.Second, time.Second)
+	assert.NoError(err)
+	assert.NoError(p.push())
+	var received strings.Builder
+	buf := make([]byte, 64*1024)
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	for !strings.Contains(received.String(), "fwd.dns_metrics_push_test_total:1|c\n") {
+		n, _, err := udp.ReadFrom(buf)
+		if !assert.NoError(err) {
+			break
+		}
+		received.Write(buf[:n])
+	}
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer tcp.Close()
+	p, err = newMetricsPusher("graphite://"+tcp.Addr().String(), "fwd", nil, 10*time.Millisecond, time.Second)
+	assert.NoError(err)
+	p.start()
+	conn, err := tcp.Accept()
+	assert.NoError(err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	body, err := io.ReadAll(conn)
+	assert.NoError(err)
+	conn.Close()
+	p.stop()
+	assert.Contains(string(body), "fwd.dns_metrics_push_test_total 1 ")
+}
@@ -0,0 +1,310 @@
+//go:build linux
+
+package plugins
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/VictoriaMetrics/metrics"
+	log "github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	recvmmsgCalls   = metrics.GetOrCreateCounter(`dns_udp_mmsg_syscalls_total{op="recvmmsg"}`)
+	sendmmsgCalls   = metrics.GetOrCreateCounter(`dns_udp_mmsg_syscalls_total{op="sendmmsg"}`)
+	recvmmsgPackets = metrics.GetOrCreateCounter(`dns_udp_mmsg_packets_total{op="recvmmsg"}`)
+	sendmmsgPackets = metrics.GetOrCreateCounter(`dns_udp_mmsg_packets_total{op="sendmmsg"}`)
+	recvmmsgErrors  = metrics.GetOrCreateCounter(`dns_udp_mmsg_errors_total{op="recvmmsg"}`)
+)
+
+const (
+	// the reader waits between the failed reads, doubling up to the max
+	mmsgRetryMin = time.Millisecond
+	mmsgRetryMax = time.Second
+	// the read errors are logged at most once per interval
+	mmsgErrorLogInterval = 10 * time.Second
+)
+
+// mmsghdr is struct mmsghdr from sendmmsg(2), it isn't defined in x/sys.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgPeer is the raw socket address of a client.
+type mmsgPeer struct {
+	addr unix.RawSockaddrAny
+	len  uint32
+}
+
+func (p *mmsgPeer) udpAddr() *net.UDPAddr {
+	switch p.addr.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&p.addr))
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: networkPort(&sa.Port)}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&p.addr))
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: networkPort(&sa.Port)}
+	}
+	return &net.UDPAddr{}
+}
+
+// networkPort reads a port stored in network byte order.
+func networkPort(port *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(port))
+	return int(b[0])<<8 | int(b[1])
+}
+
+type mmsgPacket struct {
+	out  []byte
+	buf  *[]byte
+	peer *mmsgPeer
+}
+
+// mmsgSocket is a SO_REUSEPORT udp socket with a reader and a writer goroutine,
+// both moving batches of datagrams per syscall.
+type mmsgSocket struct {
+	conn      *net.UDPConn
+	raw       syscall.RawConn
+	batchSize int
+
+	rhdrs  []mmsghdr
+	riovs  []unix.Iovec
+	rbufs  [][]byte
+	rnames []unix.RawSockaddrAny
+
+	out   chan *mmsgPacket
+	done  chan struct{}
+	shdrs []mmsghdr
+	siovs []unix.Iovec
+	wg    sync.WaitGroup
+}
+
+func listenMmsg(network, address string, batchSize, bufferSize int, pmtuMode string) (*mmsgSocket, error) {
+	pc, err := serverListenConfig(pmtuMode).ListenPacket(context.Background(), network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &mmsgSocket{
+		conn:      conn,
+		raw:       raw,
+		batchSize: batchSize,
+		rhdrs:     make([]mmsghdr, batchSize),
+		riovs:     make([]unix.Iovec, batchSize),
+		rbufs:     make([][]byte, batchSize),
+		rnames:    make([]unix.RawSockaddrAny, batchSize),
+		out:       make(chan *mmsgPacket, batchSize*4),
+		done:      make(chan struct{}),
+		shdrs:     make([]mmsghdr, batchSize),
+		siovs:     make([]unix.Iovec, batchSize),
+	}
+	for i := range s.rhdrs {
+		s.rbufs[i] = make([]byte, bufferSize)
+		s.riovs[i].Base = &s.rbufs[i][0]
+		s.riovs[i].SetLen(bufferSize)
+		s.rhdrs[i].hdr.Iov = &s.riovs[i]
+		s.rhdrs[i].hdr.SetIovlen(1)
+		s.rhdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&s.rnames[i]))
+	}
+	return s, nil
+}
+
+func (s *mmsgSocket) localAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// serve starts the reader and writer, handle is called for every datagram read.
+func (s *mmsgSocket) serve(handle func(s *mmsgSocket, in []byte, peer *mmsgPeer)) {
+	s.wg.Add(2)
+	go s.sendLoop()
+	go func() {
+		defer s.wg.Done()
+		retry := &mmsgRetry{}
+		for {
+			n, err := s.recv()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) || !retry.wait(err, s.done) {
+					return
+				}
+				continue
+			}
+			retry.reset()
+			recvmmsgPackets.Add(n)
+			for i := 0; i < n; i++ {
+				h := &s.rhdrs[i]
+				if h.hdr.Flags&unix.MSG_TRUNC != 0 {
+					continue // larger than the read buffer
+				}
+				peer := &mmsgPeer{addr: s.rnames[i], len: h.hdr.Namelen}
+				handle(s, s.rbufs[i][:h.len], peer)
+			}
+		}
+	}()
+}
+
+// mmsgRetry backs off the reads after the errors, so a persistent error doesn't
+// spin the reader or flood the log.
+type mmsgRetry struct {
+	delay      time.Duration
+	logged     time.Time
+	suppressed int
+}
+
+// wait logs the error and sleeps before the next read, false is returned when
+// the reader must stop: the error can't recover or the socket is closing.
+func (r *mmsgRetry) wait(err error, done chan struct{}) bool {
+	recvmmsgErrors.Inc()
+	if errors.Is(err, unix.EBADF) || errors.Is(err, unix.ENOTSOCK) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EFAULT) {
+		log.Error().Err(err).Msg("recvmmsg failed, stopping the reader")
+		return false
+	}
+	if now := time.Now(); now.Sub(r.logged) >= mmsgErrorLogInterval {
+		log.Error().Err(err).Int("suppressed", r.suppressed).Msg("recvmmsg")
+		r.logged, r.suppressed = now, 0
+	} else {
+		r.suppressed++
+	}
+	r.delay = min(max(2*r.delay, mmsgRetryMin), mmsgRetryMax)
+	select {
+	case <-done:
+		return false
+	case <-time.After(r.delay):
+		return true
+	}
+}
+
+func (r *mmsgRetry) reset() {
+	r.delay = 0
+}
+
+// recv waits for at least one datagram and reads up to a batch of them.
+func (s *mmsgSocket) recv() (int, error) {
+	for i := range s.rhdrs {
+		s.rhdrs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		s.rhdrs[i].hdr.Flags = 0
+	}
+	var n int
+	var errno syscall.Errno
+	err := s.raw.Read(func(fd uintptr) bool {
+		for {
+			recvmmsgCalls.Inc()
+			r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&s.rhdrs[0])), uintptr(len(s.rhdrs)), unix.MSG_DONTWAIT, 0, 0)
+			switch e {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return n, nil
+}
+
+// send queues the packed response for the writer, buf is returned to the pool after it is sent.
+func (s *mmsgSocket) send(out []byte, buf *[]byte, peer *mmsgPeer) error {
+	select {
+	case s.out <- &mmsgPacket{out: out, buf: buf, peer: peer}:
+		return nil
+	case <-s.done:
+		putPackBuffer(buf)
+		return net.ErrClosed
+	}
+}
+
+// sendLoop collects the queued responses into batches, a batch is written as
+// soon as no more responses are waiting or it is full.
+func (s *mmsgSocket) sendLoop() {
+	defer s.wg.Done()
+	batch := make([]*mmsgPacket, 0, s.batchSize)
+	for {
+		select {
+		case p := <-s.out:
+			batch = append(batch[:0], p)
+		case <-s.done:
+			return
+		}
+	fill:
+		for len(batch) < s.batchSize {
+			select {
+			case p := <-s.out:
+				batch = append(batch, p)
+			default:
+				break fill
+			}
+		}
+		s.sendBatch(batch)
+		for i, p := range batch {
+			putPackBuffer(p.buf)
+			batch[i] = nil
+		}
+	}
+}
+
+func (s *mmsgSocket) sendBatch(batch []*mmsgPacket) {
+	for i, p := range batch {
+		s.siovs[i].Base = &p.out[0]
+		s.siovs[i].SetLen(len(p.out))
+		h := &s.shdrs[i].hdr
+		h.Iov = &s.siovs[i]
+		h.SetIovlen(1)
+		h.Name = (*byte)(unsafe.Pointer(&p.peer.addr))
+		h.Namelen = p.peer.len
+	}
+	for sent := 0; sent < len(batch); {
+		var n int
+		var errno syscall.Errno
+		err := s.raw.Write(func(fd uintptr) bool {
+			for {
+				sendmmsgCalls.Inc()
+				r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&s.shdrs[sent])), uintptr(len(batch)-sent), unix.MSG_DONTWAIT, 0, 0)
+				switch e {
+				case unix.EINTR:
+					continue
+				case unix.EAGAIN:
+					return false
+				}
+				n, errno = int(r), e
+				return true
+			}
+		})
+		if err != nil {
+			return
+		}
+		if errno != 0 {
+			// skip the datagram that failed
+			log.Debug().Err(errno).Msg("sendmmsg")
+			sent++
+			continue
+		}
+		sendmmsgPackets.Add(n)
+		sent += n
+	}
+}
+
+func (s *mmsgSocket) close() {
+	close(s.done)
+	s.conn.Close()
+	s.wg.Wait()
+}
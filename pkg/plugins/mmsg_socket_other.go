@@ -0,0 +1,35 @@
+//go:build !linux
+
+package plugins
+
+import (
+	"errors"
+	"net"
+)
+
+var errMmsgUnsupported = errors.New("recvmmsg/sendmmsg are only supported on linux")
+
+type mmsgPeer struct{}
+
+func (p *mmsgPeer) udpAddr() *net.UDPAddr {
+	return &net.UDPAddr{}
+}
+
+type mmsgSocket struct{}
+
+func listenMmsg(network, address string, batchSize, bufferSize int, pmtuMode string) (*mmsgSocket, error) {
+	return nil, errMmsgUnsupported
+}
+
+func (s *mmsgSocket) localAddr() net.Addr {
+	return nil
+}
+
+func (s *mmsgSocket) serve(handle func(s *mmsgSocket, in []byte, peer *mmsgPeer)) {}
+
+func (s *mmsgSocket) send(out []byte, buf *[]byte, peer *mmsgPeer) error {
+	putPackBuffer(buf)
+	return errMmsgUnsupported
+}
+
+func (s *mmsgSocket) close() {}
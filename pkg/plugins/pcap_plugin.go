@@ -0,0 +1,489 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// PcapPlugin captures the exchanges of the matching queries, with the client
+// and the upstreams, to a rotating pcapng file. The packets are rebuilt from
+// the messages and the addresses of the queries, with synthetic IP, UDP and
+// TCP headers, so no capture privileges are needed. A capture runs from the
+// start or is started with the admin API, it stops after its duration.
+type PcapPlugin struct {
+	config  PcapPluginConfig
+	filters pcapFilters
+	mu      sync.Mutex
+	capture atomic.Pointer[pcapCapture]
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&PcapPlugin{})
+}
+
+func (p *PcapPlugin) Name() string {
+	return "pcap"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (p *PcapPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(p.Name(), &p.config, out)
+}
+
+type PcapPluginConfig struct {
+	File           string        `toml:"file" comment:"pcapng file, rotated to file.1, file.2..." default:"dns-forwarder.pcapng"`
+	FileMaxSize    int           `toml:"fileMaxSizeMB" comment:"Rotate the file at this size in MB, 0 never rotates" default:"100"`
+	FileMaxBackups int           `toml:"fileMaxBackups" comment:"Rotated files kept" default:"5"`
+	Clients        []string      `toml:"clients" comment:"Client CIDRs or IPs captured, all when empty"`
+	Names          []string      `toml:"names" comment:"Query name suffixes captured, all when empty"`
+	Rcodes         []string      `toml:"rcodes" comment:"Response codes captured, e.g. SERVFAIL, all when empty"`
+	Upstream       bool          `toml:"upstream" comment:"Capture the upstream exchanges of the matching queries" default:"true"`
+	Start          bool          `toml:"start" comment:"Capture from the start, otherwise once started with the admin API" default:"true"`
+	Duration       time.Duration `toml:"duration" comment:"Stop a capture after this time, 0 never stops" default:"0s"`
+	BufferSize     int           `toml:"bufferSize" comment:"Max exchanges waiting to be written, more are dropped" default:"10000"`
+}
+
+var (
+	pcapPackets          = metrics.GetOrCreateCounter(`dns_pcap_packets_total`)
+	pcapDroppedFull      = metrics.GetOrCreateCounter(`dns_pcap_dropped_total{reason="buffer_full"}`)
+	pcapDroppedWriteFail = metrics.GetOrCreateCounter(`dns_pcap_dropped_total{reason="write_error"}`)
+)
+
+const (
+	pcapKey = "Pcap"
+
+	pcapPath      = "/pcap"
+	pcapStartPath = "/pcap/start"
+	pcapStopPath  = "/pcap/stop"
+)
+
+// Configure the plugin.
+func (p *PcapPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("PcapPlugin.Configure")
+	p.config = PcapPluginConfig{}
+	if err := UnmarshalConfiguration(config, &p.config); err != nil {
+		return err
+	}
+	if p.config.File == "" {
+		return fmt.Errorf("invalid pcap file: %q", p.config.File)
+	}
+	if p.config.BufferSize < 1 {
+		return fmt.Errorf("invalid pcap buffer size: %v", p.config.BufferSize)
+	}
+	if p.config.Duration < 0 {
+		return fmt.Errorf("invalid pcap duration: %v", p.config.Duration)
+	}
+	filters, err := parsePcapFilters(p.config.Clients, p.config.Names, p.config.Rcodes)
+	if err != nil {
+		return err
+	}
+	p.filters = filters
+	return nil
+}
+
+// Start the protocol plugin.
+func (p *PcapPlugin) StartClient(ctx context.Context, handler Handler) error {
+	if p.config.Start {
+		if _, err := p.startCapture(p.filters, p.config.Duration); err != nil {
+			return err
+		}
+	}
+	if p.config.Upstream {
+		setForwarderTap(p.Name(), p.tapForwarder)
+	}
+	for _, path := range []string{pcapPath, pcapStartPath, pcapStopPath} {
+		registerAdminHandler(path, p)
+	}
+	return nil
+}
+
+// Stop the protocol plugin, the queued exchanges are written first.
+func (p *PcapPlugin) StopClient(ctx context.Context) error {
+	for _, path := range []string{pcapPath, pcapStartPath, pcapStopPath} {
+		registerAdminHandler(path, nil)
+	}
+	setForwarderTap(p.Name(), nil)
+	p.stopCapture()
+	return nil
+}
+
+func (p *PcapPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	c := p.capture.Load()
+	if c == nil || !c.filters.matchQuery(ctx, msg) {
+		return nil
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	x := &pcapExchange{capture: c, proto: protoUDP}
+	if remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr); ok && remote != nil && remote.Network() == protoTCP {
+		x.proto = protoTCP
+	}
+	if remote := clientAddr(ctx); remote != nil {
+		x.client = dnstapAddrPort(remote)
+	}
+	if local, ok := QueryMetadata(ctx)["LocalAddr"].(net.Addr); ok && local != nil {
+		x.local = dnstapAddrPort(local)
+	}
+	x.add(pcapPacket{at: time.Now(), proto: x.proto, src: x.client, dst: x.local, msg: wire})
+	x.queryLen = len(wire)
+	QueryMetadata(ctx)[pcapKey] = x
+	return nil
+}
+
+func (p *PcapPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	x, ok := QueryMetadata(ctx)[pcapKey].(*pcapExchange)
+	if !ok {
+		return nil
+	}
+	delete(QueryMetadata(ctx), pcapKey)
+	if !x.capture.filters.matchRcode(msg.Rcode) {
+		return nil
+	}
+	wire, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	x.add(pcapPacket{at: time.Now(), proto: x.proto, src: x.local, dst: x.client, msg: wire, answers: x.queryLen})
+	x.capture.emit(x)
+	return nil
+}
+
+// tapForwarder adds the upstream exchanges to the exchange of the query.
+func (p *PcapPlugin) tapForwarder(ctx context.Context, m *dnstapMessage, resp []byte) {
+	x, ok := QueryMetadata(ctx)[pcapKey].(*pcapExchange)
+	if !ok {
+		return
+	}
+	x.add(pcapPacket{at: m.queryTime, proto: m.protocol, src: m.queryAddr, dst: m.responseAddr, msg: m.queryMsg})
+	if resp != nil {
+		x.add(pcapPacket{at: time.Now(), proto: m.protocol, src: m.responseAddr, dst: m.queryAddr, msg: resp, answers: len(m.queryMsg)})
+	}
+}
+
+// startCapture starts a capture, only one runs at a time.
+func (p *PcapPlugin) startCapture(filters pcapFilters, duration time.Duration) (*pcapCapture, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.capture.Load() != nil {
+		return nil, fmt.Errorf("pcap capture already running")
+	}
+	c := &pcapCapture{
+		filters:   filters,
+		started:   time.Now(),
+		exchanges: make(chan *pcapExchange, p.config.BufferSize),
+		done:      make(chan struct{}),
+		file: &utils.RotatingFile{
+			Path:       p.config.File,
+			MaxSize:    int64(p.config.FileMaxSize) << 20,
+			MaxBackups: p.config.FileMaxBackups,
+			Header:     utils.PcapngHeader(),
+		},
+	}
+	if duration > 0 {
+		c.until = c.started.Add(duration)
+	}
+	if err := c.file.Open(); err != nil {
+		return nil, err
+	}
+	log.Info().Str("file", p.config.File).Time("until", c.until).Msg("pcap capture started")
+	c.wg.Add(1)
+	go p.run(c)
+	p.capture.Store(c)
+	return c, nil
+}
+
+// stopCapture stops the running capture, once its queued exchanges are written.
+func (p *PcapPlugin) stopCapture() *pcapCapture {
+	p.mu.Lock()
+	c := p.capture.Swap(nil)
+	p.mu.Unlock()
+	if c != nil {
+		close(c.done)
+		c.wg.Wait()
+	}
+	return c
+}
+
+// run writes the exchanges of the capture until it's stopped or expires.
+func (p *PcapPlugin) run(c *pcapCapture) {
+	defer c.wg.Done()
+	var expired <-chan time.Time
+	if !c.until.IsZero() {
+		timer := time.NewTimer(time.Until(c.until))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var b []byte
+	write := func(x *pcapExchange) {
+		b = x.appendPackets(b[:0])
+		if _, err := c.file.Write(b); err != nil {
+			pcapDroppedWriteFail.Inc()
+			log.Warn().Err(err).Str("file", p.config.File).Msg("pcap write failed")
+			return
+		}
+		c.packets.Add(uint64(len(x.packets)))
+		pcapPackets.Add(len(x.packets))
+	}
+wait:
+	for {
+		select {
+		case x := <-c.exchanges:
+			write(x)
+		case <-c.done:
+			break wait
+		case <-expired:
+			p.mu.Lock()
+			p.capture.CompareAndSwap(c, nil)
+			p.mu.Unlock()
+			break wait
+		}
+	}
+	for len(c.exchanges) > 0 {
+		write(<-c.exchanges)
+	}
+	if err := c.file.Close(); err != nil {
+		log.Warn().Err(err).Str("file", p.config.File).Msg("pcap close failed")
+	}
+	log.Info().Str("file", p.config.File).Uint64("packets", c.packets.Load()).Msg("pcap capture stopped")
+}
+
+type pcapStatus struct {
+	Running bool      `json:"running"`
+	File    string    `json:"file"`
+	Started time.Time `json:"started,omitempty"`
+	Until   time.Time `json:"until,omitempty"`
+	Packets uint64    `json:"packets"`
+	Clients []string  `json:"clients,omitempty"`
+	Names   []string  `json:"names,omitempty"`
+	Rcodes  []string  `json:"rcodes,omitempty"`
+}
+
+func (p *PcapPlugin) status(c *pcapCapture) pcapStatus {
+	s := pcapStatus{File: p.config.File}
+	if c == nil {
+		return s
+	}
+	s.Running = p.capture.Load() == c
+	s.Started, s.Until, s.Packets = c.started, c.until, c.packets.Load()
+	for _, pr := range c.filters.clients {
+		s.Clients = append(s.Clients, pr.String())
+	}
+	s.Names = c.filters.names
+	for _, rcode := range c.filters.rcodes {
+		s.Rcodes = append(s.Rcodes, dns.RcodeToString[rcode])
+	}
+	return s
+}
+
+// ServeHTTP returns the capture status, or starts and stops a capture on a
+// POST. The start takes the duration, and the client, name and rcode filters
+// replacing the configured ones.
+func (p *PcapPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == pcapPath {
+		writeAdminJSON(w, p.status(p.capture.Load()))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == pcapStopPath {
+		writeAdminJSON(w, p.status(p.stopCapture()))
+		return
+	}
+	params := r.URL.Query()
+	duration := p.config.Duration
+	if v := params.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("invalid duration: %v", v), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	filters := p.filters
+	if params.Has("client") || params.Has("name") || params.Has("rcode") {
+		var err error
+		if filters, err = parsePcapFilters(params["client"], params["name"], params["rcode"]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	c, err := p.startCapture(filters, duration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeAdminJSON(w, p.status(c))
+}
+
+// pcapCapture is a running capture.
+type pcapCapture struct {
+	filters   pcapFilters
+	started   time.Time
+	until     time.Time
+	file      *utils.RotatingFile
+	exchanges chan *pcapExchange
+	packets   atomic.Uint64
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// emit queues the exchange without blocking, it is dropped when the buffer is full.
+func (c *pcapCapture) emit(x *pcapExchange) {
+	select {
+	case c.exchanges <- x:
+	default:
+		pcapDroppedFull.Inc()
+	}
+}
+
+// pcapFilters select the captured queries, an empty filter matches all.
+type pcapFilters struct {
+	clients []netip.Prefix
+	names   []string
+	rcodes  []int
+}
+
+func parsePcapFilters(clients, names, rcodes []string) (pcapFilters, error) {
+	var f pcapFilters
+	var err error
+	if f.clients, err = utils.ParsePrefixes(clients); err != nil {
+		return f, fmt.Errorf("invalid pcap clients: %w", err)
+	}
+	for _, name := range names {
+		f.names = append(f.names, dns.CanonicalName(name))
+	}
+	for _, rcode := range rcodes {
+		code, ok := dns.StringToRcode[strings.ToUpper(rcode)]
+		if !ok {
+			return f, fmt.Errorf("invalid pcap rcode: %v", rcode)
+		}
+		f.rcodes = append(f.rcodes, code)
+	}
+	return f, nil
+}
+
+func (f *pcapFilters) matchQuery(ctx context.Context, msg *dns.Msg) bool {
+	if len(f.clients) > 0 {
+		remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr)
+		if !ok {
+			return false
+		}
+		client, _ := utils.AddrToNetIP(remote)
+		if !slices.ContainsFunc(f.clients, func(pr netip.Prefix) bool { return pr.Contains(client) }) {
+			return false
+		}
+	}
+	if len(f.names) > 0 {
+		qname := strings.ToLower(safeQuestion(msg).Name)
+		if !slices.ContainsFunc(f.names, func(n string) bool { return dns.IsSubDomain(n, qname) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *pcapFilters) matchRcode(rcode int) bool {
+	return len(f.rcodes) == 0 || slices.Contains(f.rcodes, rcode)
+}
+
+// pcapExchange is a client query with its upstream exchanges and response.
+type pcapExchange struct {
+	capture  *pcapCapture
+	proto    string
+	client   netip.AddrPort
+	local    netip.AddrPort
+	queryLen int
+	mu       sync.Mutex
+	packets  []pcapPacket
+}
+
+type pcapPacket struct {
+	at       time.Time
+	proto    string
+	src, dst netip.AddrPort
+	msg      []byte
+	// answers is the length of the query of a response
+	answers int
+}
+
+func (x *pcapExchange) add(packet pcapPacket) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.packets = append(x.packets, packet)
+}
+
+// appendPackets appends the packets as pcapng blocks, the messages over tcp
+// are a segment each, with their length, the responses acknowledge the query.
+func (x *pcapExchange) appendPackets(b []byte) []byte {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var ip []byte
+	var err error
+	for _, packet := range x.packets {
+		src, dst := pcapEndpoints(packet.src, packet.dst)
+		if packet.proto == protoTCP {
+			ack := uint32(1)
+			if packet.answers > 0 {
+				ack += uint32(packet.answers + 2)
+			}
+			ip, err = utils.AppendTCPPacket(ip[:0], src, dst, 1, ack, binaryLength(packet.msg))
+		} else {
+			ip, err = utils.AppendUDPPacket(ip[:0], src, dst, packet.msg)
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("pcap packet")
+			continue
+		}
+		b = utils.AppendPcapngPacket(b, packet.at, ip)
+	}
+	return b
+}
+
+// binaryLength prefixes the message with its length, as sent over tcp.
+func binaryLength(msg []byte) []byte {
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+// pcapEndpoints returns addresses of the same family for a packet, the
+// unknown ones are unspecified and IPv4 is mapped when mixed with IPv6.
+func pcapEndpoints(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort) {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	switch {
+	case !srcIP.IsValid() && !dstIP.IsValid():
+		srcIP, dstIP = netip.IPv4Unspecified(), netip.IPv4Unspecified()
+	case !srcIP.IsValid():
+		srcIP = unspecifiedLike(dstIP)
+	case !dstIP.IsValid():
+		dstIP = unspecifiedLike(srcIP)
+	case srcIP.Is4() != dstIP.Is4():
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	return netip.AddrPortFrom(srcIP, src.Port()), netip.AddrPortFrom(dstIP, dst.Port())
+}
+
+func unspecifiedLike(ip netip.Addr) netip.Addr {
+	if ip.Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
@@ -0,0 +1,176 @@
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// readPcapng returns the IP packets of the enhanced packet blocks.
+func readPcapng(t *testing.T, path string) [][]byte {
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	packets := [][]byte{}
+	for len(b) >= 12 {
+		typ, size := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if typ == 6 {
+			n := binary.LittleEndian.Uint32(b[20:])
+			packets = append(packets, b[28:28+n])
+		}
+		b = b[size:]
+	}
+	return packets
+}
+
+func pcapExchangeQuery(t *testing.T, p *PcapPlugin, remote net.Addr, name string, rcode int) {
+	ctx, q := aclQuery(remote, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, name)
+	assert.NoError(t, p.Query(ctx, q))
+	wire, _ := q.Pack()
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	rwire, _ := r.Pack()
+	tapForwarderExchange(ctx, protoUDP, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 40000}, "198.51.100.1:53", wire, time.Now(), rwire, nil)
+	assert.NoError(t, p.Response(ctx, r))
+}
+
+func TestPcapPlugin(t *testing.T) {
+	assert := assert.New(t)
+	p := &PcapPlugin{}
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"rcodes": []string{"NOPE"}}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"clients": []string{"nope"}}))
+
+	file := filepath.Join(t.TempDir(), "capture.pcapng")
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{
+		"file": file, "names": []string{"Example.com"}, "rcodes": []string{"noerror"},
+	}))
+	assert.NoError(p.StartClient(context.Background(), nil))
+	udpClient := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	pcapExchangeQuery(t, p, udpClient, "www.example.com.", dns.RcodeSuccess)
+	pcapExchangeQuery(t, p, udpClient, "example.org.", dns.RcodeSuccess)
+	pcapExchangeQuery(t, p, udpClient, "nx.example.com.", dns.RcodeNameError)
+	pcapExchangeQuery(t, p, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40001}, "example.com.", dns.RcodeSuccess)
+	assert.NoError(p.StopClient(context.Background()))
+
+	packets := readPcapng(t, file)
+	if !assert.Len(packets, 8) {
+		return
+	}
+	// the client query over udp
+	ip := packets[0]
+	assert.Equal(byte(0x45), ip[0])
+	assert.Equal(net.ParseIP("192.0.2.1").To4(), net.IP(ip[12:16]))
+	assert.Equal(net.ParseIP("192.0.2.53").To4(), net.IP(ip[16:20]))
+	assert.Equal(uint16(53), binary.BigEndian.Uint16(ip[22:]))
+	m := new(dns.Msg)
+	assert.NoError(m.Unpack(ip[28:]))
+	assert.Equal("www.example.com.", m.Question[0].Name)
+	// the upstream exchange
+	assert.Equal(net.ParseIP("198.51.100.1").To4(), net.IP(packets[1][16:20]))
+	assert.Equal(net.ParseIP("198.51.100.1").To4(), net.IP(packets[2][12:16]))
+	// the client response
+	assert.Equal(net.ParseIP("192.0.2.1").To4(), net.IP(packets[3][16:20]))
+	assert.NoError(m.Unpack(packets[3][28:]))
+	assert.True(m.Response)
+
+	// the client exchange over tcp with IPv6, the upstream over udp with IPv4
+	ip = packets[4]
+	assert.Equal(byte(0x60), ip[0])
+	assert.Equal(byte(6), ip[6])
+	assert.Equal(netip.MustParseAddr("2001:db8::1").AsSlice(), ip[8:24])
+	assert.Equal(netip.MustParseAddr("::ffff:192.0.2.53").AsSlice(), ip[24:40])
+	assert.Equal(int(binary.BigEndian.Uint16(ip[60:])), len(ip)-62)
+	assert.NoError(m.Unpack(ip[62:]))
+	assert.Equal("example.com.", m.Question[0].Name)
+	assert.Equal(byte(0x45), packets[5][0])
+	response := packets[7]
+	assert.Equal(uint32(1+len(ip)-60), binary.BigEndian.Uint32(response[48:]))
+}
+
+func TestPcapPluginAdmin(t *testing.T) {
+	assert := assert.New(t)
+	p := &PcapPlugin{}
+	file := filepath.Join(t.TempDir(), "capture.pcapng")
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{"file": file, "start": false}))
+	assert.NoError(p.StartClient(context.Background(), nil))
+	defer p.StopClient(context.Background())
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		adminHandler(r.URL.Path).ServeHTTP(w, r)
+		return w
+	}
+	status := func(w *httptest.ResponseRecorder) pcapStatus {
+		var s pcapStatus
+		assert.NoError(json.NewDecoder(w.Body).Decode(&s))
+		return s
+	}
+	assert.False(status(do(http.MethodGet, pcapPath)).Running)
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	pcapExchangeQuery(t, p, client, "example.com.", dns.RcodeServerFailure)
+
+	assert.Equal(http.StatusMethodNotAllowed, do(http.MethodGet, pcapStartPath).Code)
+	assert.Equal(http.StatusBadRequest, do(http.MethodPost, pcapStartPath+"?rcode=NOPE").Code)
+	assert.Equal(http.StatusBadRequest, do(http.MethodPost, pcapStartPath+"?duration=soon").Code)
+	s := status(do(http.MethodPost, pcapStartPath+"?rcode=SERVFAIL&client=192.0.2.0/24"))
+	assert.True(s.Running)
+	assert.Equal([]string{"SERVFAIL"}, s.Rcodes)
+	assert.Equal([]string{"192.0.2.0/24"}, s.Clients)
+	assert.Equal(http.StatusConflict, do(http.MethodPost, pcapStartPath).Code)
+	pcapExchangeQuery(t, p, client, "example.com.", dns.RcodeServerFailure)
+	pcapExchangeQuery(t, p, client, "example.com.", dns.RcodeSuccess)
+	s = status(do(http.MethodPost, pcapStopPath))
+	assert.False(s.Running)
+	assert.Equal(uint64(4), s.Packets)
+	assert.Len(readPcapng(t, file), 4)
+
+	// the capture stops after its duration
+	s = status(do(http.MethodPost, pcapStartPath+"?duration=50ms"))
+	assert.True(s.Running)
+	assert.Eventually(func() bool { return !status(do(http.MethodGet, pcapPath)).Running }, 5*time.Second, 10*time.Millisecond)
+	_, err := os.Stat(file + ".1")
+	assert.NoError(err)
+}
+
+func TestPcapFileRotation(t *testing.T) {
+	assert := assert.New(t)
+	p := &PcapPlugin{}
+	file := filepath.Join(t.TempDir(), "capture.pcapng")
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{"file": file, "upstream": false}))
+	assert.NoError(p.StartClient(context.Background(), nil))
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	for i := 0; i < 10; i++ {
+		pcapExchangeQuery(t, p, client, "example.com.", dns.RcodeSuccess)
+		if i == 4 {
+			assert.NoError(p.capture.Load().file.Rotate())
+		}
+	}
+	assert.NoError(p.StopClient(context.Background()))
+	// every file starts with the headers
+	total := 0
+	for _, path := range []string{file, file + ".1"} {
+		f, err := os.Open(path)
+		if !assert.NoError(err) {
+			continue
+		}
+		header := make([]byte, 4)
+		_, err = io.ReadFull(f, header)
+		f.Close()
+		assert.NoError(err)
+		assert.Equal(uint32(0x0A0D0D0A), binary.LittleEndian.Uint32(header))
+		total += len(readPcapng(t, path))
+	}
+	assert.Equal(20, total)
+}
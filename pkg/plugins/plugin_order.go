@@ -10,11 +10,20 @@ var (
 	pluginOrder = []string{
 		"memory",
 		"metrics",
+		"admin",
+		"anonymizer",
+		"trace",
 		"dns",
 		"gnetdns",
+		"mmsgdns",
 		"http",
 		"https",
 		"doq",
+		"dnstap",
+		"pcap",
+		"stats",
+		"acl",
+		"rrl",
 		"querylogger",
 		"cache",
 		"dnsclient",
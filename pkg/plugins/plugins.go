@@ -211,6 +211,10 @@ var converter = convert.New(convert.Options{
 			*out, err = time.ParseDuration(in)
 			return
 		},
+		func(_ convert.Converter, in string, out *ListenAddrs) (err error) {
+			*out = ListenAddrs{in}
+			return
+		},
 	),
 })
 
@@ -0,0 +1,175 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+)
+
+// QueryLogRuleConfig selects the transactions logged at a sampling rate, every
+// criteria set must match, an empty criteria matches all.
+type QueryLogRuleConfig struct {
+	Name       string        `toml:"name" comment:"Rule name used in the metrics"`
+	Domains    []string      `toml:"domains" comment:"Query name suffixes"`
+	Regex      string        `toml:"regex" comment:"Regular expression matching the lowercase query name, with the final dot"`
+	Types      []string      `toml:"types" comment:"Query types (A, AAAA...)"`
+	Rcodes     []string      `toml:"rcodes" comment:"Response codes (NOERROR, SERVFAIL...)"`
+	Clients    []string      `toml:"clients" comment:"Client CIDRs or IPs"`
+	MinLatency time.Duration `toml:"minLatency" comment:"Transactions taking at least this long"`
+	CacheMiss  bool          `toml:"cacheMiss" comment:"Responses not served from the cache"`
+	Sample     *float64      `toml:"sample" comment:"Fraction of the matching transactions logged, from 0 to 1 (default 1)"`
+}
+
+// queryLogFilter decides which transactions are logged, the first matching
+// rule wins and the last rule is the default.
+type queryLogFilter struct {
+	rules []*queryLogRule
+}
+
+type queryLogRule struct {
+	name       string
+	domains    []string
+	regex      *regexp.Regexp
+	types      []uint16
+	rcodes     []int
+	clients    []netip.Prefix
+	minLatency time.Duration
+	cacheMiss  bool
+	sample     float64
+	logged     *metrics.Counter
+	suppressed *metrics.Counter
+}
+
+func newQueryLogFilter(rules []QueryLogRuleConfig, defaultSample float64) (*queryLogFilter, error) {
+	if defaultSample < 0 || defaultSample > 1 {
+		return nil, fmt.Errorf("invalid query log default sample: %v", defaultSample)
+	}
+	f := &queryLogFilter{}
+	for i, rc := range rules {
+		rule, err := newQueryLogRule(i, rc)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+	}
+	f.rules = append(f.rules, &queryLogRule{name: "default", sample: defaultSample})
+	for _, r := range f.rules {
+		r.logged = metrics.GetOrCreateCounter(fmt.Sprintf(`dns_querylog_logged_total{rule=%q}`, r.name))
+		r.suppressed = metrics.GetOrCreateCounter(fmt.Sprintf(`dns_querylog_suppressed_total{rule=%q}`, r.name))
+	}
+	return f, nil
+}
+
+func newQueryLogRule(idx int, rc QueryLogRuleConfig) (*queryLogRule, error) {
+	rule := &queryLogRule{name: rc.Name, minLatency: rc.MinLatency, cacheMiss: rc.CacheMiss, sample: 1}
+	if rule.name == "" {
+		rule.name = "rule" + strconv.Itoa(idx)
+	}
+	if rc.Sample != nil {
+		rule.sample = *rc.Sample
+	}
+	if rule.sample < 0 || rule.sample > 1 {
+		return nil, fmt.Errorf("invalid query log sample for rule %v: %v", rule.name, rule.sample)
+	}
+	for _, d := range rc.Domains {
+		rule.domains = append(rule.domains, dns.CanonicalName(d))
+	}
+	if rc.Regex != "" {
+		re, err := regexp.Compile(rc.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query log regex for rule %v: %w", rule.name, err)
+		}
+		rule.regex = re
+	}
+	for _, t := range rc.Types {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return nil, fmt.Errorf("invalid query log type for rule %v: %v", rule.name, t)
+		}
+		rule.types = append(rule.types, qtype)
+	}
+	for _, r := range rc.Rcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(r)]
+		if !ok {
+			return nil, fmt.Errorf("invalid query log rcode for rule %v: %v", rule.name, r)
+		}
+		rule.rcodes = append(rule.rcodes, rcode)
+	}
+	clients, err := utils.ParsePrefixes(rc.Clients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query log clients for rule %v: %w", rule.name, err)
+	}
+	rule.clients = clients
+	return rule, nil
+}
+
+// logged reports if the response is logged, counting it as logged or suppressed
+// by the matching rule. A nil filter logs everything.
+func (f *queryLogFilter) logged(ctx context.Context, resp *dns.Msg) bool {
+	if f == nil {
+		return true
+	}
+	rule := f.match(ctx, resp)
+	if rule.sample >= 1 || (rule.sample > 0 && rand.Float64() < rule.sample) {
+		rule.logged.Inc()
+		return true
+	}
+	rule.suppressed.Inc()
+	return false
+}
+
+// match finds the first rule matching the transaction, or the default rule.
+func (f *queryLogFilter) match(ctx context.Context, resp *dns.Msg) *queryLogRule {
+	last := len(f.rules) - 1
+	if last == 0 {
+		return f.rules[0]
+	}
+	question := safeQuestion(resp)
+	qname := strings.ToLower(question.Name)
+	var client netip.Addr
+	if remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr); ok {
+		client, _ = utils.AddrToNetIP(remote)
+	}
+	var latency time.Duration
+	if req, ok := QueryMetadata(ctx)[queryLogRequestKey].(*queryLogRequest); ok {
+		latency = time.Since(req.start)
+	}
+	cacheMiss := ServedFromCache(ctx) == ""
+
+	for _, r := range f.rules[:last] {
+		if len(r.rcodes) > 0 && !slices.Contains(r.rcodes, resp.Rcode) {
+			continue
+		}
+		if len(r.types) > 0 && !slices.Contains(r.types, question.Qtype) {
+			continue
+		}
+		if r.cacheMiss && !cacheMiss {
+			continue
+		}
+		if r.minLatency > 0 && latency < r.minLatency {
+			continue
+		}
+		if len(r.domains) > 0 && !slices.ContainsFunc(r.domains, func(d string) bool { return dns.IsSubDomain(d, qname) }) {
+			continue
+		}
+		if r.regex != nil && !r.regex.MatchString(qname) {
+			continue
+		}
+		if len(r.clients) > 0 && !slices.ContainsFunc(r.clients, func(p netip.Prefix) bool { return p.Contains(client) }) {
+			continue
+		}
+		return r
+	}
+	return f.rules[last]
+}
@@ -0,0 +1,90 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func queryLogFilterTxn(client, name string, qtype uint16, rcode int) (context.Context, *dns.Msg) {
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, name)
+	q.Question[0].Qtype = qtype
+	recordQueryLogRequest(ctx, q)
+	r := new(dns.Msg)
+	r.SetRcode(q, rcode)
+	return ctx, r
+}
+
+func TestQueryLogFilter(t *testing.T) {
+	assert := assert.New(t)
+	q := &QueryLoggerPlugin{}
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{
+		"defaultSample": 0.0,
+		"rules": []map[string]interface{}{
+			{"name": "servfail", "rcodes": []string{"servfail"}},
+			{"name": "internal", "domains": []string{"corp.example."}, "sample": 0.0},
+			{"name": "tracked", "regex": `^track\d+\.`, "types": []string{"AAAA"}},
+			{"name": "lan", "clients": []string{"10.0.0.0/8"}, "cacheMiss": true},
+			{"name": "slow", "minLatency": "50ms"},
+			{"name": "noerror", "rcodes": []string{"NOERROR"}, "sample": 0.5},
+		},
+	}))
+
+	match := func(ctx context.Context, r *dns.Msg) string {
+		return q.filter.match(ctx, r).name
+	}
+	ctx, r := queryLogFilterTxn("192.0.2.1", "a.corp.example.", dns.TypeA, dns.RcodeServerFailure)
+	assert.Equal("servfail", match(ctx, r))
+	ctx, r = queryLogFilterTxn("192.0.2.1", "a.CORP.example.", dns.TypeA, dns.RcodeSuccess)
+	assert.Equal("internal", match(ctx, r))
+	assert.False(q.filter.logged(ctx, r))
+	ctx, r = queryLogFilterTxn("192.0.2.1", "Track42.example.", dns.TypeAAAA, dns.RcodeNameError)
+	assert.Equal("tracked", match(ctx, r))
+	ctx, r = queryLogFilterTxn("192.0.2.1", "track42.example.", dns.TypeA, dns.RcodeNameError)
+	assert.Equal("default", match(ctx, r))
+	assert.False(q.filter.logged(ctx, r))
+
+	ctx, r = queryLogFilterTxn("10.1.2.3", "www.example.", dns.TypeA, dns.RcodeNameError)
+	assert.Equal("lan", match(ctx, r))
+	SetServedFromCache(ctx, "hit")
+	assert.Equal("default", match(ctx, r))
+
+	ctx, r = queryLogFilterTxn("192.0.2.1", "www.example.", dns.TypeA, dns.RcodeNameError)
+	QueryMetadata(ctx)[queryLogRequestKey].(*queryLogRequest).start = time.Now().Add(-time.Second)
+	assert.Equal("slow", match(ctx, r))
+
+	// sampled
+	ctx, r = queryLogFilterTxn("192.0.2.1", "www.example.", dns.TypeA, dns.RcodeSuccess)
+	rule := q.filter.match(ctx, r)
+	assert.Equal("noerror", rule.name)
+	logged, suppressed := rule.logged.Get(), rule.suppressed.Get()
+	for i := 0; i < 1000; i++ {
+		q.filter.logged(ctx, r)
+	}
+	assert.Equal(uint64(1000), rule.logged.Get()+rule.suppressed.Get()-logged-suppressed)
+	assert.InDelta(500, int(rule.logged.Get()-logged), 100)
+}
+
+func TestQueryLogFilterConfigure(t *testing.T) {
+	assert := assert.New(t)
+	q := &QueryLoggerPlugin{}
+	for _, rule := range []map[string]interface{}{
+		{"sample": 1.5},
+		{"regex": "("},
+		{"types": []string{"NOPE"}},
+		{"rcodes": []string{"NOPE"}},
+		{"clients": []string{"10.0.0.0/33"}},
+	} {
+		assert.Error(q.Configure(context.Background(), map[string]interface{}{"rules": []map[string]interface{}{rule}}), rule)
+	}
+	assert.Error(q.Configure(context.Background(), map[string]interface{}{"defaultSample": -1.0}))
+
+	// everything is logged by default
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{}))
+	ctx, r := queryLogFilterTxn("192.0.2.1", "www.example.", dns.TypeA, dns.RcodeSuccess)
+	assert.True(q.filter.logged(ctx, r))
+}
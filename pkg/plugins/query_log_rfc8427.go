@@ -0,0 +1,246 @@
+package plugins
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 8427 JSON encoding of the messages, appended by hand to a pooled buffer
+// rather than built with maps and encoding/json.
+
+// ednsOptionNames are the EDNS option codes decoded by name.
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0LLQ:          "LLQ",
+	dns.EDNS0UL:           "UL",
+	dns.EDNS0NSID:         "NSID",
+	dns.EDNS0DAU:          "DAU",
+	dns.EDNS0DHU:          "DHU",
+	dns.EDNS0N3U:          "N3U",
+	dns.EDNS0SUBNET:       "CLIENT-SUBNET",
+	dns.EDNS0EXPIRE:       "EXPIRE",
+	dns.EDNS0COOKIE:       "COOKIE",
+	dns.EDNS0TCPKEEPALIVE: "TCP-KEEPALIVE",
+	dns.EDNS0PADDING:      "PADDING",
+	dns.EDNS0EDE:          "EXTENDED-DNS-ERROR",
+}
+
+// appendRfc8427Pair appends the paired query and response object, the query is
+// left out when nil.
+func appendRfc8427Pair(b []byte, ctx context.Context, query *dns.Msg, queryTime time.Time, resp *dns.Msg, now time.Time, octetsHex bool) []byte {
+	proto, src := remoteAddr(ctx)
+	b = append(b, `{"src":`...)
+	b = appendJSONString(b, src)
+	b = append(b, `,"proto":`...)
+	b = appendJSONString(b, proto)
+	if query != nil {
+		b = append(b, `,"queryMessage":`...)
+		b = appendRfc8427Message(b, query, queryTime, octetsHex)
+	}
+	b = append(b, `,"responseMessage":`...)
+	b = appendRfc8427Message(b, resp, now, octetsHex)
+	return append(b, '}')
+}
+
+// appendRfc8427Message appends the message object, with the time it was received
+// or sent and the wire format as messageOctetsHEX when octetsHex is set.
+func appendRfc8427Message(b []byte, msg *dns.Msg, at time.Time, octetsHex bool) []byte {
+	b = append(b, `{"dateString":"`...)
+	b = at.UTC().AppendFormat(b, time.RFC3339Nano)
+	b = append(b, `","dateSeconds":`...)
+	b = strconv.AppendFloat(b, float64(at.UnixMicro())/1e6, 'f', -1, 64)
+	b = appendJSONInt(b, "ID", int(msg.Id))
+	b = appendJSONBit(b, "QR", msg.Response)
+	b = appendJSONInt(b, "Opcode", msg.Opcode)
+	b = appendJSONBit(b, "AA", msg.Authoritative)
+	b = appendJSONBit(b, "TC", msg.Truncated)
+	b = appendJSONBit(b, "RD", msg.RecursionDesired)
+	b = appendJSONBit(b, "RA", msg.RecursionAvailable)
+	b = appendJSONBit(b, "AD", msg.AuthenticatedData)
+	b = appendJSONBit(b, "CD", msg.CheckingDisabled)
+	b = appendJSONInt(b, "RCODE", msg.Rcode)
+	b = appendJSONInt(b, "QDCOUNT", len(msg.Question))
+	b = appendJSONInt(b, "ANCOUNT", len(msg.Answer))
+	b = appendJSONInt(b, "NSCOUNT", len(msg.Ns))
+	b = appendJSONInt(b, "ARCOUNT", len(msg.Extra))
+	switch len(msg.Question) {
+	case 0:
+	case 1:
+		b = append(b, ',')
+		b = appendRfc8427Question(b, &msg.Question[0], "Q")
+	default:
+		b = append(b, `,"questionRRs":[`...)
+		for i := range msg.Question {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, '{')
+			b = appendRfc8427Question(b, &msg.Question[i], "")
+			b = append(b, '}')
+		}
+		b = append(b, ']')
+	}
+	b = appendRfc8427RRs(b, "answerRRs", msg.Answer)
+	b = appendRfc8427RRs(b, "authorityRRs", msg.Ns)
+	b = appendRfc8427RRs(b, "additionalRRs", msg.Extra)
+	if octetsHex {
+		if wire, err := msg.Pack(); err == nil {
+			b = append(b, `,"messageOctetsHEX":"`...)
+			b = hex.AppendEncode(b, wire)
+			b = append(b, '"')
+		}
+	}
+	return append(b, '}')
+}
+
+// appendRfc8427Question appends the NAME, TYPE and CLASS members, prefixed by
+// "Q" in the message object.
+func appendRfc8427Question(b []byte, q *dns.Question, prefix string) []byte {
+	b = append(b, '"')
+	b = append(b, prefix...)
+	b = append(b, `NAME":`...)
+	b = appendJSONString(b, q.Name)
+	b = appendRfc8427TypeClass(b, prefix, q.Qtype, q.Qclass)
+	return b
+}
+
+func appendRfc8427TypeClass(b []byte, prefix string, rrtype, class uint16) []byte {
+	b = appendJSONInt(b, prefix+"TYPE", int(rrtype))
+	b = append(b, `,"`...)
+	b = append(b, prefix...)
+	b = append(b, `TYPEname":`...)
+	b = appendJSONString(b, dns.Type(rrtype).String())
+	b = appendJSONInt(b, prefix+"CLASS", int(class))
+	if rrtype != dns.TypeOPT {
+		b = append(b, `,"`...)
+		b = append(b, prefix...)
+		b = append(b, `CLASSname":`...)
+		b = appendJSONString(b, dns.Class(class).String())
+	}
+	return b
+}
+
+func appendRfc8427RRs(b []byte, name string, rrs []dns.RR) []byte {
+	if len(rrs) == 0 {
+		return b
+	}
+	b = append(b, `,"`...)
+	b = append(b, name...)
+	b = append(b, `":[`...)
+	for i, rr := range rrs {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendRfc8427RR(b, rr)
+	}
+	return append(b, ']')
+}
+
+// appendRfc8427RR appends the RR object, the rdata is rdata<TYPE> in presentation
+// format or RDATAHEX for the unknown types. The OPT pseudo RR has an EDNS member
+// with the decoded options instead.
+func appendRfc8427RR(b []byte, rr dns.RR) []byte {
+	hdr := rr.Header()
+	b = append(b, `{"NAME":`...)
+	b = appendJSONString(b, hdr.Name)
+	b = appendRfc8427TypeClass(b, "", hdr.Rrtype, hdr.Class)
+	b = appendJSONInt(b, "TTL", int(hdr.Ttl))
+	switch rr := rr.(type) {
+	case *dns.OPT:
+		b = appendRfc8427EDNS(b, rr)
+	case *dns.RFC3597:
+		b = append(b, `,"RDATAHEX":`...)
+		b = appendJSONString(b, strings.ToUpper(rr.Rdata))
+	default:
+		b = append(b, `,"rdata`...)
+		b = append(b, dns.Type(hdr.Rrtype).String()...)
+		b = append(b, `":`...)
+		b = appendJSONString(b, strings.TrimPrefix(rr.String(), hdr.String()))
+	}
+	return append(b, '}')
+}
+
+func appendRfc8427EDNS(b []byte, opt *dns.OPT) []byte {
+	b = append(b, `,"EDNS":{"version":`...)
+	b = strconv.AppendUint(b, uint64(opt.Version()), 10)
+	b = appendJSONInt(b, "udpSize", int(opt.UDPSize()))
+	b = appendJSONInt(b, "extendedRCODE", opt.ExtendedRcode())
+	b = appendJSONBit(b, "DO", opt.Do())
+	if len(opt.Option) > 0 {
+		b = append(b, `,"options":[`...)
+		for i, o := range opt.Option {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			code := o.Option()
+			b = append(b, `{"code":`...)
+			b = strconv.AppendUint(b, uint64(code), 10)
+			if name, ok := ednsOptionNames[code]; ok {
+				b = append(b, `,"name":`...)
+				b = appendJSONString(b, name)
+			}
+			b = append(b, `,"value":`...)
+			b = appendJSONString(b, o.String())
+			b = append(b, '}')
+		}
+		b = append(b, ']')
+	}
+	return append(b, '}')
+}
+
+// appendJSONInt appends a ,"name":value member.
+func appendJSONInt(b []byte, name string, v int) []byte {
+	b = append(b, `,"`...)
+	b = append(b, name...)
+	b = append(b, `":`...)
+	return strconv.AppendInt(b, int64(v), 10)
+}
+
+// appendJSONBit appends a ,"name":0|1 member.
+func appendJSONBit(b []byte, name string, v bool) []byte {
+	return appendJSONInt(b, name, int(boolToUint8(v)))
+}
+
+// appendJSONString appends the quoted and escaped string.
+func appendJSONString(b []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' && c < utf8.RuneSelf {
+			i++
+			continue
+		}
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r != utf8.RuneError || size != 1 {
+				i += size
+				continue
+			}
+		}
+		b = append(b, s[start:i]...)
+		switch c {
+		case '"', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\t':
+			b = append(b, '\\', 't')
+		case '\r':
+			b = append(b, '\\', 'r')
+		default:
+			// control characters and invalid utf-8
+			b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+		}
+		i++
+		start = i
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
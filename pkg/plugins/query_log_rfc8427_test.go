@@ -0,0 +1,142 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func rfc8427TestExchange() (context.Context, *dns.Msg, *dns.Msg) {
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, "example.com.")
+	q.SetEdns0(1232, true)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	r := new(dns.Msg)
+	r.SetReply(q)
+	a, _ := dns.NewRR("example.com. 300 IN A 192.0.2.10")
+	txt, _ := dns.NewRR(`example.com. 60 IN TXT "quoted \"text\""`)
+	soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 2 3 4 5")
+	r.Answer = []dns.RR{a, txt, &dns.RFC3597{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: 65280, Class: dns.ClassINET, Ttl: 10}, Rdata: "abcd"}}
+	r.Ns = []dns.RR{soa}
+	return ctx, q, r
+}
+
+func TestRfc8427Message(t *testing.T) {
+	assert := assert.New(t)
+	ctx, q, r := rfc8427TestExchange()
+	now := time.Date(2024, 5, 6, 7, 8, 9, 500000000, time.UTC)
+	line := appendRfc8427Pair(nil, ctx, q, now, r, now, true)
+
+	var pair struct {
+		Src             string                 `json:"src"`
+		Proto           string                 `json:"proto"`
+		QueryMessage    map[string]interface{} `json:"queryMessage"`
+		ResponseMessage map[string]interface{} `json:"responseMessage"`
+	}
+	if !assert.NoError(json.Unmarshal(line, &pair), string(line)) {
+		return
+	}
+	assert.Equal("192.0.2.1:5353", pair.Src)
+	assert.Equal("udp", pair.Proto)
+
+	qm := pair.QueryMessage
+	assert.Equal("2024-05-06T07:08:09.5Z", qm["dateString"])
+	assert.Equal(1714979289.5, qm["dateSeconds"])
+	assert.Equal(float64(q.Id), qm["ID"])
+	assert.Equal(float64(0), qm["QR"])
+	assert.Equal(float64(1), qm["RD"])
+	assert.Equal("example.com.", qm["QNAME"])
+	assert.Equal("A", qm["QTYPEname"])
+	assert.Equal("IN", qm["QCLASSname"])
+	wire, _ := q.Pack()
+	assert.Equal(hex.EncodeToString(wire), qm["messageOctetsHEX"])
+	additional := qm["additionalRRs"].([]interface{})
+	edns := additional[0].(map[string]interface{})["EDNS"].(map[string]interface{})
+	assert.Equal(float64(1232), edns["udpSize"])
+	assert.Equal(float64(1), edns["DO"])
+	options := edns["options"].([]interface{})
+	assert.Equal(map[string]interface{}{"code": float64(10), "name": "COOKIE", "value": "0102030405060708"}, options[0])
+	assert.Equal("CLIENT-SUBNET", options[1].(map[string]interface{})["name"])
+	assert.Equal("192.0.2.0/24/0", options[1].(map[string]interface{})["value"])
+
+	rm := pair.ResponseMessage
+	assert.Equal(float64(1), rm["QR"])
+	assert.Equal(float64(3), rm["ANCOUNT"])
+	answers := rm["answerRRs"].([]interface{})
+	assert.Equal(map[string]interface{}{"NAME": "example.com.", "TYPE": float64(1), "TYPEname": "A", "CLASS": float64(1),
+		"CLASSname": "IN", "TTL": float64(300), "rdataA": "192.0.2.10"}, answers[0])
+	assert.Equal(`"quoted \"text\""`, answers[1].(map[string]interface{})["rdataTXT"])
+	assert.Equal("ABCD", answers[2].(map[string]interface{})["RDATAHEX"])
+	assert.Equal("TYPE65280", answers[2].(map[string]interface{})["TYPEname"])
+	soa := rm["authorityRRs"].([]interface{})[0].(map[string]interface{})
+	assert.Equal("ns.example.com. admin.example.com. 1 2 3 4 5", soa["rdataSOA"])
+	wire, _ = r.Pack()
+	assert.Equal(hex.EncodeToString(wire), rm["messageOctetsHEX"])
+}
+
+func TestAppendJSONString(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []string{"", "plain", `a"b\c`, "tab\tnl\ncr\r", "\x00\x1f", "héllo", "bad\xffutf8"} {
+		var decoded string
+		b := appendJSONString(nil, s)
+		assert.NoError(json.Unmarshal(b, &decoded), string(b))
+		if s != "bad\xffutf8" {
+			assert.Equal(s, decoded)
+		}
+	}
+}
+
+func TestQueryLoggerRfc8427File(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "queries.jsonl")
+	q := &QueryLoggerPlugin{}
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{"format": "rfc8427", "output": path}))
+	assert.NoError(q.StartClient(context.Background(), nil))
+
+	ctx, query, resp := rfc8427TestExchange()
+	assert.NoError(q.Query(ctx, query))
+	assert.NoError(q.Response(ctx, resp))
+	// refused before the query was logged
+	ctx, query, resp = rfc8427TestExchange()
+	resp.Rcode = dns.RcodeRefused
+	assert.NoError(q.Response(ctx, resp))
+	assert.NoError(q.StopClient(context.Background()))
+
+	f, err := os.Open(path)
+	assert.NoError(err)
+	defer f.Close()
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		assert.NoError(json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	if assert.Len(lines, 2) {
+		assert.Contains(lines[0], "queryMessage")
+		assert.Contains(lines[0], "responseMessage")
+		assert.NotContains(lines[1], "queryMessage")
+		assert.Equal(float64(dns.RcodeRefused), lines[1]["responseMessage"].(map[string]interface{})["RCODE"])
+	}
+}
+
+func BenchmarkRfc8427(b *testing.B) {
+	ctx, q, r := rfc8427TestExchange()
+	line := make([]byte, 0, 4096)
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		line = appendRfc8427Pair(line[:0], ctx, q, now, r, now, false)
+	}
+}
@@ -0,0 +1,139 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// queryLogEntry is a logged transaction, line is reused once written.
+type queryLogEntry struct {
+	at   time.Time
+	ctx  context.Context
+	resp *dns.Msg
+	line []byte
+}
+
+// queryLogSink is where the query logger writes the entries.
+type queryLogSink interface {
+	write(e *queryLogEntry)
+	close() error
+}
+
+const (
+	queryLogOutputLog    = "log"
+	queryLogOutputStdout = "stdout"
+	queryLogOutputStderr = "stderr"
+	queryLogOutputSyslog = "syslog"
+
+	queryLogSyslogPrefix = "syslog+"
+	queryLogSQLitePrefix = "sqlite://"
+	queryLogFilePrefix   = "file://"
+)
+
+var (
+	queryLogWriteErrors = metrics.GetOrCreateCounter(`dns_querylog_write_errors_total`)
+	queryLogDropped     = metrics.GetOrCreateCounter(`dns_querylog_dropped_total`)
+)
+
+func validQueryLogOutput(config QueryLoggerPluginConfig) error {
+	output := config.Output
+	switch {
+	case output == queryLogOutputLog, output == queryLogOutputStdout, output == queryLogOutputStderr:
+		return nil
+	case output == queryLogOutputSyslog, strings.HasPrefix(output, queryLogSyslogPrefix):
+		if _, _, err := parseSyslogOutput(output); err != nil {
+			return err
+		}
+		return validSyslogFacility(config.SyslogFacility)
+	case strings.HasPrefix(output, queryLogSQLitePrefix):
+		if strings.TrimPrefix(output, queryLogSQLitePrefix) == "" || config.SQLiteBufferSize < 1 {
+			return fmt.Errorf("invalid query log output: %v", output)
+		}
+		return nil
+	case strings.TrimPrefix(output, queryLogFilePrefix) == "":
+		return fmt.Errorf("invalid query log output: %v", output)
+	}
+	return nil
+}
+
+// openQueryLogSink opens the output of the configuration, it must be valid.
+func openQueryLogSink(config QueryLoggerPluginConfig) (queryLogSink, error) {
+	output := config.Output
+	switch {
+	case output == queryLogOutputLog:
+		return &appLogSink{}, nil
+	case output == queryLogOutputStdout:
+		return &writerSink{out: os.Stdout}, nil
+	case output == queryLogOutputStderr:
+		return &writerSink{out: os.Stderr}, nil
+	case output == queryLogOutputSyslog, strings.HasPrefix(output, queryLogSyslogPrefix):
+		network, addr, _ := parseSyslogOutput(output)
+		return openSyslogSink(network, addr, config.SyslogFacility, config.SyslogTag)
+	case strings.HasPrefix(output, queryLogSQLitePrefix):
+		return openSQLiteSink(strings.TrimPrefix(output, queryLogSQLitePrefix), config.SQLiteRetention, config.SQLiteBufferSize)
+	}
+	f := &utils.RotatingFile{
+		Path:       strings.TrimPrefix(output, queryLogFilePrefix),
+		MaxSize:    int64(config.FileMaxSize) << 20,
+		MaxBackups: config.FileMaxBackups,
+		Compress:   config.FileCompress,
+	}
+	if err := f.Open(); err != nil {
+		return nil, err
+	}
+	return &writerSink{out: f, closer: f}, nil
+}
+
+// parseSyslogOutput returns the network and address of syslog+udp://host:port,
+// both are empty for the local syslog.
+func parseSyslogOutput(output string) (network, addr string, err error) {
+	if output == queryLogOutputSyslog {
+		return "", "", nil
+	}
+	network, addr, ok := strings.Cut(strings.TrimPrefix(output, queryLogSyslogPrefix), "://")
+	if !ok || addr == "" || (network != protoUDP && network != protoTCP) {
+		return "", "", fmt.Errorf("invalid query log output: %v", output)
+	}
+	return network, addr, nil
+}
+
+// appLogSink writes to the application log.
+type appLogSink struct{}
+
+func (s *appLogSink) write(e *queryLogEntry) {
+	log.Info().Msg(string(e.line))
+}
+
+func (s *appLogSink) close() error {
+	return nil
+}
+
+// writerSink writes the entries as lines.
+type writerSink struct {
+	out    io.Writer
+	closer io.Closer
+}
+
+func (s *writerSink) write(e *queryLogEntry) {
+	e.line = append(e.line, '\n')
+	if _, err := s.out.Write(e.line); err != nil {
+		queryLogWriteErrors.Inc()
+		log.Debug().Err(err).Msg("query log write failed")
+	}
+}
+
+func (s *writerSink) close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// logTestQuery runs a query and its response through the query logger.
+func logTestQuery(q *QueryLoggerPlugin, client string, name string, rcode int) {
+	ctx, m := aclQuery(&net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, name)
+	q.Query(ctx, m)
+	r := new(dns.Msg)
+	r.SetRcode(m, rcode)
+	q.Response(ctx, r)
+}
+
+func TestQueryLogFileSink(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "queries.log")
+	q := &QueryLoggerPlugin{}
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{"output": "file://" + path, "template": "{remote} {name} {rcode}"}))
+	assert.NoError(q.StartClient(context.Background(), nil))
+	logTestQuery(q, "192.0.2.1", "example.com.", dns.RcodeSuccess)
+	logTestQuery(q, "192.0.2.2", "example.org.", dns.RcodeNameError)
+	assert.NoError(q.StopClient(context.Background()))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("192.0.2.1 example.com. NOERROR\n192.0.2.2 example.org. NXDOMAIN\n", string(data))
+}
+
+func TestQueryLogSQLiteSink(t *testing.T) {
+	assert := assert.New(t)
+	q := &QueryLoggerPlugin{}
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{
+		"output":   "sqlite://" + filepath.Join(t.TempDir(), "queries.db"),
+		"template": "{remote} {name}",
+	}))
+	assert.NoError(q.StartClient(context.Background(), nil))
+	from := time.Now()
+	logTestQuery(q, "192.0.2.1", "Example.COM.", dns.RcodeSuccess)
+	logTestQuery(q, "192.0.2.1", "www.example.com.", dns.RcodeSuccess)
+	logTestQuery(q, "2001:db8::1", "notexample.com.", dns.RcodeNameError)
+	logTestQuery(q, "192.0.2.2", "example.org.", dns.RcodeSuccess)
+
+	admin := &AdminPlugin{}
+	search := func(query string) (int, []queryLogSearchResult) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, queryLogSearchPath+"?"+query, nil))
+		var results []queryLogSearchResult
+		json.Unmarshal(w.Body.Bytes(), &results)
+		return w.Code, results
+	}
+	// the entries are stored in the background
+	assert.Eventually(func() bool {
+		_, results := search("")
+		return len(results) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, results := search("name=example.com")
+	if assert.Len(results, 2) {
+		assert.Equal("example.com.", results[0].Name)
+		assert.Equal("192.0.2.1", results[0].Client)
+		assert.Equal("A", results[0].Type)
+		assert.Equal("NOERROR", results[0].Rcode)
+		assert.Equal("192.0.2.1 Example.COM.", results[0].Entry)
+		assert.Equal("www.example.com.", results[1].Name)
+	}
+	_, results = search("client=2001:db8:0::1")
+	if assert.Len(results, 1) {
+		assert.Equal("NXDOMAIN", results[0].Rcode)
+	}
+	_, results = search("client=192.0.2.1&limit=1&from=" + from.Add(-time.Second).Format(time.RFC3339Nano))
+	assert.Len(results, 1)
+	_, results = search("to=" + from.Add(-time.Second).Format(time.RFC3339))
+	assert.Len(results, 0)
+	code, _ := search("from=yesterday")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _ = search("limit=0")
+	assert.Equal(http.StatusBadRequest, code)
+
+	assert.NoError(q.StopClient(context.Background()))
+	assert.Nil(adminHandler(queryLogSearchPath))
+}
+
+func TestQueryLogSQLiteRetention(t *testing.T) {
+	assert := assert.New(t)
+	sink, err := openSQLiteSink(filepath.Join(t.TempDir(), "queries.db"), time.Hour, 10)
+	assert.NoError(err)
+	s := sink.(*sqliteSink)
+	defer s.close()
+	assert.NoError(s.insert([]*sqliteRow{
+		{time: time.Now().Add(-2 * time.Hour), name: "old."},
+		{time: time.Now(), name: "new."},
+	}))
+	s.purge()
+	var names []string
+	rows, err := s.db.Query(`SELECT name FROM queries`)
+	assert.NoError(err)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		names = append(names, name)
+	}
+	rows.Close()
+	assert.Equal([]string{"new."}, names)
+}
+
+func TestQueryLogSQLiteClose(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "queries.db")
+	q := &QueryLoggerPlugin{}
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{"output": "sqlite://" + path}))
+	assert.NoError(q.StartClient(context.Background(), nil))
+	sink := *q.sink.Load()
+	for i := 0; i < 100; i++ {
+		logTestQuery(q, "192.0.2.1", "example.com.", dns.RcodeSuccess)
+	}
+	// the in flight queries respond while and after the plugin stops
+	assert.NoError(q.StopClient(context.Background()))
+	logTestQuery(q, "192.0.2.1", "example.com.", dns.RcodeSuccess)
+	ctx, m := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, nil, "example.com.")
+	sink.write(&queryLogEntry{at: time.Now(), ctx: ctx, resp: m})
+	assert.NoError(sink.close())
+
+	// the queued entries were stored
+	s, err := openSQLiteSink(path, 0, 10)
+	assert.NoError(err)
+	defer s.close()
+	var count int
+	assert.NoError(s.(*sqliteSink).db.QueryRow(`SELECT count(*) FROM queries`).Scan(&count))
+	assert.Equal(100, count)
+}
@@ -0,0 +1,258 @@
+package plugins
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	queryLogSearchPath = "/querylog/search"
+
+	sqliteBatchSize     = 1000
+	sqlitePurgeInterval = time.Minute
+	sqliteSearchLimit   = 100
+	sqliteSearchMax     = 10000
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS queries (
+	time INTEGER NOT NULL,
+	client TEXT NOT NULL,
+	name TEXT NOT NULL,
+	type TEXT NOT NULL,
+	rcode TEXT NOT NULL,
+	entry TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS queries_time ON queries (time);
+CREATE INDEX IF NOT EXISTS queries_client ON queries (client, time);
+CREATE INDEX IF NOT EXISTS queries_name ON queries (name, time);
+`
+
+// sqliteRow is a stored entry, the rows are inserted in batches by a goroutine.
+type sqliteRow struct {
+	time   time.Time
+	client string
+	name   string
+	typ    string
+	rcode  string
+	entry  string
+}
+
+// sqliteSink stores the entries in a local SQLite database searchable through
+// the admin API, the entries older than the retention are removed. The rows
+// channel is never closed, the queries still in flight may write while closing.
+type sqliteSink struct {
+	db        *sql.DB
+	retention time.Duration
+	rows      chan *sqliteRow
+	done      chan struct{}
+	closed    atomic.Bool
+	wg        sync.WaitGroup
+}
+
+func openSQLiteSink(path string, retention time.Duration, bufferSize int) (queryLogSink, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("query log database %v: %w", path, err)
+	}
+	s := &sqliteSink{db: db, retention: retention, rows: make(chan *sqliteRow, bufferSize), done: make(chan struct{})}
+	s.wg.Add(1)
+	go s.run()
+	registerAdminHandler(queryLogSearchPath, s)
+	return s, nil
+}
+
+// write queues the entry without blocking, it is dropped when the buffer is
+// full and ignored once closed.
+func (s *sqliteSink) write(e *queryLogEntry) {
+	if s.closed.Load() {
+		return
+	}
+	q := safeQuestion(e.resp)
+	client, _ := splitRemoteAddr(e.ctx)
+	row := &sqliteRow{
+		time:   e.at,
+		client: client,
+		name:   strings.ToLower(q.Name),
+		typ:    dns.Type(q.Qtype).String(),
+		rcode:  dns.RcodeToString[e.resp.Rcode],
+		entry:  string(e.line),
+	}
+	select {
+	case s.rows <- row:
+	default:
+		queryLogDropped.Inc()
+	}
+}
+
+// close stores the queued entries and closes the database.
+func (s *sqliteSink) close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	registerAdminHandler(queryLogSearchPath, nil)
+	close(s.done)
+	s.wg.Wait()
+	return s.db.Close()
+}
+
+func (s *sqliteSink) run() {
+	defer s.wg.Done()
+	purge := time.NewTicker(sqlitePurgeInterval)
+	defer purge.Stop()
+	s.purge()
+	batch := make([]*sqliteRow, 0, sqliteBatchSize)
+	for {
+		select {
+		case row := <-s.rows:
+			s.insertBatch(append(batch[:0], row))
+		case <-purge.C:
+			s.purge()
+		case <-s.done:
+			// store the queued rows
+			for len(s.rows) > 0 {
+				s.insertBatch(batch[:0])
+			}
+			return
+		}
+	}
+}
+
+// insertBatch fills the batch with the queued rows and inserts it.
+func (s *sqliteSink) insertBatch(batch []*sqliteRow) {
+fill:
+	for len(batch) < sqliteBatchSize {
+		select {
+		case row := <-s.rows:
+			batch = append(batch, row)
+		default:
+			break fill
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.insert(batch); err != nil {
+		queryLogWriteErrors.Add(len(batch))
+		log.Warn().Err(err).Msg("query log database insert failed")
+	}
+}
+
+func (s *sqliteSink) insert(batch []*sqliteRow) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO queries (time, client, name, type, rcode, entry) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		if _, err := stmt.Exec(r.time.UnixNano(), r.client, r.name, r.typ, r.rcode, r.entry); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purge removes the entries older than the retention.
+func (s *sqliteSink) purge() {
+	if s.retention <= 0 {
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM queries WHERE time < ?`, time.Now().Add(-s.retention).UnixNano()); err != nil {
+		log.Warn().Err(err).Msg("query log database purge failed")
+	}
+}
+
+type queryLogSearchResult struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Rcode  string    `json:"rcode"`
+	Entry  string    `json:"entry"`
+}
+
+// ServeHTTP searches the entries by client, name with its subdomains and time
+// range (RFC 3339), the oldest first.
+func (s *sqliteSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	where := []string{"1 = 1"}
+	args := []any{}
+	if client := params.Get("client"); client != "" {
+		if addr, err := netip.ParseAddr(client); err == nil {
+			client = addr.Unmap().String()
+		}
+		where = append(where, "client = ?")
+		args = append(args, client)
+	}
+	if name := params.Get("name"); name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+		where = append(where, "(name = ? OR substr(name, -length(?) - 1) = '.' || ?)")
+		args = append(args, name, name, name)
+	}
+	for _, p := range []struct{ param, cond string }{{"from", "time >= ?"}, {"to", "time <= ?"}} {
+		v := params.Get(p.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %v: %v", p.param, v), http.StatusBadRequest)
+			return
+		}
+		where = append(where, p.cond)
+		args = append(args, t.UnixNano())
+	}
+	limit := sqliteSearchLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > sqliteSearchMax {
+			http.Error(w, fmt.Sprintf("invalid limit: %v", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(r.Context(), `SELECT time, client, name, type, rcode, entry FROM queries WHERE `+
+		strings.Join(where, " AND ")+` ORDER BY time LIMIT ?`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	results := []queryLogSearchResult{}
+	for rows.Next() {
+		var res queryLogSearchResult
+		var at int64
+		if err := rows.Scan(&at, &res.Client, &res.Name, &res.Type, &res.Rcode, &res.Entry); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Time = time.Unix(0, at).UTC()
+		results = append(results, res)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, results)
+}
@@ -0,0 +1,66 @@
+//go:build !windows && !plan9
+
+package plugins
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	log "github.com/rs/zerolog/log"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func validSyslogFacility(facility string) error {
+	if _, ok := syslogFacilities[strings.ToLower(facility)]; !ok {
+		return fmt.Errorf("invalid syslog facility: %v", facility)
+	}
+	return nil
+}
+
+// syslogSink sends the entries to the local syslog or a remote one, the
+// connection is reopened by the writer after an error.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func openSyslogSink(network, addr, facility, tag string) (queryLogSink, error) {
+	writer, err := syslog.Dial(network, addr, syslogFacilities[strings.ToLower(facility)]|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(e *queryLogEntry) {
+	if err := s.writer.Info(string(e.line)); err != nil {
+		queryLogWriteErrors.Inc()
+		log.Debug().Err(err).Msg("query log syslog write failed")
+	}
+}
+
+func (s *syslogSink) close() error {
+	return s.writer.Close()
+}
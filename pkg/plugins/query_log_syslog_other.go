@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package plugins
+
+import "errors"
+
+var errSyslogUnsupported = errors.New("syslog query log output isn't supported on this platform")
+
+func validSyslogFacility(facility string) error {
+	return errSyslogUnsupported
+}
+
+func openSyslogSink(network, addr, facility, tag string) (queryLogSink, error) {
+	return nil, errSyslogUnsupported
+}
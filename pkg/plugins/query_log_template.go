@@ -0,0 +1,182 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLogCommonFormat is the CoreDNS common log format.
+const queryLogCommonFormat = `{remote}:{port} - {>id} "{type} {class} {name} {proto} {size} {>do} {>bufsize}" {rcode} {>rflags} {rsize} {duration}`
+
+const queryLogRequestKey = "queryLogRequest"
+
+// queryLogRequest keeps what's logged of the query until the response.
+type queryLogRequest struct {
+	start   time.Time
+	size    int
+	do      bool
+	bufsize uint16
+	query   *dns.Msg // kept for the rfc8427 format
+}
+
+func recordQueryLogRequest(ctx context.Context, msg *dns.Msg) *queryLogRequest {
+	r := &queryLogRequest{start: time.Now(), size: msg.Len(), bufsize: dns.MinMsgSize}
+	if opt := msg.IsEdns0(); opt != nil {
+		r.do, r.bufsize = opt.Do(), opt.UDPSize()
+	}
+	QueryMetadata(ctx)[queryLogRequestKey] = r
+	return r
+}
+
+// queryLogTxn is a query with its response.
+type queryLogTxn struct {
+	ctx  context.Context
+	req  *queryLogRequest // nil when answered before the query was logged
+	resp *dns.Msg
+}
+
+// queryLogField appends the value of a placeholder.
+type queryLogField func(b []byte, t *queryLogTxn) []byte
+
+// queryLogTemplate is a parsed template, the literal text is a field too.
+type queryLogTemplate []queryLogField
+
+var queryLogFields = map[string]queryLogField{
+	"remote": func(b []byte, t *queryLogTxn) []byte {
+		host, _ := splitRemoteAddr(t.ctx)
+		return append(b, host...)
+	},
+	"port": func(b []byte, t *queryLogTxn) []byte {
+		_, port := splitRemoteAddr(t.ctx)
+		return append(b, port...)
+	},
+	"local": func(b []byte, t *queryLogTxn) []byte {
+		_, addr := localAddr(t.ctx)
+		return append(b, addr...)
+	},
+	"proto": func(b []byte, t *queryLogTxn) []byte {
+		proto, _ := remoteAddr(t.ctx)
+		return append(b, proto...)
+	},
+	">id": func(b []byte, t *queryLogTxn) []byte {
+		return strconv.AppendUint(b, uint64(t.resp.Id), 10)
+	},
+	"type": func(b []byte, t *queryLogTxn) []byte {
+		return append(b, dns.Type(safeQuestion(t.resp).Qtype).String()...)
+	},
+	"class": func(b []byte, t *queryLogTxn) []byte {
+		return append(b, dns.Class(safeQuestion(t.resp).Qclass).String()...)
+	},
+	"name": func(b []byte, t *queryLogTxn) []byte {
+		return append(b, safeQuestion(t.resp).Name...)
+	},
+	"size": func(b []byte, t *queryLogTxn) []byte {
+		if t.req == nil {
+			return append(b, emptyValue...)
+		}
+		return strconv.AppendInt(b, int64(t.req.size), 10)
+	},
+	">do": func(b []byte, t *queryLogTxn) []byte {
+		if t.req == nil {
+			return append(b, emptyValue...)
+		}
+		return strconv.AppendBool(b, t.req.do)
+	},
+	">bufsize": func(b []byte, t *queryLogTxn) []byte {
+		if t.req == nil {
+			return append(b, emptyValue...)
+		}
+		return strconv.AppendUint(b, uint64(t.req.bufsize), 10)
+	},
+	"rcode": func(b []byte, t *queryLogTxn) []byte {
+		if rcode, ok := dns.RcodeToString[t.resp.Rcode]; ok {
+			return append(b, rcode...)
+		}
+		return strconv.AppendInt(b, int64(t.resp.Rcode), 10)
+	},
+	">rflags": func(b []byte, t *queryLogTxn) []byte {
+		return append(b, flagsAsLetters(t.resp)...)
+	},
+	"rsize": func(b []byte, t *queryLogTxn) []byte {
+		return strconv.AppendInt(b, int64(t.resp.Len()), 10)
+	},
+	"duration": func(b []byte, t *queryLogTxn) []byte {
+		if t.req == nil {
+			return append(b, emptyValue...)
+		}
+		return append(strconv.AppendFloat(b, time.Since(t.req.start).Seconds(), 'f', -1, 64), 's')
+	},
+	"cached": func(b []byte, t *queryLogTxn) []byte {
+		if from := ServedFromCache(t.ctx); from != "" {
+			return append(b, from...)
+		}
+		return append(b, emptyValue...)
+	},
+	"upstream": func(b []byte, t *queryLogTxn) []byte {
+		if up := Upstream(t.ctx); up != "" {
+			return append(b, up...)
+		}
+		return append(b, emptyValue...)
+	},
+}
+
+// parseQueryLogTemplate parses the {placeholder} of the template, {common}
+// expands to the CoreDNS common log format.
+func parseQueryLogTemplate(template string) (queryLogTemplate, error) {
+	template = strings.ReplaceAll(template, "{common}", queryLogCommonFormat)
+	t := queryLogTemplate{}
+	for template != "" {
+		open := strings.IndexByte(template, '{')
+		if open < 0 {
+			t = append(t, queryLogLiteral(template))
+			break
+		}
+		if open > 0 {
+			t = append(t, queryLogLiteral(template[:open]))
+		}
+		end := strings.IndexByte(template[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated query log placeholder: %v", template[open:])
+		}
+		name := template[open+1 : open+end]
+		field, ok := queryLogFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown query log placeholder: {%v}", name)
+		}
+		t = append(t, field)
+		template = template[open+end+1:]
+	}
+	return t, nil
+}
+
+func queryLogLiteral(s string) queryLogField {
+	return func(b []byte, _ *queryLogTxn) []byte {
+		return append(b, s...)
+	}
+}
+
+// format appends the log line of the response to the query of the context.
+func (t queryLogTemplate) format(b []byte, ctx context.Context, resp *dns.Msg) []byte {
+	txn := &queryLogTxn{ctx: ctx, resp: resp}
+	txn.req, _ = QueryMetadata(ctx)[queryLogRequestKey].(*queryLogRequest)
+	for _, field := range t {
+		b = field(b, txn)
+	}
+	return b
+}
+
+// splitRemoteAddr returns the client address and port, the unix peers have no port.
+func splitRemoteAddr(ctx context.Context) (host, port string) {
+	_, addr := remoteAddr(ctx)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, emptyValue
+	}
+	return host, port
+}
@@ -5,13 +5,25 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
-	"github.com/rs/zerolog/log"
 )
 
 type QueryLoggerPlugin struct {
-	config QueryLoggerPluginConfig
+	config   QueryLoggerPluginConfig
+	template queryLogTemplate
+	sink     atomic.Pointer[queryLogSink]
+	filter   *queryLogFilter
+}
+
+var queryLogBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 2048)
+		return &buf
+	},
 }
 
 // Register this plugin with the DNS Forwarder.
@@ -29,8 +41,20 @@ func (q *QueryLoggerPlugin) PrintHelp(out io.Writer) {
 }
 
 type QueryLoggerPluginConfig struct {
-	Format     string `toml:"format" comment:"Query logging format (text, rfc8427)" default:"text"`
-	formatType formatType
+	Format           string               `toml:"format" comment:"Query logging format (text, rfc8427)" default:"text"`
+	Template         string               `toml:"template" comment:"Fields of the text format, {common} is the CoreDNS common log format" default:"{common} {cached} {upstream}"`
+	Output           string               `toml:"output" comment:"Query log sink: log, stdout, stderr, a file path, syslog, syslog+udp://host:port, syslog+tcp://host:port or sqlite:///path (default log for text, stdout for rfc8427)"`
+	FileMaxSize      int                  `toml:"fileMaxSizeMB" comment:"Rotate the file at this size in MB, 0 never rotates" default:"100"`
+	FileMaxBackups   int                  `toml:"fileMaxBackups" comment:"Rotated files kept" default:"5"`
+	FileCompress     bool                 `toml:"fileCompress" comment:"Gzip the rotated files"`
+	SyslogFacility   string               `toml:"syslogFacility" comment:"Syslog facility" default:"local0"`
+	SyslogTag        string               `toml:"syslogTag" comment:"Syslog tag" default:"dns-forwarder"`
+	SQLiteRetention  time.Duration        `toml:"sqliteRetention" comment:"Age of the entries removed from the SQLite database, 0 keeps them" default:"168h"`
+	SQLiteBufferSize int                  `toml:"sqliteBufferSize" comment:"Max entries waiting to be stored in SQLite, more are dropped" default:"10000"`
+	MessageOctetsHex bool                 `toml:"messageOctetsHex" comment:"Add the wire format of the messages as messageOctetsHEX in the rfc8427 format"`
+	DefaultSample    float64              `toml:"defaultSample" comment:"Fraction of the transactions logged when no rule matches, from 0 to 1" default:"1"`
+	Rules            []QueryLogRuleConfig `toml:"rules" comment:"Rules selecting the transactions logged, the first match wins"`
+	formatType       formatType
 }
 
 type formatType int
@@ -63,131 +87,96 @@ func toFormatType(s string) formatType {
 
 // Configure the plugin.
 func (q *QueryLoggerPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	q.config = QueryLoggerPluginConfig{}
 	if err := UnmarshalConfiguration(config, &q.config); err != nil {
 		return err
 	}
 	q.config.formatType = toFormatType(q.config.Format)
-	return nil
+	template, err := parseQueryLogTemplate(q.config.Template)
+	if err != nil {
+		return err
+	}
+	q.template = template
+	filter, err := newQueryLogFilter(q.config.Rules, q.config.DefaultSample)
+	if err != nil {
+		return err
+	}
+	q.filter = filter
+	if q.config.Output == "" {
+		q.config.Output = queryLogOutputLog
+		if q.config.formatType == formatRfc8427 {
+			q.config.Output = queryLogOutputStdout
+		}
+	}
+	return validQueryLogOutput(q.config)
 }
 
-const emptyValue = "-"
-
-/* Following: RFC 8427
-"queryMessage": { "ID": 32784, "QR": 0, "Opcode": 0, "AA": 0,
-                      "TC": 0, "RD": 0, "RA": 0, "AD": 0, "CD": 0,
-                      "RCODE": 0, "QDCOUNT": 1, "ANCOUNT": 0,
-                      "NSCOUNT": 0, "ARCOUNT": 0,
-                      "QNAME": "example.com.",
-                      "QTYPE": 1, "QCLASS": 1 },
-*/
-
-func (q *QueryLoggerPlugin) Query(ctx context.Context, msg *dns.Msg) error {
-	switch q.config.formatType {
-	case formatRfc8427:
-		return LogRfc8427Style(ctx, msg)
-	case formatText:
-		return LogTextStyle(ctx, msg)
-	default:
-		return nil
+// Start the protocol plugin.
+func (q *QueryLoggerPlugin) StartClient(ctx context.Context, handler Handler) error {
+	sink, err := openQueryLogSink(q.config)
+	if err != nil {
+		return err
 	}
+	q.sink.Store(&sink)
+	return nil
 }
 
-func (q *QueryLoggerPlugin) Response(ctx context.Context, msg *dns.Msg) error {
-	switch q.config.formatType {
-	case formatRfc8427:
-		return LogRfc8427Style(ctx, msg)
-	case formatText:
-		return LogTextStyle(ctx, msg)
-	default:
+// Stop the protocol plugin.
+func (q *QueryLoggerPlugin) StopClient(ctx context.Context) error {
+	sink := q.sink.Swap(nil)
+	if sink == nil {
 		return nil
 	}
+	return (*sink).close()
 }
 
-func LogRfc8427Style(ctx context.Context, msg *dns.Msg) error {
-	return LogRfc8427StyleWithPrefix("", "", ctx, msg)
-}
-
-func LogMsgWithPrefix(prefixKey, prefixVal string, ctx context.Context, msg *dns.Msg) error {
-	return LogRfc8427StyleWithPrefix("", "", ctx, msg)
-}
-
-// This version is significantly slower (~6x) than the text-based version
-func LogRfc8427StyleWithPrefix(prefixKey, prefixVal string, ctx context.Context, msg *dns.Msg) error {
-	question := safeQuestion(msg)
-	proto, srcIp := remoteAddr(ctx)
-	opt := msg.IsEdns0()
+const emptyValue = "-"
 
-	logInfo := log.Info().
-		Str("src", srcIp).
-		Str("proto", proto).
-		Uint16("ID", msg.MsgHdr.Id).
-		Uint8("QR", boolToUint8(msg.MsgHdr.Response)).
-		Int("Opcode", msg.MsgHdr.Opcode).
-		Uint8("AA", boolToUint8(msg.MsgHdr.Authoritative)).
-		Uint8("TC", boolToUint8(msg.MsgHdr.Truncated)).
-		Uint8("RD", boolToUint8(msg.MsgHdr.RecursionDesired)).
-		Uint8("RA", boolToUint8(msg.MsgHdr.RecursionAvailable)).
-		Uint8("AD", boolToUint8(msg.MsgHdr.AuthenticatedData)).
-		Uint8("CD", boolToUint8(msg.MsgHdr.CheckingDisabled)).
-		Uint8("DO", boolToUint8(opt != nil && opt.Do())).
-		Int("RCODE", msg.MsgHdr.Rcode).
-		Int("QDCOUNT", len(msg.Question)).
-		Int("ANCOUNT", len(msg.Answer)).
-		Int("NSCOUNT", len(msg.Ns)).
-		Int("ARCOUNT", len(msg.Extra)).
-		Str("QNAME", question.Name).
-		Uint16("QTYPE", question.Qtype).
-		Str("QTYPEname", dns.Type(question.Qtype).String()).
-		Uint16("QCLASS", question.Qclass).
-		Str("QCLASSname", dns.Class(question.Qclass).String())
-
-	if prefixKey != "" && prefixVal != "" {
-		logInfo = logInfo.Str(prefixKey, prefixVal)
-	}
-
-	if msg.MsgHdr.Response {
-		logInfo.Msg("responseMessage")
-		return nil
+func (q *QueryLoggerPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	req := recordQueryLogRequest(ctx, msg)
+	if q.config.formatType == formatRfc8427 {
+		// encoded with the response, only when it's logged
+		req.query = msg
 	}
-
-	logInfo.Msg("queryMessage")
 	return nil
 }
 
-// Similar to CoreDNS Format:
-// 	CommonLogFormat = `{remote}:{port} ` + replacer.EmptyValue + ` {>id} "{type} {class} {name} {proto} {size} {>do} {>bufsize}" {rcode} {>rflags} {rsize} {duration}`
-// [1553775695] unbound[32655:0] info: 127.0.0.1 clients4.google.com. A IN
-
-func LogTextStyle(ctx context.Context, msg *dns.Msg) error {
-	question := safeQuestion(msg)
-	qname := question.Name
-	qtype := dns.Type(question.Qtype).String()
-	qclass := dns.Class(question.Qclass).String()
-	proto, addr := remoteAddr(ctx)
-	rcode := dns.RcodeToString[msg.MsgHdr.Rcode]
-
-	if msg.MsgHdr.Response {
-		log.Info().Msgf("response: %s %s %d %s %s %s %s %s",
-			addr, proto, msg.MsgHdr.Id, qname, qclass, qtype, rcode, flagsAsLetters(msg))
+func (q *QueryLoggerPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	sink := q.sink.Load()
+	if sink == nil || !q.filter.logged(ctx, msg) {
 		return nil
 	}
-
-	log.Info().Msgf("query: %s %s %d %s %s %s %s %s",
-		addr, proto, msg.MsgHdr.Id, qname, qclass, qtype, rcode, flagsAsLetters(msg))
+	now := time.Now()
+	buf := queryLogBufferPool.Get().(*[]byte)
+	defer queryLogBufferPool.Put(buf)
+	switch q.config.formatType {
+	case formatRfc8427:
+		var query *dns.Msg
+		var queryTime time.Time
+		if req, ok := QueryMetadata(ctx)[queryLogRequestKey].(*queryLogRequest); ok {
+			query, queryTime = req.query, req.start
+		}
+		*buf = appendRfc8427Pair((*buf)[:0], ctx, query, queryTime, msg, now, q.config.MessageOctetsHex)
+	default:
+		*buf = q.template.format((*buf)[:0], ctx, msg)
+	}
+	(*sink).write(&queryLogEntry{at: now, ctx: ctx, resp: msg, line: *buf})
 	return nil
 }
 
 func localAddr(ctx context.Context) (proto string, addr string) {
-	return addrInfo(ctx, "LocalAddr")
+	laddr, _ := QueryMetadata(ctx)["LocalAddr"].(net.Addr)
+	return addrInfo(laddr)
 }
+
+// remoteAddr is the client address, anonymized when the anonymizer runs.
 func remoteAddr(ctx context.Context) (proto string, addr string) {
-	return addrInfo(ctx, "RemoteAddr")
+	return addrInfo(clientAddr(ctx))
 }
 
-func addrInfo(ctx context.Context, key string) (proto string, addr string) {
+func addrInfo(laddr net.Addr) (proto string, addr string) {
 	proto = emptyValue
 	addr = emptyValue
-	laddr := QueryMetadata(ctx)[key].(net.Addr)
 	if laddr != nil {
 		proto = laddr.Network()
 		addr = laddr.String()
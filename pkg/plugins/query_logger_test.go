@@ -1,8 +1,13 @@
 package plugins
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
 	"testing"
 
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -49,3 +54,56 @@ func TestBoolToUint8(t *testing.T) {
 	assert.Equal(uint8(0), boolToUint8(false))
 	assert.Equal(uint8(1), boolToUint8(true))
 }
+
+func TestQueryLogTemplate(t *testing.T) {
+	assert := assert.New(t)
+	_, err := parseQueryLogTemplate("{remote} {nope}")
+	assert.Error(err)
+	_, err = parseQueryLogTemplate("{remote")
+	assert.Error(err)
+
+	tmpl, err := parseQueryLogTemplate("{common} {cached} {upstream}")
+	assert.NoError(err)
+
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}, "example.com.")
+	q.Id = 42
+	q.SetEdns0(1232, true)
+	recordQueryLogRequest(ctx, q)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	SetUpstream(ctx, "198.51.100.1:53")
+
+	line := string(tmpl.format(nil, ctx, r))
+	prefix := fmt.Sprintf(`192.0.2.1:5353 - 42 "A IN example.com. udp %d true 1232" NOERROR rd,ra %d `, q.Len(), r.Len())
+	assert.True(strings.HasPrefix(line, prefix), line)
+	assert.Regexp(`\d+(\.\d+)?s - 198\.51\.100\.1:53$`, line)
+
+	// answered from the cache before the query was logged
+	ctx, q = aclQuery(&utils.UnixPeerAddr{Net: "unix", PID: 7}, nil, "example.org.")
+	r = new(dns.Msg)
+	r.SetRcode(q, dns.RcodeRefused)
+	SetServedFromCache(ctx, "hit")
+	tmpl, _ = parseQueryLogTemplate("{remote} {port} {proto} {size} {rcode} {duration} {cached} {upstream}")
+	assert.Equal("pid=7,uid=0,gid=0 - unix - REFUSED - hit -", string(tmpl.format(nil, ctx, r)))
+}
+
+func TestQueryLoggerConfigure(t *testing.T) {
+	assert := assert.New(t)
+	q := &QueryLoggerPlugin{}
+	assert.Error(q.Configure(context.Background(), map[string]interface{}{"template": "{client}"}))
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{}))
+	assert.Equal("{common} {cached} {upstream}", q.config.Template)
+	assert.Equal(formatText, q.config.formatType)
+	assert.Equal(queryLogOutputLog, q.config.Output)
+
+	assert.NoError(q.Configure(context.Background(), map[string]interface{}{"format": "rfc8427"}))
+	assert.Equal(queryLogOutputStdout, q.config.Output)
+	for _, output := range []string{"stderr", "/var/log/queries.log", "sqlite:///var/lib/queries.db", "syslog+udp://127.0.0.1:514"} {
+		assert.NoError(q.Configure(context.Background(), map[string]interface{}{"output": output}), output)
+	}
+	for _, output := range []string{"file://", "sqlite://", "syslog+http://127.0.0.1", "syslog+tcp://"} {
+		assert.Error(q.Configure(context.Background(), map[string]interface{}{"output": output}), output)
+	}
+	assert.Error(q.Configure(context.Background(), map[string]interface{}{"output": "syslog", "syslogFacility": "nope"}))
+}
@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/miekg/dns"
+)
+
+// queryQueue is a bounded queue in front of a fixed set of workers. Submitting
+// never blocks, when the queue is full the caller applies the overload action
+// so the servers (and the gnet event loops) shed load instead of stalling.
+// Priority queries are taken by the workers before the others, both share the
+// size bound.
+type queryQueue struct {
+	high, low chan interface{}
+	size      int64
+	queued    atomic.Int64
+	done      chan struct{}
+	wg        sync.WaitGroup
+	depth     *metrics.Gauge
+	busy      *metrics.Gauge
+}
+
+func newQueryQueue(name string, workers, size int, job func(interface{})) *queryQueue {
+	q := &queryQueue{
+		high:  make(chan interface{}, size),
+		low:   make(chan interface{}, size),
+		size:  int64(size),
+		done:  make(chan struct{}),
+		depth: metrics.GetOrCreateGauge(fmt.Sprintf(`dns_query_queue_depth{queue=%q}`, name), nil),
+		busy:  metrics.GetOrCreateGauge(fmt.Sprintf(`dns_query_queue_busy_workers{queue=%q}`, name), nil),
+	}
+	workers = max(workers, 1)
+	q.depth.Set(0)
+	q.busy.Set(0)
+	metrics.GetOrCreateGauge(fmt.Sprintf(`dns_query_queue_workers{queue=%q}`, name), nil).Set(float64(workers))
+	metrics.GetOrCreateGauge(fmt.Sprintf(`dns_query_queue_capacity{queue=%q}`, name), nil).Set(float64(size))
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work(job)
+	}
+	return q
+}
+
+func (q *queryQueue) work(job func(interface{})) {
+	defer q.wg.Done()
+	for {
+		// drain the priority queries first
+		select {
+		case item := <-q.high:
+			q.run(job, item)
+			continue
+		default:
+		}
+		select {
+		case item := <-q.high:
+			q.run(job, item)
+		case item := <-q.low:
+			q.run(job, item)
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *queryQueue) run(job func(interface{}), item interface{}) {
+	q.queued.Add(-1)
+	q.depth.Dec()
+	q.busy.Inc()
+	defer q.busy.Dec()
+	job(item)
+}
+
+// submit queues the item, false is returned when the queue is full.
+func (q *queryQueue) submit(item interface{}, priority bool) bool {
+	if q.queued.Add(1) > q.size {
+		q.queued.Add(-1)
+		return false
+	}
+	queue := q.low
+	if priority {
+		queue = q.high
+	}
+	// each channel holds size items, the shared count keeps it from filling
+	queue <- item
+	q.depth.Inc()
+	return true
+}
+
+// stop the workers, queued queries are abandoned.
+func (q *queryQueue) stop() {
+	if q == nil {
+		return
+	}
+	close(q.done)
+	q.wg.Wait()
+}
+
+// Overload actions for the queries that don't fit in the queue.
+const (
+	overloadRefuse   = "refuse"
+	overloadServfail = "servfail"
+	overloadDrop     = "drop"
+)
+
+func validOverloadAction(action string) error {
+	switch strings.ToLower(action) {
+	case overloadRefuse, overloadServfail, overloadDrop:
+		return nil
+	}
+	return fmt.Errorf("invalid overload action: %v", action)
+}
+
+// shedResponse counts the shed query and returns the response for the overload
+// action, nil when the query is dropped.
+func shedResponse(server string, req *dns.Msg, action string) *dns.Msg {
+	action = strings.ToLower(action)
+	metrics.GetOrCreateCounter(fmt.Sprintf(`dns_queries_shed_total{server=%q,action=%q}`, server, action)).Inc()
+	rcode := dns.RcodeRefused
+	switch action {
+	case overloadDrop:
+		return nil
+	case overloadServfail:
+		rcode = dns.RcodeServerFailure
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	return resp
+}
+
+// cachedQueryProbe reports if a query can be answered from the cache, it is set
+// while the cache plugin runs and lets the servers prioritize the cache hits.
+var (
+	cachedQueryProbeMutex sync.RWMutex
+	cachedQueryProbe      func(*dns.Msg) bool
+)
+
+func setCachedQueryProbe(probe func(*dns.Msg) bool) {
+	cachedQueryProbeMutex.Lock()
+	defer cachedQueryProbeMutex.Unlock()
+	cachedQueryProbe = probe
+}
+
+func isCachedQuery(req *dns.Msg) bool {
+	cachedQueryProbeMutex.RLock()
+	probe := cachedQueryProbe
+	cachedQueryProbeMutex.RUnlock()
+	return probe != nil && req != nil && probe(req)
+}
@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryQueuePriorityAndBounds(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	processed := make(chan int, 10)
+	q := newQueryQueue("test", 1, 3, func(item interface{}) {
+		if item.(int) == 0 {
+			<-release
+		}
+		processed <- item.(int)
+	})
+	defer q.stop()
+
+	// occupy the only worker
+	assert.True(q.submit(0, false))
+	time.Sleep(20 * time.Millisecond)
+
+	assert.True(q.submit(1, false))
+	assert.True(q.submit(2, false))
+	assert.True(q.submit(4, true))
+	assert.False(q.submit(3, false), "queue is full")
+	assert.False(q.submit(5, true), "the priority queries share the bound")
+	assert.Equal(float64(3), q.depth.Get())
+	assert.Equal(float64(1), q.busy.Get())
+
+	close(release)
+	order := []int{}
+	for i := 0; i < 4; i++ {
+		order = append(order, <-processed)
+	}
+	assert.Equal([]int{0, 4, 1, 2}, order)
+	assert.Equal(float64(0), q.depth.Get())
+	assert.Eventually(func() bool { return q.busy.Get() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestShedResponse(t *testing.T) {
+	assert := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	assert.Nil(shedResponse("test", req, "drop"))
+	assert.Equal(dns.RcodeRefused, shedResponse("test", req, "refuse").Rcode)
+	resp := shedResponse("test", req, "SERVFAIL")
+	assert.Equal(dns.RcodeServerFailure, resp.Rcode)
+	assert.Equal(req.Id, resp.Id)
+
+	assert.NoError(validOverloadAction("Drop"))
+	assert.Error(validOverloadAction("queue"))
+}
+
+func TestServersShedWhenOverloaded(t *testing.T) {
+	for _, name := range []string{"dns", "gnetdns"} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			addr := "127.0.0.1:" + freePort(t)
+			config := map[string]interface{}{"listen": addr, "queueSize": 1, "overloadAction": "servfail"}
+			var s ProtocolServerPlugin
+			if name == "dns" {
+				config["workerPoolSize"] = 1
+				s = &DO53ServerPlugin{}
+				assert.NoError(s.Configure(context.Background(), config))
+			} else {
+				config["udpPoolSize"] = 1
+				s = newTestGnetServer(t, config)
+			}
+			release := make(chan struct{})
+			startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+				<-release
+				r := new(dns.Msg)
+				r.SetReply(m)
+				return nil, s.Response(ctx, r)
+			})
+
+			conn, err := net.Dial("udp", addr)
+			assert.NoError(err)
+			defer conn.Close()
+			dc := &dns.Conn{Conn: conn}
+			// one query is processed, one waits in the queue, the rest are shed
+			for id := uint16(1); id <= 4; id++ {
+				m := new(dns.Msg)
+				m.SetQuestion("example.com.", dns.TypeA)
+				m.Id = id
+				assert.NoError(dc.WriteMsg(m))
+				time.Sleep(20 * time.Millisecond)
+			}
+			assert.NoError(dc.SetReadDeadline(time.Now().Add(2 * time.Second)))
+			for i := 0; i < 2; i++ {
+				r, err := dc.ReadMsg()
+				if assert.NoError(err) {
+					assert.Equal(dns.RcodeServerFailure, r.Rcode)
+					assert.Contains([]uint16{3, 4}, r.Id)
+				}
+			}
+			close(release)
+			for i := 0; i < 2; i++ {
+				r, err := dc.ReadMsg()
+				if assert.NoError(err) {
+					assert.Equal(dns.RcodeSuccess, r.Rcode)
+					assert.Contains([]uint16{1, 2}, r.Id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package plugins
+
+import (
+	"encoding/binary"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// Front-line validation of the queries received by the server plugins, only
+// well formed standard queries enter the plugins.
+
+const (
+	headerSize = 12
+
+	flagQR = 1 << 15
+	flagRD = 1 << 8
+)
+
+func countInvalidQuery(reason string) {
+	metrics.GetOrCreateCounter(`dns_invalid_queries_total{reason="` + reason + `"}`).Inc()
+}
+
+// acceptQueryHeader decides on a query by its header, responses are ignored and
+// only the QUERY opcode with a single question is accepted.
+// It is also the MsgAcceptFunc of the miekg/dns servers.
+func acceptQueryHeader(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Bits&flagQR != 0 {
+		countInvalidQuery("response")
+		return dns.MsgIgnore
+	}
+	if opcode := int(dh.Bits>>11) & 0xF; opcode != dns.OpcodeQuery {
+		countInvalidQuery("opcode")
+		return dns.MsgRejectNotImplemented
+	}
+	if dh.Qdcount != 1 {
+		countInvalidQuery("qdcount")
+		return dns.MsgReject
+	}
+	return dns.MsgAccept
+}
+
+// unpackQuery unpacks and validates a raw query. Either the query or the error
+// response to send is returned, both are nil when the packet is dropped.
+func unpackQuery(in []byte) (req *dns.Msg, errResp *dns.Msg) {
+	if len(in) < headerSize {
+		countInvalidQuery("short")
+		return nil, nil
+	}
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(in[0:]),
+		Bits:    binary.BigEndian.Uint16(in[2:]),
+		Qdcount: binary.BigEndian.Uint16(in[4:]),
+		Ancount: binary.BigEndian.Uint16(in[6:]),
+		Nscount: binary.BigEndian.Uint16(in[8:]),
+		Arcount: binary.BigEndian.Uint16(in[10:]),
+	}
+	switch acceptQueryHeader(dh) {
+	case dns.MsgIgnore:
+		return nil, nil
+	case dns.MsgRejectNotImplemented:
+		return nil, headerErrorResponse(dh, dns.RcodeNotImplemented)
+	case dns.MsgReject:
+		return nil, headerErrorResponse(dh, dns.RcodeFormatError)
+	}
+
+	req = new(dns.Msg)
+	if err := req.Unpack(in); err != nil {
+		log.Debug().Err(err).Msg("malformed query")
+		countInvalidQuery("malformed")
+		return nil, headerErrorResponse(dh, dns.RcodeFormatError)
+	}
+	if errResp = checkQuery(req); errResp != nil {
+		return nil, errResp
+	}
+	return req, nil
+}
+
+// checkQuery validates the EDNS of an unpacked query (RFC 6891), returning the
+// error response when the query is rejected.
+func checkQuery(req *dns.Msg) *dns.Msg {
+	opts := 0
+	for _, rr := range req.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			opts++
+		}
+	}
+	if opts > 1 {
+		countInvalidQuery("opt")
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return resp
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Version() != 0 {
+		countInvalidQuery("badvers")
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeBadVers)
+		resp.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		return resp
+	}
+	return nil
+}
+
+// headerErrorResponse is an error response built only from the query header,
+// for queries that can't be unpacked or are rejected before unpacking.
+func headerErrorResponse(dh dns.Header, rcode int) *dns.Msg {
+	req := new(dns.Msg)
+	req.Id = dh.Id
+	req.Opcode = int(dh.Bits>>11) & 0xF
+	req.RecursionDesired = dh.Bits&flagRD != 0
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	return resp
+}
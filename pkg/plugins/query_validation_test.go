@@ -0,0 +1,130 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func packQuery(t *testing.T, modify func(m *dns.Msg)) []byte {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 1234
+	modify(m)
+	buf, err := m.Pack()
+	assert.NoError(t, err)
+	return buf
+}
+
+func TestUnpackQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	req, errResp := unpackQuery(packQuery(t, func(m *dns.Msg) {}))
+	assert.NotNil(req)
+	assert.Nil(errResp)
+
+	// dropped
+	req, errResp = unpackQuery([]byte{1, 2, 3})
+	assert.Nil(req)
+	assert.Nil(errResp)
+	req, errResp = unpackQuery(packQuery(t, func(m *dns.Msg) { m.Response = true }))
+	assert.Nil(req)
+	assert.Nil(errResp)
+
+	tests := []struct {
+		name  string
+		in    []byte
+		rcode int
+	}{
+		{"notify", packQuery(t, func(m *dns.Msg) { m.Opcode = dns.OpcodeNotify }), dns.RcodeNotImplemented},
+		{"update", packQuery(t, func(m *dns.Msg) { m.Opcode = dns.OpcodeUpdate }), dns.RcodeNotImplemented},
+		{"no question", packQuery(t, func(m *dns.Msg) { m.Question = nil }), dns.RcodeFormatError},
+		{"two questions", packQuery(t, func(m *dns.Msg) { m.Question = append(m.Question, m.Question[0]) }), dns.RcodeFormatError},
+		{"truncated body", packQuery(t, func(m *dns.Msg) {})[:20], dns.RcodeFormatError},
+		{"two opt", packQuery(t, func(m *dns.Msg) {
+			m.SetEdns0(1232, false)
+			m.Extra = append(m.Extra, m.Extra[0])
+		}), dns.RcodeFormatError},
+		{"edns version", packQuery(t, func(m *dns.Msg) {
+			m.SetEdns0(1232, false)
+			m.IsEdns0().SetVersion(1)
+		}), dns.RcodeBadVers},
+	}
+	for _, tt := range tests {
+		req, errResp := unpackQuery(tt.in)
+		assert.Nil(req, tt.name)
+		if assert.NotNil(errResp, tt.name) {
+			assert.Equal(tt.rcode, errResp.Rcode, tt.name)
+			assert.Equal(uint16(1234), errResp.Id, tt.name)
+			assert.True(errResp.Response, tt.name)
+			_, err := errResp.Pack()
+			assert.NoError(err, tt.name)
+		}
+	}
+}
+
+func TestServersRejectInvalidQueries(t *testing.T) {
+	for _, name := range []string{"dns", "gnetdns"} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			addr := "127.0.0.1:" + freePort(t)
+			var s ProtocolServerPlugin
+			if name == "dns" {
+				s = &DO53ServerPlugin{}
+				assert.NoError(s.Configure(context.Background(), map[string]interface{}{"listen": addr}))
+			} else {
+				s = newTestGnetServer(t, map[string]interface{}{"listen": addr})
+			}
+			handled := atomic.Int32{}
+			startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+				handled.Add(1)
+				r := new(dns.Msg)
+				r.SetReply(m)
+				return nil, s.Response(ctx, r)
+			})
+
+			conn, err := net.Dial("udp", addr)
+			assert.NoError(err)
+			defer conn.Close()
+			exchange := func(in []byte) *dns.Msg {
+				_, err := conn.Write(in)
+				assert.NoError(err)
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				buf := make([]byte, 1232)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return nil
+				}
+				r := new(dns.Msg)
+				assert.NoError(r.Unpack(buf[:n]))
+				return r
+			}
+
+			assert.Nil(exchange(packQuery(t, func(m *dns.Msg) { m.Response = true })))
+			if r := exchange(packQuery(t, func(m *dns.Msg) { m.Opcode = dns.OpcodeNotify })); assert.NotNil(r) {
+				assert.Equal(dns.RcodeNotImplemented, r.Rcode)
+			}
+			if r := exchange(packQuery(t, func(m *dns.Msg) { m.Question = nil })); assert.NotNil(r) {
+				assert.Equal(dns.RcodeFormatError, r.Rcode)
+			}
+			if r := exchange(packQuery(t, func(m *dns.Msg) {})[:20]); assert.NotNil(r) {
+				assert.Equal(dns.RcodeFormatError, r.Rcode)
+			}
+			if r := exchange(packQuery(t, func(m *dns.Msg) {
+				m.SetEdns0(1232, false)
+				m.IsEdns0().SetVersion(1)
+			})); assert.NotNil(r) {
+				assert.Equal(dns.RcodeBadVers, r.Rcode)
+			}
+			if r := exchange(packQuery(t, func(m *dns.Msg) {})); assert.NotNil(r) {
+				assert.Equal(dns.RcodeSuccess, r.Rcode)
+			}
+			assert.Equal(int32(1), handled.Load())
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/maypok86/otter"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// RRLPlugin is Response Rate Limiting for udp responses, it limits the responses
+// sent to a client network to keep the forwarder from amplifying spoofed queries.
+// Limited responses are dropped, or every slip'th one is sent truncated so a
+// legitimate client can retry over TCP.
+type RRLPlugin struct {
+	config  RRLPluginConfig
+	buckets otter.Cache[rrlKey, *rrlBucket]
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&RRLPlugin{})
+}
+
+func (r *RRLPlugin) Name() string {
+	return "rrl"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (r *RRLPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(r.Name(), &r.config, out)
+}
+
+type RRLPluginConfig struct {
+	ResponsesPerSecond int           `toml:"responsesPerSecond" comment:"Answers per second per client network (0 is unlimited)" default:"20"`
+	NXDomainsPerSecond int           `toml:"nxdomainsPerSecond" comment:"NXDOMAIN responses per second per client network (0 is unlimited)" default:"10"`
+	ReferralsPerSecond int           `toml:"referralsPerSecond" comment:"Referrals per second per client network (0 is unlimited)" default:"10"`
+	ErrorsPerSecond    int           `toml:"errorsPerSecond" comment:"Error responses per second per client network (0 is unlimited)" default:"10"`
+	Window             time.Duration `toml:"window" comment:"Burst allowance, in seconds of the rate" default:"2s"`
+	IPv4PrefixLen      int           `toml:"ipv4PrefixLength" comment:"Prefix length grouping IPv4 clients" default:"24"`
+	IPv6PrefixLen      int           `toml:"ipv6PrefixLength" comment:"Prefix length grouping IPv6 clients" default:"56"`
+	Slip               int           `toml:"slip" comment:"Send every Nth limited response truncated instead of dropping it (0 always drops)" default:"2"`
+	LogOnly            bool          `toml:"logOnly" comment:"Only log and count the responses that would be limited" default:"false"`
+	MaxTableSize       int           `toml:"maxTableSize" comment:"Max client networks tracked" default:"100000"`
+	Exempt             []string      `toml:"exempt" comment:"Client CIDRs never limited"`
+	exempt             []netip.Prefix
+}
+
+type rrlClass uint8
+
+const (
+	rrlAnswer rrlClass = iota
+	rrlNXDomain
+	rrlReferral
+	rrlError
+)
+
+func (c rrlClass) String() string {
+	switch c {
+	case rrlAnswer:
+		return "answer"
+	case rrlNXDomain:
+		return "nxdomain"
+	case rrlReferral:
+		return "referral"
+	case rrlError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+type rrlKey struct {
+	prefix netip.Prefix
+	class  rrlClass
+}
+
+// rrlBucket is a token bucket refilled at the class rate.
+type rrlBucket struct {
+	mutex   sync.Mutex
+	tokens  float64
+	last    time.Time
+	limited int
+}
+
+// Configure the plugin.
+func (r *RRLPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("RRLPlugin.Configure")
+	if err := UnmarshalConfiguration(config, &r.config); err != nil {
+		return err
+	}
+	if r.config.IPv4PrefixLen < 0 || r.config.IPv4PrefixLen > 32 || r.config.IPv6PrefixLen < 0 || r.config.IPv6PrefixLen > 128 {
+		return fmt.Errorf("invalid rrl prefix lengths: %v, %v", r.config.IPv4PrefixLen, r.config.IPv6PrefixLen)
+	}
+	var err error
+	if r.config.exempt, err = utils.ParsePrefixes(r.config.Exempt); err != nil {
+		return err
+	}
+	r.buckets, err = otter.MustBuilder[rrlKey, *rrlBucket](r.config.MaxTableSize).Build()
+	log.Debug().Msgf("RRLPlugin: %#v", r.config)
+	return err
+}
+
+func (r *RRLPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	// only udp can be spoofed
+	addr, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr)
+	if !ok || addr.Network() != protoUDP {
+		return nil
+	}
+	client, ok := utils.AddrToNetIP(addr)
+	if !ok || (len(r.config.exempt) > 0 && utils.IsTrustedAddr(addr, r.config.exempt)) {
+		return nil
+	}
+
+	class := classifyRRL(msg)
+	rate := r.rate(class)
+	if rate <= 0 {
+		return nil
+	}
+	bits := r.config.IPv6PrefixLen
+	if client.Is4() {
+		bits = r.config.IPv4PrefixLen
+	}
+	prefix, _ := client.Prefix(bits)
+
+	allowed, slip := r.take(rrlKey{prefix: prefix, class: class}, rate)
+	if allowed {
+		return nil
+	}
+
+	action := "drop"
+	if slip {
+		action = "slip"
+	}
+	if r.config.LogOnly {
+		action = "log"
+	}
+	metrics.GetOrCreateCounter(fmt.Sprintf(`dns_rrl_limited_total{class=%q,action=%q}`, class, action)).Inc()
+	log.Debug().Stringer("client", prefix).Stringer("class", class).Str("action", action).Msg("response rate limited")
+
+	switch action {
+	case "log":
+		return nil
+	case "slip":
+		slipResponse(msg)
+		return nil
+	default:
+		DropResponse(ctx)
+		return ErrBreakProcessing
+	}
+}
+
+func (r *RRLPlugin) rate(class rrlClass) int {
+	switch class {
+	case rrlNXDomain:
+		return r.config.NXDomainsPerSecond
+	case rrlReferral:
+		return r.config.ReferralsPerSecond
+	case rrlError:
+		return r.config.ErrorsPerSecond
+	default:
+		return r.config.ResponsesPerSecond
+	}
+}
+
+// take a token from the bucket, when there are none report if this limited response slips.
+func (r *RRLPlugin) take(key rrlKey, rate int) (allowed bool, slip bool) {
+	burst := float64(rate) * max(r.config.Window.Seconds(), 1)
+	bucket, ok := r.buckets.Get(key)
+	if !ok {
+		bucket = &rrlBucket{tokens: burst, last: time.Now()}
+		if !r.buckets.SetIfAbsent(key, bucket) {
+			if existing, ok := r.buckets.Get(key); ok {
+				bucket = existing
+			}
+		}
+	}
+
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+	now := time.Now()
+	bucket.tokens = min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*float64(rate))
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, false
+	}
+	bucket.limited++
+	return false, r.config.Slip > 0 && bucket.limited%r.config.Slip == 0
+}
+
+func classifyRRL(msg *dns.Msg) rrlClass {
+	switch {
+	case msg.Rcode == dns.RcodeNameError:
+		return rrlNXDomain
+	case msg.Rcode != dns.RcodeSuccess:
+		return rrlError
+	case len(msg.Answer) == 0 && !msg.Authoritative && utils.ContainsNS(msg):
+		return rrlReferral
+	default:
+		return rrlAnswer
+	}
+}
+
+// slipResponse empties the response and sets TC so the client retries over tcp.
+func slipResponse(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+	if opt != nil {
+		msg.Extra = []dns.RR{opt}
+	}
+	msg.Truncated = true
+}
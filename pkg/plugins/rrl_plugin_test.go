@@ -0,0 +1,106 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func rrlCtx(addr net.Addr) context.Context {
+	ctx := CreateNewHandlerCtx()
+	QueryMetadata(ctx)["RemoteAddr"] = addr
+	ResponseMetadata(ctx)[responseWritten] = false
+	return ctx
+}
+
+func rrlResponse() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	rr, _ := dns.NewRR("example.com. 300 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, rr)
+	return resp
+}
+
+func TestRRLPlugin(t *testing.T) {
+	assert := assert.New(t)
+	p := &RRLPlugin{}
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{
+		"responsesPerSecond": 2,
+		"window":             "1s",
+		"slip":               2,
+		"exempt":             []string{"10.0.0.0/8"},
+	}))
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5000}
+	passed, slipped, dropped := 0, 0, 0
+	for i := 0; i < 6; i++ {
+		ctx := rrlCtx(client)
+		resp := rrlResponse()
+		err := p.Response(ctx, resp)
+		switch {
+		case err == ErrBreakProcessing:
+			assert.True(ResponseMetadata(ctx)[responseWritten].(bool))
+			dropped++
+		case resp.Truncated:
+			assert.Empty(resp.Answer)
+			slipped++
+		default:
+			passed++
+		}
+	}
+	assert.Equal(2, passed)
+	assert.Equal(2, slipped)
+	assert.Equal(2, dropped)
+
+	// same network is limited, others and tcp are not
+	assert.Equal(ErrBreakProcessing, p.Response(rrlCtx(&net.UDPAddr{IP: net.ParseIP("192.0.2.20")}), rrlResponse()))
+	assert.NoError(p.Response(rrlCtx(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}), rrlResponse()))
+	assert.NoError(p.Response(rrlCtx(&net.TCPAddr{IP: net.ParseIP("192.0.2.10")}), rrlResponse()))
+	for i := 0; i < 6; i++ {
+		resp := rrlResponse()
+		assert.NoError(p.Response(rrlCtx(&net.UDPAddr{IP: net.ParseIP("10.1.1.1")}), resp))
+		assert.False(resp.Truncated)
+	}
+
+	// other response classes have their own buckets
+	nx := rrlResponse()
+	nx.Rcode = dns.RcodeNameError
+	assert.NoError(p.Response(rrlCtx(client), nx))
+}
+
+func TestRRLPluginLogOnly(t *testing.T) {
+	assert := assert.New(t)
+	p := &RRLPlugin{}
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{
+		"responsesPerSecond": 1,
+		"logOnly":            true,
+	}))
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}
+	for i := 0; i < 10; i++ {
+		resp := rrlResponse()
+		assert.NoError(p.Response(rrlCtx(client), resp))
+		assert.False(resp.Truncated)
+	}
+}
+
+func TestClassifyRRL(t *testing.T) {
+	assert := assert.New(t)
+	msg := rrlResponse()
+	assert.Equal(rrlAnswer, classifyRRL(msg))
+
+	msg.Rcode = dns.RcodeNameError
+	assert.Equal(rrlNXDomain, classifyRRL(msg))
+	msg.Rcode = dns.RcodeServerFailure
+	assert.Equal(rrlError, classifyRRL(msg))
+
+	msg.Rcode = dns.RcodeSuccess
+	msg.Answer = nil
+	ns, _ := dns.NewRR("example.com. 300 IN NS ns1.example.com.")
+	msg.Ns = append(msg.Ns, ns)
+	assert.Equal(rrlReferral, classifyRRL(msg))
+}
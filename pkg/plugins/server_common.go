@@ -0,0 +1,126 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// Helpers shared by the server plugins.
+
+const (
+	udpSizeKey = "UDPSize"
+
+	// packBufferSize fits most responses, larger ones are packed into a new allocation.
+	packBufferSize = 4096
+)
+
+var errNoProxyTrusted = errors.New("proxyProtocol requires the proxyProtocolTrusted sources")
+
+var packBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, packBufferSize)
+		return &buf
+	},
+}
+
+// getPackBuffer returns a pooled buffer for msg.PackBuffer, return it with putPackBuffer
+// once the packed message is written.
+func getPackBuffer() *[]byte {
+	return packBufferPool.Get().(*[]byte)
+}
+
+func putPackBuffer(buf *[]byte) {
+	if buf != nil {
+		packBufferPool.Put(buf)
+	}
+}
+
+// DropResponse marks the query as handled without sending a response to the client,
+// return ErrBreakProcessing after it to stop the response processing.
+func DropResponse(ctx context.Context) {
+	ResponseMetadata(ctx)[responseWritten] = true
+}
+
+// requestUDPSize is the largest udp response the client accepts, 512 without EDNS.
+func requestUDPSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return max(int(opt.UDPSize()), dns.MinMsgSize)
+	}
+	return dns.MinMsgSize
+}
+
+// udpResponseSize is the largest udp response for the query, the client's size capped at maxPayload.
+func udpResponseSize(ctx context.Context, maxPayload int) int {
+	size := dns.MinMsgSize
+	if s, ok := QueryMetadata(ctx)[udpSizeKey].(int); ok {
+		size = s
+	}
+	if maxPayload > 0 {
+		size = min(size, maxPayload)
+	}
+	return size
+}
+
+// truncateUDPResponse fits the response into the size the client advertised, capped
+// at maxPayload. Records that don't fit are removed and TC is set, a copy is
+// truncated so messages shared with other plugins (ex: the cache) are left intact.
+func truncateUDPResponse(ctx context.Context, msg *dns.Msg, maxPayload int) *dns.Msg {
+	size := udpResponseSize(ctx, maxPayload)
+	if msg.Len() <= size {
+		return msg
+	}
+	msg = msg.Copy()
+	msg.Truncate(size)
+	return msg
+}
+
+var pmtuUnsupportedOnce sync.Once
+
+// setPMTUDiscovery sets the path MTU discovery mode of a udp socket, platforms
+// without the socket option keep their default behaviour.
+func setPMTUDiscovery(fd uintptr, mode string) error {
+	err := utils.SetPMTUDiscovery(fd, mode)
+	if errors.Is(err, utils.ErrPMTUUnsupported) {
+		pmtuUnsupportedOnce.Do(func() {
+			log.Warn().Str("mode", mode).Msg("path MTU discovery mode not supported, using the system default")
+		})
+		return nil
+	}
+	return err
+}
+
+// udpListenConfig creates udp sockets with the path MTU discovery mode set.
+func udpListenConfig(pmtuMode string) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = setPMTUDiscovery(fd, pmtuMode)
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+}
+
+// serverListenConfig creates the server sockets with SO_REUSEPORT and the path
+// MTU discovery mode set, tcp listeners use the default mode.
+func serverListenConfig(pmtuMode string) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			if serr = utils.SetReusePort(fd); serr == nil {
+				serr = setPMTUDiscovery(fd, pmtuMode)
+			}
+		}); err != nil {
+			return err
+		}
+		return serr
+	}}
+}
@@ -0,0 +1,82 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func largeResponse(req *dns.Msg, answers int) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for i := 0; i < answers; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("example.com. 300 IN TXT \"%064d\"", i))
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
+
+func TestRequestUDPSize(t *testing.T) {
+	assert := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	assert.Equal(512, requestUDPSize(req))
+
+	req.SetEdns0(4096, false)
+	assert.Equal(4096, requestUDPSize(req))
+
+	req.IsEdns0().SetUDPSize(100)
+	assert.Equal(512, requestUDPSize(req))
+}
+
+func TestTruncateUDPResponse(t *testing.T) {
+	assert := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	resp := largeResponse(req, 40)
+
+	// no edns, 512 bytes
+	ctx := CreateNewHandlerCtx()
+	QueryMetadata(ctx)[udpSizeKey] = requestUDPSize(req)
+	truncated := truncateUDPResponse(ctx, resp, 1232)
+	assert.True(truncated.Truncated)
+	assert.LessOrEqual(truncated.Len(), 512)
+	assert.False(resp.Truncated, "original must not be modified")
+	assert.Len(resp.Answer, 40)
+
+	// edns size is capped by the max payload
+	req.SetEdns0(4096, false)
+	QueryMetadata(ctx)[udpSizeKey] = requestUDPSize(req)
+	truncated = truncateUDPResponse(ctx, resp, 1232)
+	assert.True(truncated.Truncated)
+	assert.LessOrEqual(truncated.Len(), 1232)
+	assert.Greater(truncated.Len(), 512)
+
+	// fits
+	small := largeResponse(req, 2)
+	assert.Same(small, truncateUDPResponse(ctx, small, 1232))
+	assert.False(small.Truncated)
+}
+
+func TestServerListenConfigReusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported")
+	}
+	assert := assert.New(t)
+	addr := "127.0.0.1:" + freePort(t)
+	for i := 0; i < 2; i++ {
+		ln, err := serverListenConfig(utils.PMTUDefault).Listen(context.Background(), "tcp", addr)
+		if assert.NoError(err) {
+			defer ln.Close()
+		}
+		pc, err := serverListenConfig(utils.PMTUOmit).ListenPacket(context.Background(), "udp", addr)
+		if assert.NoError(err) {
+			defer pc.Close()
+		}
+	}
+}
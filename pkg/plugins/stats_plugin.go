@@ -0,0 +1,225 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// StatsPlugin keeps the heavy hitters of a rolling window: the most queried
+// names, the busiest clients, the names answered with NXDOMAIN or blocked by
+// the acl, and the rcodes. The counts are approximate with a bounded memory,
+// they are served by the admin API and as Prometheus gauges of the top K.
+type StatsPlugin struct {
+	config   StatsPluginConfig
+	names    *utils.RollingTopK
+	clients  *utils.RollingTopK
+	nxdomain *utils.RollingTopK
+	blocked  *utils.RollingTopK
+	rcodes   *utils.RollingTopK
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&StatsPlugin{})
+}
+
+func (s *StatsPlugin) Name() string {
+	return "stats"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (s *StatsPlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(s.Name(), &s.config, out)
+}
+
+type StatsPluginConfig struct {
+	TopK     int           `toml:"topK" comment:"Heavy hitters exposed as Prometheus gauges and by default in the admin API" default:"10"`
+	Capacity int           `toml:"capacity" comment:"Keys counted per list and bucket, more keys are more accurate" default:"1000"`
+	Window   time.Duration `toml:"window" comment:"Rolling window of the counts" default:"5m"`
+	Buckets  int           `toml:"buckets" comment:"Buckets of the window, one is dropped every window/buckets" default:"5"`
+	Metrics  bool          `toml:"metrics" comment:"Expose the top K as Prometheus gauges" default:"true"`
+}
+
+const (
+	statsTopPath = "/stats/top"
+
+	// statsRcodeCapacity counts all the rcodes exactly.
+	statsRcodeCapacity = 32
+)
+
+// Configure the plugin.
+func (s *StatsPlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("StatsPlugin.Configure")
+	s.config = StatsPluginConfig{}
+	if err := UnmarshalConfiguration(config, &s.config); err != nil {
+		return err
+	}
+	if s.config.TopK < 1 || s.config.Capacity < s.config.TopK {
+		return fmt.Errorf("invalid stats top k and capacity: %v, %v", s.config.TopK, s.config.Capacity)
+	}
+	if s.config.Buckets < 1 || s.config.Window < time.Duration(s.config.Buckets)*time.Second {
+		return fmt.Errorf("invalid stats window and buckets: %v, %v", s.config.Window, s.config.Buckets)
+	}
+	return nil
+}
+
+// Start the protocol plugin.
+func (s *StatsPlugin) StartClient(ctx context.Context, handler Handler) error {
+	s.names = utils.NewRollingTopK(s.config.Capacity, s.config.Buckets)
+	s.clients = utils.NewRollingTopK(s.config.Capacity, s.config.Buckets)
+	s.nxdomain = utils.NewRollingTopK(s.config.Capacity, s.config.Buckets)
+	s.blocked = utils.NewRollingTopK(s.config.Capacity, s.config.Buckets)
+	s.rcodes = utils.NewRollingTopK(statsRcodeCapacity, s.config.Buckets)
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go s.rotate(s.done)
+	setActiveStats(s)
+	registerAdminHandler(statsTopPath, s)
+	if s.config.Metrics {
+		setPluginMetricsWriter(s.Name(), s.writeMetrics)
+	}
+	return nil
+}
+
+// Stop the protocol plugin.
+func (s *StatsPlugin) StopClient(ctx context.Context) error {
+	setPluginMetricsWriter(s.Name(), nil)
+	registerAdminHandler(statsTopPath, nil)
+	setActiveStats(nil)
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+	return nil
+}
+
+func (s *StatsPlugin) rotate(done chan struct{}) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.Window / time.Duration(s.config.Buckets))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for _, top := range s.lists() {
+				top.Rotate()
+			}
+		}
+	}
+}
+
+func (s *StatsPlugin) lists() []*utils.RollingTopK {
+	return []*utils.RollingTopK{s.names, s.clients, s.nxdomain, s.blocked, s.rcodes}
+}
+
+func (s *StatsPlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	s.names.Add(statsName(msg), 1)
+	// the anonymized address, as logged
+	if client, _ := splitRemoteAddr(ctx); client != emptyValue {
+		s.clients.Add(client, 1)
+	}
+	return nil
+}
+
+func (s *StatsPlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	s.rcodes.Add(dns.RcodeToString[msg.Rcode], 1)
+	if msg.Rcode == dns.RcodeNameError {
+		s.nxdomain.Add(statsName(msg), 1)
+	}
+	return nil
+}
+
+func statsName(msg *dns.Msg) string {
+	return strings.ToLower(safeQuestion(msg).Name)
+}
+
+type statsTop struct {
+	Window   string            `json:"window"`
+	Names    []utils.TopKEntry `json:"names"`
+	Clients  []utils.TopKEntry `json:"clients"`
+	NXDomain []utils.TopKEntry `json:"nxdomain"`
+	Blocked  []utils.TopKEntry `json:"blocked"`
+	Rcodes   []utils.TopKEntry `json:"rcodes"`
+}
+
+// ServeHTTP returns the top k of the lists, k is the topK or the k parameter.
+func (s *StatsPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k := s.config.TopK
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > s.config.Capacity {
+			http.Error(w, fmt.Sprintf("invalid k: %v", v), http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	writeAdminJSON(w, statsTop{
+		Window:   s.config.Window.String(),
+		Names:    s.names.Top(k),
+		Clients:  s.clients.Top(k),
+		NXDomain: s.nxdomain.Top(k),
+		Blocked:  s.blocked.Top(k),
+		Rcodes:   s.rcodes.Top(statsRcodeCapacity),
+	})
+}
+
+// writeMetrics writes the top K as gauges, the series change with the heavy hitters.
+func (s *StatsPlugin) writeMetrics(w io.Writer) {
+	for _, list := range []struct {
+		metric, label string
+		top           *utils.RollingTopK
+	}{
+		{"dns_stats_top_names", "name", s.names},
+		{"dns_stats_top_clients", "client", s.clients},
+		{"dns_stats_top_nxdomain_names", "name", s.nxdomain},
+		{"dns_stats_top_blocked_names", "name", s.blocked},
+	} {
+		for i, e := range list.top.Top(s.config.TopK) {
+			metrics.WriteGaugeUint64(w, fmt.Sprintf(`%v{rank="%d",%v=%q}`, list.metric, i+1, list.label, e.Key), e.Count)
+		}
+	}
+	for _, e := range s.rcodes.Top(statsRcodeCapacity) {
+		metrics.WriteGaugeUint64(w, fmt.Sprintf(`dns_stats_rcodes{rcode=%q}`, e.Key), e.Count)
+	}
+}
+
+// activeStats is set while the stats plugin runs, the acl reports the blocked
+// queries to it.
+var (
+	activeStatsMutex sync.RWMutex
+	activeStats      *StatsPlugin
+)
+
+func setActiveStats(s *StatsPlugin) {
+	activeStatsMutex.Lock()
+	defer activeStatsMutex.Unlock()
+	activeStats = s
+}
+
+func getActiveStats() *StatsPlugin {
+	activeStatsMutex.RLock()
+	defer activeStatsMutex.RUnlock()
+	return activeStats
+}
+
+// reportBlockedQuery counts a query refused or dropped by a policy.
+func reportBlockedQuery(msg *dns.Msg) {
+	if s := getActiveStats(); s != nil {
+		s.blocked.Add(statsName(msg), 1)
+	}
+}
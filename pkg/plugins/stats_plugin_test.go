@@ -0,0 +1,102 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsPluginConfigure(t *testing.T) {
+	assert := assert.New(t)
+	s := &StatsPlugin{}
+	assert.Error(s.Configure(context.Background(), map[string]interface{}{"topK": 0}))
+	assert.Error(s.Configure(context.Background(), map[string]interface{}{"topK": 20, "capacity": 10}))
+	assert.Error(s.Configure(context.Background(), map[string]interface{}{"buckets": 0}))
+	assert.Error(s.Configure(context.Background(), map[string]interface{}{"window": "1s", "buckets": 5}))
+	assert.NoError(s.Configure(context.Background(), map[string]interface{}{}))
+	assert.Equal(StatsPluginConfig{TopK: 10, Capacity: 1000, Window: 5 * time.Minute, Buckets: 5, Metrics: true}, s.config)
+}
+
+func TestStatsPlugin(t *testing.T) {
+	assert := assert.New(t)
+	s := &StatsPlugin{}
+	assert.NoError(s.Configure(context.Background(), map[string]interface{}{"topK": 2}))
+	assert.NoError(s.StartClient(context.Background(), nil))
+	defer s.StopClient(context.Background())
+
+	query := func(client, name string, rcode int) {
+		ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, nil, name)
+		s.Query(ctx, q)
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		s.Response(ctx, r)
+	}
+	for i := 0; i < 3; i++ {
+		query("192.0.2.1", "Example.com.", dns.RcodeSuccess)
+	}
+	query("192.0.2.2", "missing.example.", dns.RcodeNameError)
+	query("192.0.2.2", "missing.example.", dns.RcodeNameError)
+	query("192.0.2.3", "other.example.", dns.RcodeSuccess)
+
+	// the acl reports the blocked queries
+	a, _ := newTestACL(t, map[string]interface{}{
+		"rules": []map[string]interface{}{{"name": "block", "action": "drop", "domains": []string{"blocked.example"}}},
+	})
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.9"), Port: 5353}, nil, "www.blocked.example.")
+	assert.Equal(ErrBreakProcessing, a.Query(ctx, q))
+
+	w := httptest.NewRecorder()
+	(&AdminPlugin{}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, statsTopPath, nil))
+	var top statsTop
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &top))
+	assert.Equal("5m0s", top.Window)
+	if assert.Len(top.Names, 2) {
+		assert.Equal("example.com.", top.Names[0].Key)
+		assert.Equal(uint64(3), top.Names[0].Count)
+		assert.Equal("missing.example.", top.Names[1].Key)
+	}
+	if assert.Len(top.Clients, 2) {
+		assert.Equal("192.0.2.1", top.Clients[0].Key)
+	}
+	if assert.Len(top.NXDomain, 1) {
+		assert.Equal(uint64(2), top.NXDomain[0].Count)
+	}
+	if assert.Len(top.Blocked, 1) {
+		assert.Equal("www.blocked.example.", top.Blocked[0].Key)
+	}
+	assert.Len(top.Rcodes, 2)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, statsTopPath+"?k=5", nil))
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &top))
+	assert.Len(top.Names, 3)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, statsTopPath+"?k=0", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	var buf bytes.Buffer
+	writePluginMetrics(&buf)
+	out := buf.String()
+	assert.Contains(out, `dns_stats_top_names{rank="1",name="example.com."} 3`)
+	assert.Contains(out, `dns_stats_top_clients{rank="2",client="192.0.2.2"} 2`)
+	assert.Contains(out, `dns_stats_top_nxdomain_names{rank="1",name="missing.example."} 2`)
+	assert.Contains(out, `dns_stats_top_blocked_names{rank="1",name="www.blocked.example."} 1`)
+	assert.Contains(out, `dns_stats_rcodes{rcode="NXDOMAIN"} 2`)
+
+	for _, top := range s.lists() {
+		for i := 0; i < s.config.Buckets; i++ {
+			top.Rotate()
+		}
+	}
+	buf.Reset()
+	writePluginMetrics(&buf)
+	assert.Empty(buf.String())
+}
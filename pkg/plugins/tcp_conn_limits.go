@@ -0,0 +1,255 @@
+package plugins
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	log "github.com/rs/zerolog/log"
+)
+
+// tcpConnTracker enforces the global and per client limits on concurrent tcp
+// connections. When the global limit is reached the connection idle the longest
+// is closed to make room, a client over its own limit is refused.
+type tcpConnTracker struct {
+	maxConns          int
+	maxConnsPerClient int
+
+	mutex   sync.Mutex
+	conns   map[*tcpConnEntry]struct{}
+	clients map[netip.Addr]int
+}
+
+type tcpConnEntry struct {
+	client     netip.Addr
+	lastActive atomic.Int64
+	close      func()
+}
+
+func (e *tcpConnEntry) touch() {
+	if e != nil {
+		e.lastActive.Store(time.Now().UnixNano())
+	}
+}
+
+func newTCPConnTracker(maxConns, maxConnsPerClient int) *tcpConnTracker {
+	return &tcpConnTracker{
+		maxConns:          maxConns,
+		maxConnsPerClient: maxConnsPerClient,
+		conns:             make(map[*tcpConnEntry]struct{}),
+		clients:           make(map[netip.Addr]int),
+	}
+}
+
+var errClientConnLimit = errors.New("tcp connection limit per client reached")
+
+// open registers a new connection, nil is returned when it must be refused.
+// A nil remote, for a connection waiting for its PROXY header, is only
+// counted in the global limit until assigned its client.
+func (t *tcpConnTracker) open(remote net.Addr, close func()) *tcpConnEntry {
+	client, _ := utils.AddrToNetIP(remote)
+	entry := &tcpConnEntry{client: client, close: close}
+	entry.touch()
+
+	var evict *tcpConnEntry
+	t.mutex.Lock()
+	// unix socket clients have no address, only the global limit applies to them
+	if t.maxConnsPerClient > 0 && client.IsValid() && t.clients[client] >= t.maxConnsPerClient {
+		t.mutex.Unlock()
+		log.Debug().Stringer("client", client).Msg("tcp connection limit per client reached")
+		return nil
+	}
+	if t.maxConns > 0 && len(t.conns) >= t.maxConns {
+		if evict = t.oldestIdle(); evict == nil {
+			t.mutex.Unlock()
+			return nil
+		}
+		t.remove(evict)
+	}
+	t.conns[entry] = struct{}{}
+	t.clients[client]++
+	t.mutex.Unlock()
+
+	if evict != nil {
+		log.Debug().Stringer("client", evict.client).Msg("tcp connection limit reached, closing oldest idle connection")
+		evict.close()
+	}
+	return entry
+}
+
+// assign charges the connection to its client once known, false is returned
+// when the client is over its limit and the connection must be closed.
+func (t *tcpConnTracker) assign(entry *tcpConnEntry, remote net.Addr) bool {
+	client, _ := utils.AddrToNetIP(remote)
+	if entry == nil || !client.IsValid() {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.conns[entry]; !ok || entry.client == client {
+		return true
+	}
+	if t.maxConnsPerClient > 0 && t.clients[client] >= t.maxConnsPerClient {
+		log.Debug().Stringer("client", client).Msg("tcp connection limit per client reached")
+		return false
+	}
+	if t.clients[entry.client]--; t.clients[entry.client] <= 0 {
+		delete(t.clients, entry.client)
+	}
+	entry.client = client
+	t.clients[client]++
+	return true
+}
+
+func (t *tcpConnTracker) release(entry *tcpConnEntry) {
+	if entry == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.remove(entry)
+}
+
+// closeIdle closes the connections without any activity for the idle timeout.
+func (t *tcpConnTracker) closeIdle(idleTimeout time.Duration) {
+	deadline := time.Now().Add(-idleTimeout).UnixNano()
+	idle := []*tcpConnEntry{}
+	t.mutex.Lock()
+	for e := range t.conns {
+		if e.lastActive.Load() < deadline {
+			idle = append(idle, e)
+			t.remove(e)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, e := range idle {
+		e.close()
+	}
+}
+
+func (t *tcpConnTracker) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+func (t *tcpConnTracker) remove(entry *tcpConnEntry) {
+	if _, ok := t.conns[entry]; !ok {
+		return
+	}
+	delete(t.conns, entry)
+	if t.clients[entry.client]--; t.clients[entry.client] <= 0 {
+		delete(t.clients, entry.client)
+	}
+}
+
+func (t *tcpConnTracker) oldestIdle() *tcpConnEntry {
+	var oldest *tcpConnEntry
+	for e := range t.conns {
+		if oldest == nil || e.lastActive.Load() < oldest.lastActive.Load() {
+			oldest = e
+		}
+	}
+	return oldest
+}
+
+// trackedListener applies the tracker to the accepted connections. The
+// connections of a utils.ProxyListener are charged to their client once the
+// PROXY header is read, on the first Read.
+type trackedListener struct {
+	net.Listener
+	tracker *tcpConnTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tc := &trackedConn{Conn: c, tracker: l.tracker, proxied: utils.IsProxyConn(c)}
+		remote := c.RemoteAddr()
+		if tc.proxied {
+			remote = nil
+		}
+		if tc.entry = l.tracker.open(remote, func() { c.Close() }); tc.entry == nil {
+			c.Close()
+			continue
+		}
+		return tc, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *tcpConnTracker
+	entry   *tcpConnEntry
+	proxied bool
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.proxied {
+		// the PROXY header was read
+		c.proxied = false
+		if !c.tracker.assign(c.entry, c.Conn.RemoteAddr()) {
+			c.Close()
+			return 0, errClientConnLimit
+		}
+	}
+	if n > 0 {
+		c.entry.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.entry.touch()
+	return c.Conn.Write(b)
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.release(c.entry)
+	return c.Conn.Close()
+}
+
+// RFC 7828 edns-tcp-keepalive
+
+const tcpKeepaliveKey = "TCPKeepalive"
+
+func requestsTCPKeepalive(req *dns.Msg) bool {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0TCPKEEPALIVE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addTCPKeepalive returns a copy of the response advertising the idle timeout.
+func addTCPKeepalive(msg *dns.Msg, idleTimeout time.Duration) *dns.Msg {
+	msg = msg.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	timeout := uint16(min(idleTimeout/(100*time.Millisecond), 0xffff))
+	keepalive := &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: timeout}
+	for i, o := range opt.Option {
+		if o.Option() == dns.EDNS0TCPKEEPALIVE {
+			opt.Option[i] = keepalive
+			return msg
+		}
+	}
+	opt.Option = append(opt.Option, keepalive)
+	return msg
+}
@@ -0,0 +1,186 @@
+package plugins
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPConnTrackerLimits(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTCPConnTracker(3, 2)
+	clientA := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	clientB := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	closed := []string{}
+	closer := func(name string) func() {
+		return func() { closed = append(closed, name) }
+	}
+
+	a1 := tracker.open(clientA, closer("a1"))
+	assert.NotNil(a1)
+	a2 := tracker.open(clientA, closer("a2"))
+	assert.NotNil(a2)
+	assert.Nil(tracker.open(clientA, closer("a3")), "per client limit")
+
+	b1 := tracker.open(clientB, closer("b1"))
+	assert.NotNil(b1)
+	assert.Equal(3, tracker.count())
+
+	// at the global limit the connection idle the longest is closed
+	a1.lastActive.Store(time.Now().Add(-time.Minute).UnixNano())
+	b2 := tracker.open(clientB, closer("b2"))
+	assert.NotNil(b2)
+	assert.Equal([]string{"a1"}, closed)
+	assert.Equal(3, tracker.count())
+
+	// a1 is gone so client A may connect again, after the idle timeout
+	a2.lastActive.Store(time.Now().Add(-time.Minute).UnixNano())
+	tracker.closeIdle(10 * time.Second)
+	assert.Equal([]string{"a1", "a2"}, closed)
+	assert.Equal(2, tracker.count())
+
+	tracker.release(b1)
+	tracker.release(b1)
+	tracker.release(nil)
+	assert.Equal(1, tracker.count())
+}
+
+func TestTCPConnTrackerAssign(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newTCPConnTracker(0, 1)
+	clientA := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	clientB := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	// the connections waiting for their PROXY header share no client limit
+	p1 := tracker.open(nil, func() {})
+	p2 := tracker.open(nil, func() {})
+	p3 := tracker.open(nil, func() {})
+	assert.NotNil(p1)
+	assert.NotNil(p2)
+	assert.NotNil(p3)
+	assert.True(tracker.assign(p1, clientA))
+	assert.True(tracker.assign(p2, clientB))
+	assert.False(tracker.assign(p3, clientA), "per client limit")
+	assert.Nil(tracker.open(clientA, func() {}))
+	tracker.release(p1)
+	assert.True(tracker.assign(p3, clientA))
+	assert.Equal(2, tracker.count())
+}
+
+// proxiedTCPExchange sends a query over tcp after a PROXY v1 header with the client address.
+func proxiedTCPExchange(t *testing.T, addr, client string) (*dns.Conn, *dns.Msg, error) {
+	c, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return nil, nil, err
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	_, err = io.WriteString(c, "PROXY TCP4 "+client+" "+host+" 40000 "+port+"\r\n")
+	assert.NoError(t, err)
+	conn := &dns.Conn{Conn: c}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	assert.NoError(t, conn.WriteMsg(m))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	r, err := conn.ReadMsg()
+	return conn, r, err
+}
+
+func TestProxyProtocolTrustedRequired(t *testing.T) {
+	for _, s := range []ProtocolServerPlugin{&DO53ServerPlugin{}, &DO53GnetServerPlugin{}} {
+		assert := assert.New(t)
+		// any client could choose its address
+		assert.ErrorIs(s.Configure(context.Background(), map[string]interface{}{"proxyProtocol": true}), errNoProxyTrusted, s.Name())
+		assert.NoError(s.Configure(context.Background(), map[string]interface{}{"proxyProtocol": true, "proxyProtocolTrusted": []string{"192.0.2.0/24"}}), s.Name())
+		assert.NoError(s.Configure(context.Background(), map[string]interface{}{}), s.Name())
+	}
+}
+
+func TestTCPConnLimitsProxyProtocol(t *testing.T) {
+	for _, s := range []ProtocolServerPlugin{&DO53ServerPlugin{}, &DO53GnetServerPlugin{}} {
+		t.Run(s.Name(), func(t *testing.T) {
+			assert := assert.New(t)
+			addr := "127.0.0.1:" + freePort(t)
+			assert.NoError(s.Configure(context.Background(), map[string]interface{}{
+				"listen": addr, "proxyProtocol": true, "proxyProtocolTrusted": []string{"127.0.0.0/8"},
+				"maxTCPConnectionsPerClient": 1,
+			}))
+			startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+				r := new(dns.Msg)
+				r.SetReply(m)
+				return nil, s.Response(ctx, r)
+			})
+
+			// all the connections come from the proxy, the limit applies to its clients
+			conn1, r, err := proxiedTCPExchange(t, addr, "192.0.2.1")
+			assert.NoError(err)
+			assert.NotNil(r)
+			defer conn1.Close()
+			conn2, r, err := proxiedTCPExchange(t, addr, "192.0.2.2")
+			assert.NoError(err)
+			assert.NotNil(r)
+			defer conn2.Close()
+			conn3, _, err := proxiedTCPExchange(t, addr, "192.0.2.1")
+			assert.Error(err)
+			conn3.Close()
+		})
+	}
+}
+
+func TestTCPKeepaliveOption(t *testing.T) {
+	assert := assert.New(t)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.False(requestsTCPKeepalive(req))
+
+	req.SetEdns0(1232, false)
+	assert.False(requestsTCPKeepalive(req))
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	assert.True(requestsTCPKeepalive(req))
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	withKeepalive := addTCPKeepalive(resp, 10*time.Second)
+	assert.Nil(resp.IsEdns0(), "original must not be modified")
+	keepalive := withKeepalive.IsEdns0().Option[0].(*dns.EDNS0_TCP_KEEPALIVE)
+	assert.Equal(uint16(100), keepalive.Timeout)
+}
+
+func TestGnetServerTCPIdleTimeout(t *testing.T) {
+	assert := assert.New(t)
+	addr := "127.0.0.1:" + freePort(t)
+
+	s := newTestGnetServer(t, map[string]interface{}{"listen": addr, "tcpIdleTimeout": "300ms"})
+	startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return nil, s.Response(ctx, r)
+	})
+
+	conn, err := dns.Dial("tcp", addr)
+	assert.NoError(err)
+	defer conn.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	assert.NoError(conn.WriteMsg(m))
+	assert.NoError(conn.SetReadDeadline(time.Now().Add(2 * time.Second)))
+	r, err := conn.ReadMsg()
+	assert.NoError(err)
+	if assert.NotNil(r.IsEdns0()) && assert.Len(r.IsEdns0().Option, 1) {
+		assert.Equal(uint16(3), r.IsEdns0().Option[0].(*dns.EDNS0_TCP_KEEPALIVE).Timeout)
+	}
+
+	// the idle connection is closed by the server
+	_, err = conn.ReadMsg()
+	assert.ErrorIs(err, io.EOF)
+}
@@ -0,0 +1,211 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	log "github.com/rs/zerolog/log"
+)
+
+var (
+	otlpExported          = metrics.GetOrCreateCounter(`dns_trace_otlp_exported_total`)
+	otlpDroppedFull       = metrics.GetOrCreateCounter(`dns_trace_otlp_dropped_total{reason="buffer_full"}`)
+	otlpDroppedExportFail = metrics.GetOrCreateCounter(`dns_trace_otlp_dropped_total{reason="export_error"}`)
+)
+
+const (
+	// otlpBatchSize is the max traces of an export.
+	otlpBatchSize = 100
+
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpStatusError      = 2
+)
+
+// otlpExporter posts the traces as OTLP/HTTP JSON requests in batches, the
+// queries never wait for it, the traces over the buffer are dropped.
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	traces   chan *QueryTrace
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newOTLPExporter(endpoint, service string, timeout time.Duration, bufferSize int) *otlpExporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: timeout},
+		traces:   make(chan *QueryTrace, bufferSize),
+		done:     make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) export(t *QueryTrace) {
+	select {
+	case e.traces <- t:
+	default:
+		otlpDroppedFull.Inc()
+	}
+}
+
+// close exports the queued traces and stops.
+func (e *otlpExporter) close() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *otlpExporter) run() {
+	defer e.wg.Done()
+	batch := make([]*QueryTrace, 0, otlpBatchSize)
+	var body []byte
+	for {
+		stopped := false
+		batch = batch[:0]
+		select {
+		case t := <-e.traces:
+			batch = append(batch, t)
+		case <-e.done:
+			stopped = true
+		}
+	fill:
+		for len(batch) < otlpBatchSize {
+			select {
+			case t := <-e.traces:
+				batch = append(batch, t)
+			default:
+				break fill
+			}
+		}
+		if len(batch) > 0 {
+			body = appendOTLPRequest(body[:0], e.service, batch)
+			if err := e.post(body); err != nil {
+				otlpDroppedExportFail.Add(len(batch))
+				log.Warn().Err(err).Str("endpoint", e.endpoint).Msg("OTLP export failed")
+			} else {
+				otlpExported.Add(len(batch))
+			}
+		}
+		if stopped && len(e.traces) == 0 {
+			return
+		}
+	}
+}
+
+func (e *otlpExporter) post(body []byte) error {
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint status: %v", resp.Status)
+	}
+	return nil
+}
+
+// appendOTLPRequest encodes the traces as an ExportTraceServiceRequest in the
+// OTLP JSON encoding, each query is a server span with a child span per plugin
+// call and upstream attempt.
+func appendOTLPRequest(b []byte, service string, traces []*QueryTrace) []byte {
+	b = append(b, `{"resourceSpans":[{"resource":{"attributes":[`...)
+	b = appendOTLPAttr(b, "service.name", service)
+	b = append(b, `]},"scopeSpans":[{"scope":{"name":"dns-forwarder"},"spans":[`...)
+	for i, t := range traces {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendOTLPTrace(b, t)
+	}
+	return append(b, `]}]}]}`...)
+}
+
+func appendOTLPTrace(b []byte, t *QueryTrace) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	traceID := hex.EncodeToString(t.id[:])
+	rootID := otlpSpanID()
+	b = appendOTLPSpanStart(b, traceID, rootID, "", "dns.query", otlpSpanKindServer, t.start, t.end)
+	b = appendOTLPAttr(b, "dns.question.name", t.name)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "dns.question.type", t.qtype)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "client.address", t.client)
+	b = append(b, ',')
+	b = appendOTLPAttr(b, "dns.rcode", t.rcode)
+	b = append(b, `]}`...)
+	for _, span := range t.spans {
+		kind := otlpSpanKindInternal
+		if span.Name == "upstream" {
+			kind = otlpSpanKindClient
+		}
+		b = append(b, ',')
+		b = appendOTLPSpanStart(b, traceID, otlpSpanID(), rootID, span.Name, kind, span.Start, span.Start.Add(span.Duration))
+		b = appendOTLPAttr(b, "decision", span.Decision)
+		for _, a := range span.Attrs {
+			b = append(b, ',')
+			b = appendOTLPAttr(b, a.Key, a.Value)
+		}
+		b = append(b, ']')
+		if span.Err != nil {
+			b = append(b, `,"status":{"code":`...)
+			b = strconv.AppendInt(b, otlpStatusError, 10)
+			b = append(b, `,"message":`...)
+			b = appendJSONString(b, span.Err.Error())
+			b = append(b, '}')
+		}
+		b = append(b, '}')
+	}
+	return b
+}
+
+// appendOTLPSpanStart opens a span up to its attributes.
+func appendOTLPSpanStart(b []byte, traceID, spanID, parentID, name string, kind int, start, end time.Time) []byte {
+	b = append(b, `{"traceId":"`...)
+	b = append(b, traceID...)
+	b = append(b, `","spanId":"`...)
+	b = append(b, spanID...)
+	if parentID != "" {
+		b = append(b, `","parentSpanId":"`...)
+		b = append(b, parentID...)
+	}
+	b = append(b, `","name":`...)
+	b = appendJSONString(b, name)
+	b = append(b, `,"kind":`...)
+	b = strconv.AppendInt(b, int64(kind), 10)
+	b = append(b, `,"startTimeUnixNano":"`...)
+	b = strconv.AppendInt(b, start.UnixNano(), 10)
+	b = append(b, `","endTimeUnixNano":"`...)
+	b = strconv.AppendInt(b, end.UnixNano(), 10)
+	return append(b, `","attributes":[`...)
+}
+
+func appendOTLPAttr(b []byte, key, value string) []byte {
+	b = append(b, `{"key":`...)
+	b = appendJSONString(b, key)
+	b = append(b, `,"value":{"stringValue":`...)
+	b = appendJSONString(b, value)
+	return append(b, `}}`...)
+}
+
+func otlpSpanID() string {
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], rand.Uint64()|1)
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,318 @@
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+)
+
+// TracePlugin traces the queries of some clients or names, or carrying an EDNS
+// option, without enabling the debug logs. A traced query records a span for
+// each plugin call and upstream attempt, the trace is logged once the query is
+// answered and optionally exported as OTLP spans.
+type TracePlugin struct {
+	config     TracePluginConfig
+	clients    []netip.Prefix
+	domains    []string
+	regex      *regexp.Regexp
+	exporter   *otlpExporter
+	exportOTLP bool
+}
+
+// Register this plugin with the DNS Forwarder.
+func init() {
+	RegisterPlugin(&TracePlugin{})
+}
+
+func (p *TracePlugin) Name() string {
+	return "trace"
+}
+
+// PrintHelp prints the configuration help for the plugin.
+func (p *TracePlugin) PrintHelp(out io.Writer) {
+	PrintPluginHelp(p.Name(), &p.config, out)
+}
+
+type TracePluginConfig struct {
+	Clients        []string      `toml:"clients" comment:"Client CIDRs or IPs traced"`
+	Domains        []string      `toml:"domains" comment:"Query name suffixes traced"`
+	Regex          string        `toml:"regex" comment:"Regular expression matching the lowercase query names traced, with the final dot"`
+	EDNSOption     int           `toml:"ednsOption" comment:"EDNS option code tracing the queries carrying it, from the local range 65001-65534, removed before forwarding, 0 disables"`
+	OTLPEndpoint   string        `toml:"otlpEndpoint" comment:"OTLP/HTTP traces endpoint receiving the spans as JSON, e.g. http://localhost:4318/v1/traces, none when empty"`
+	OTLPTimeout    time.Duration `toml:"otlpTimeout" comment:"Timeout of the OTLP exports" default:"5s"`
+	OTLPBufferSize int           `toml:"otlpBufferSize" comment:"Max traces waiting to be exported, more are dropped" default:"1000"`
+	ServiceName    string        `toml:"serviceName" comment:"OTLP service name" default:"dns-forwarder"`
+}
+
+var tracedQueries = metrics.GetOrCreateCounter(`dns_traced_queries_total`)
+
+// Configure the plugin.
+func (p *TracePlugin) Configure(ctx context.Context, config map[string]interface{}) error {
+	log.Debug().Any("config", config).Msg("TracePlugin.Configure")
+	p.config = TracePluginConfig{}
+	if err := UnmarshalConfiguration(config, &p.config); err != nil {
+		return err
+	}
+	clients, err := utils.ParsePrefixes(p.config.Clients)
+	if err != nil {
+		return fmt.Errorf("invalid trace clients: %w", err)
+	}
+	p.clients = clients
+	p.domains = p.domains[:0]
+	for _, d := range p.config.Domains {
+		p.domains = append(p.domains, dns.CanonicalName(d))
+	}
+	p.regex = nil
+	if p.config.Regex != "" {
+		if p.regex, err = regexp.Compile(p.config.Regex); err != nil {
+			return fmt.Errorf("invalid trace regex: %w", err)
+		}
+	}
+	if p.config.EDNSOption != 0 && (p.config.EDNSOption < dns.EDNS0LOCALSTART || p.config.EDNSOption > dns.EDNS0LOCALEND) {
+		return fmt.Errorf("invalid trace EDNS option: %v", p.config.EDNSOption)
+	}
+	p.exportOTLP = p.config.OTLPEndpoint != ""
+	if p.exportOTLP {
+		if u, err := url.Parse(p.config.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid trace OTLP endpoint: %v", p.config.OTLPEndpoint)
+		}
+		if p.config.OTLPBufferSize < 1 {
+			return fmt.Errorf("invalid trace OTLP buffer size: %v", p.config.OTLPBufferSize)
+		}
+	}
+	return nil
+}
+
+// Start the protocol plugin.
+func (p *TracePlugin) StartClient(ctx context.Context, handler Handler) error {
+	p.exporter = nil
+	if p.exportOTLP {
+		p.exporter = newOTLPExporter(p.config.OTLPEndpoint, p.config.ServiceName, p.config.OTLPTimeout, p.config.OTLPBufferSize)
+	}
+	return nil
+}
+
+// Stop the protocol plugin, the queued traces are exported first.
+func (p *TracePlugin) StopClient(ctx context.Context) error {
+	if p.exporter != nil {
+		// the traces finished later are dropped
+		p.exporter.close()
+	}
+	return nil
+}
+
+func (p *TracePlugin) Query(ctx context.Context, msg *dns.Msg) error {
+	if !p.traced(ctx, msg) {
+		return nil
+	}
+	tracedQueries.Inc()
+	q := safeQuestion(msg)
+	client, _ := splitRemoteAddr(ctx)
+	// the trace starts with the query, before the spans of the plugins
+	start := QueryStart(ctx)
+	if start.IsZero() {
+		start = time.Now()
+	}
+	t := &QueryTrace{
+		start:  start,
+		name:   q.Name,
+		qtype:  dns.Type(q.Qtype).String(),
+		client: client,
+		finish: p.finish,
+	}
+	binary.BigEndian.PutUint64(t.id[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(t.id[8:], rand.Uint64())
+	QueryMetadata(ctx)[traceKey] = t
+	return nil
+}
+
+func (p *TracePlugin) Response(ctx context.Context, msg *dns.Msg) error {
+	if t := Trace(ctx); t != nil {
+		t.mu.Lock()
+		t.rcode = dns.RcodeToString[msg.Rcode]
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// traced reports if the query is traced, the trace EDNS option is removed.
+func (p *TracePlugin) traced(ctx context.Context, msg *dns.Msg) bool {
+	traced := false
+	if opt := msg.IsEdns0(); opt != nil && p.config.EDNSOption != 0 {
+		n := len(opt.Option)
+		opt.Option = slices.DeleteFunc(opt.Option, func(o dns.EDNS0) bool { return int(o.Option()) == p.config.EDNSOption })
+		traced = len(opt.Option) != n
+	}
+	if traced {
+		return true
+	}
+	if len(p.clients) > 0 {
+		if remote, ok := QueryMetadata(ctx)["RemoteAddr"].(net.Addr); ok {
+			client, _ := utils.AddrToNetIP(remote)
+			if slices.ContainsFunc(p.clients, func(pr netip.Prefix) bool { return pr.Contains(client) }) {
+				return true
+			}
+		}
+	}
+	if len(p.domains) == 0 && p.regex == nil {
+		return false
+	}
+	qname := strings.ToLower(safeQuestion(msg).Name)
+	if slices.ContainsFunc(p.domains, func(d string) bool { return dns.IsSubDomain(d, qname) }) {
+		return true
+	}
+	return p.regex != nil && p.regex.MatchString(qname)
+}
+
+// finish logs the trace and exports it.
+func (p *TracePlugin) finish(t *QueryTrace) {
+	log.Info().
+		Str("trace", hex.EncodeToString(t.id[:])).
+		Str("name", t.name).
+		Str("type", t.qtype).
+		Str("client", t.client).
+		Str("rcode", t.rcode).
+		Dur("duration", t.end.Sub(t.start)).
+		Array("spans", traceSpans{t}).
+		Msg("query trace")
+	if p.exporter != nil {
+		p.exporter.export(t)
+	}
+}
+
+const traceKey = "Trace"
+
+// Span decisions.
+const (
+	TraceContinue  = "continue"
+	TraceAnswered  = "answered"
+	TraceStop      = "stop"
+	TraceError     = "error"
+	TraceTimeout   = "timeout"
+	TraceTruncated = "truncated"
+)
+
+// QueryTrace is the trace of a query, with the spans of the plugin calls and
+// of the upstream attempts.
+type QueryTrace struct {
+	mu     sync.Mutex
+	id     [16]byte
+	start  time.Time
+	end    time.Time
+	name   string
+	qtype  string
+	client string
+	rcode  string
+	spans  []TraceSpan
+	finish func(*QueryTrace)
+}
+
+// TraceSpan is an operation of a traced query.
+type TraceSpan struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Decision string
+	Err      error
+	Attrs    []TraceAttr
+}
+
+type TraceAttr struct {
+	Key, Value string
+}
+
+// Trace returns the trace of the query, nil when it isn't traced.
+func Trace(ctx context.Context) *QueryTrace {
+	t, _ := QueryMetadata(ctx)[traceKey].(*QueryTrace)
+	return t
+}
+
+// AddSpan records a span of the trace.
+func (t *QueryTrace) AddSpan(span TraceSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, span)
+}
+
+// FinishTrace ends the trace of the query once it's answered, if it's traced.
+func FinishTrace(ctx context.Context) {
+	t := Trace(ctx)
+	if t == nil {
+		return
+	}
+	delete(QueryMetadata(ctx), traceKey)
+	t.mu.Lock()
+	t.end = time.Now()
+	t.mu.Unlock()
+	t.finish(t)
+}
+
+// traceUpstream records an attempt to get the response from an upstream.
+func traceUpstream(ctx context.Context, proto, upstream string, start time.Time, resp *dns.Msg, err error) {
+	t := Trace(ctx)
+	if t == nil {
+		return
+	}
+	span := TraceSpan{Name: "upstream", Start: start, Duration: time.Since(start), Decision: TraceAnswered, Err: err}
+	span.Attrs = append(span.Attrs, TraceAttr{"upstream", upstream}, TraceAttr{"proto", proto})
+	switch {
+	case err != nil:
+		span.Decision = TraceError
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			span.Decision = TraceTimeout
+		}
+	case resp.Truncated:
+		span.Decision = TraceTruncated
+	default:
+		span.Attrs = append(span.Attrs, TraceAttr{"rcode", dns.RcodeToString[resp.Rcode]})
+	}
+	t.AddSpan(span)
+}
+
+// traceSpans logs the spans of a trace, with their start from the start of the trace.
+type traceSpans struct {
+	t *QueryTrace
+}
+
+func (s traceSpans) MarshalZerologArray(a *zerolog.Array) {
+	for _, span := range s.t.spans {
+		a.Object(traceSpanLog{span: span, offset: span.Start.Sub(s.t.start)})
+	}
+}
+
+type traceSpanLog struct {
+	span   TraceSpan
+	offset time.Duration
+}
+
+func (l traceSpanLog) MarshalZerologObject(e *zerolog.Event) {
+	e.Str("name", l.span.Name).
+		Dur("offset", l.offset).
+		Dur("duration", l.span.Duration).
+		Str("decision", l.span.Decision)
+	if l.span.Err != nil {
+		e.Str("error", l.span.Err.Error())
+	}
+	for _, a := range l.span.Attrs {
+		e.Str(a.Key, a.Value)
+	}
+}
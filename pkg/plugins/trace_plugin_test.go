@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracePluginConfigure(t *testing.T) {
+	assert := assert.New(t)
+	p := &TracePlugin{}
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"clients": []string{"nope"}}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"regex": "("}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"ednsOption": 10}))
+	assert.Error(p.Configure(context.Background(), map[string]interface{}{"otlpEndpoint": "localhost:4318"}))
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{"ednsOption": 65001, "otlpEndpoint": "http://localhost:4318/v1/traces"}))
+	assert.Equal("dns-forwarder", p.config.ServiceName)
+}
+
+func TestTracePluginSelection(t *testing.T) {
+	assert := assert.New(t)
+	p := &TracePlugin{}
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{
+		"clients":    []string{"192.0.2.0/28"},
+		"domains":    []string{"Slow.Example"},
+		"regex":      `^api\.`,
+		"ednsOption": 65001,
+	}))
+	traced := func(client, name string) bool {
+		ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP(client), Port: 5353}, nil, name)
+		assert.NoError(p.Query(ctx, q))
+		return Trace(ctx) != nil
+	}
+	assert.True(traced("192.0.2.1", "example.com."))
+	assert.False(traced("192.0.2.99", "example.com."))
+	assert.True(traced("192.0.2.99", "www.slow.example."))
+	assert.True(traced("192.0.2.99", "API.example.org."))
+
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.99"), Port: 5353}, nil, "example.com.")
+	q.SetEdns0(1232, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001}, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+	assert.NoError(p.Query(ctx, q))
+	tr := Trace(ctx)
+	if assert.NotNil(tr) {
+		assert.Equal("example.com.", tr.name)
+		assert.Equal("A", tr.qtype)
+		assert.Equal("192.0.2.99", tr.client)
+	}
+	// the option isn't forwarded
+	assert.Len(q.IsEdns0().Option, 1)
+	assert.Equal(uint16(dns.EDNS0COOKIE), q.IsEdns0().Option[0].Option())
+}
+
+func TestTraceExport(t *testing.T) {
+	assert := assert.New(t)
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	p := &TracePlugin{}
+	assert.NoError(p.Configure(context.Background(), map[string]interface{}{"domains": []string{"example.com"}, "otlpEndpoint": srv.URL + "/v1/traces"}))
+	assert.NoError(p.StartClient(context.Background(), nil))
+
+	ctx, q := aclQuery(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}, nil, "example.com.")
+	assert.NoError(p.Query(ctx, q))
+	start := time.Now()
+	resp := new(dns.Msg)
+	resp.SetRcode(q, dns.RcodeSuccess)
+	traceUpstream(ctx, protoUDP, "198.51.100.1:53", start, resp, nil)
+	traceUpstream(ctx, protoUDP, "198.51.100.1:53", start, nil, errors.New("refused"))
+	assert.NoError(p.Response(ctx, resp))
+	FinishTrace(ctx)
+	assert.Nil(Trace(ctx))
+	assert.NoError(p.StopClient(context.Background()))
+
+	var req struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpTestAttr `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string         `json:"traceId"`
+					SpanID       string         `json:"spanId"`
+					ParentSpanID string         `json:"parentSpanId"`
+					Name         string         `json:"name"`
+					Kind         int            `json:"kind"`
+					Start        string         `json:"startTimeUnixNano"`
+					Attributes   []otlpTestAttr `json:"attributes"`
+					Status       struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	select {
+	case body := <-bodies:
+		assert.NoError(json.Unmarshal(body, &req), string(body))
+	case <-time.After(5 * time.Second):
+		assert.Fail("no OTLP export")
+		return
+	}
+	assert.Equal("dns-forwarder", req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if assert.Len(spans, 3) {
+		root := spans[0]
+		assert.Equal("dns.query", root.Name)
+		assert.Equal(otlpSpanKindServer, root.Kind)
+		assert.Len(root.TraceID, 32)
+		assert.Contains(root.Attributes, otlpTestAttr{Key: "dns.rcode", Value: otlpTestValue{StringValue: "NOERROR"}})
+		assert.Equal(root.SpanID, spans[1].ParentSpanID)
+		assert.Equal(root.TraceID, spans[1].TraceID)
+		assert.Equal(otlpSpanKindClient, spans[1].Kind)
+		assert.Contains(spans[1].Attributes, otlpTestAttr{Key: "rcode", Value: otlpTestValue{StringValue: "NOERROR"}})
+		assert.Equal(otlpStatusError, spans[2].Status.Code)
+		assert.Equal("refused", spans[2].Status.Message)
+	}
+}
+
+type otlpTestAttr struct {
+	Key   string        `json:"key"`
+	Value otlpTestValue `json:"value"`
+}
+
+type otlpTestValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func TestTraceSpansLog(t *testing.T) {
+	assert := assert.New(t)
+	start := time.Now()
+	tr := &QueryTrace{start: start}
+	tr.AddSpan(TraceSpan{Name: "cache.query", Start: start.Add(time.Millisecond), Duration: 2 * time.Millisecond, Decision: TraceAnswered})
+	tr.AddSpan(TraceSpan{Name: "upstream", Start: start, Decision: TraceTimeout, Err: errors.New("i/o timeout"), Attrs: []TraceAttr{{"upstream", "198.51.100.1:53"}}})
+	var buf bytes.Buffer
+	logger := zerolog.New(&buf)
+	logger.Info().Array("spans", traceSpans{tr}).Send()
+	assert.JSONEq(`{"level":"info","spans":[
+		{"name":"cache.query","offset":1,"duration":2,"decision":"answered"},
+		{"name":"upstream","offset":0,"duration":0,"decision":"timeout","error":"i/o timeout","upstream":"198.51.100.1:53"}]}`, buf.String())
+}
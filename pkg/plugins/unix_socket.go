@@ -0,0 +1,237 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	log "github.com/rs/zerolog/log"
+)
+
+// Unix domain socket listeners for local clients, the clients are identified by
+// the credentials of their process (SO_PEERCRED / SO_PASSCRED on linux).
+
+// isStreamProto reports if queries are length prefixed on the protocol.
+func isStreamProto(proto string) bool {
+	return proto == protoTCP || proto == protoUnix
+}
+
+func parseSocketMode(mode string) (fs.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid unix socket mode: %v", mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// lookupSocketOwner resolves user[:group], names or numeric ids, -1 leaves an id unchanged.
+func lookupSocketOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	name, group, _ := strings.Cut(owner, ":")
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unix socket owner: %w", err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, fmt.Errorf("unix socket group: %w", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+// isAbstractSocket reports a linux abstract socket name, it has no file.
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// removeStaleSocket removes a socket file left by a previous run, any other
+// file at the path is an error rather than being replaced.
+func removeStaleSocket(path string) error {
+	if isAbstractSocket(path) {
+		return nil
+	}
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("unix socket path %v exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// setSocketAccess applies the configured mode and owner to the socket file.
+func setSocketAccess(ep listenEndpoint) error {
+	if isAbstractSocket(ep.address) {
+		return nil
+	}
+	if ep.mode != "" {
+		mode, err := parseSocketMode(ep.mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(ep.address, mode); err != nil {
+			return err
+		}
+	}
+	if ep.owner != "" {
+		uid, gid, err := lookupSocketOwner(ep.owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(ep.address, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenUnixStream listens on a unix stream socket, the accepted connections
+// report the peer credentials as their remote address.
+func listenUnixStream(ep listenEndpoint) (net.Listener, error) {
+	if err := removeStaleSocket(ep.address); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(protoUnix, ep.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketAccess(ep); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixPeerListener{Listener: ln}, nil
+}
+
+type unixPeerListener struct {
+	net.Listener
+}
+
+func (l *unixPeerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixPeerConn{Conn: c, peer: unixStreamPeer(c)}, nil
+}
+
+type unixPeerConn struct {
+	net.Conn
+	peer *utils.UnixPeerAddr
+}
+
+func (c *unixPeerConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func unixStreamPeer(c net.Conn) *utils.UnixPeerAddr {
+	peer := utils.NewUnixPeerAddr(protoUnix, "")
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return peer
+	}
+	if addr, ok := uc.RemoteAddr().(*net.UnixAddr); ok && addr != nil {
+		peer.Path = addr.Name
+	}
+	if raw, err := uc.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			utils.SetPeerCredentials(fd, peer)
+		})
+	}
+	return peer
+}
+
+// unixFdPeer is the peer of a connected unix stream socket.
+func unixFdPeer(fd int) *utils.UnixPeerAddr {
+	peer := utils.NewUnixPeerAddr(protoUnix, "")
+	utils.SetPeerCredentials(uintptr(fd), peer)
+	return peer
+}
+
+// listenUnixgram listens on a unix datagram socket, the sender credentials are
+// received with every datagram where supported.
+func listenUnixgram(ep listenEndpoint) (net.PacketConn, error) {
+	if err := removeStaleSocket(ep.address); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram(protoUnixgram, &net.UnixAddr{Name: ep.address, Net: protoUnixgram})
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketAccess(ep); err != nil {
+		conn.Close()
+		os.Remove(ep.address)
+		return nil, err
+	}
+	c := &unixgramConn{UnixConn: conn, path: ep.address}
+	if raw, err := conn.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			if err := utils.EnablePassCredentials(fd); err == nil {
+				c.oob = make([]byte, utils.PassCredentialsSpace)
+			}
+		})
+	}
+	if c.oob == nil {
+		log.Debug().Str("path", ep.address).Msg("unix datagram peer credentials not available")
+	}
+	return c, nil
+}
+
+// unixgramConn reports the senders as utils.UnixPeerAddr, reads must not be concurrent.
+type unixgramConn struct {
+	*net.UnixConn
+	path string
+	oob  []byte
+}
+
+func (c *unixgramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, oobn, _, addr, err := c.UnixConn.ReadMsgUnix(b, c.oob)
+	if err != nil {
+		return n, nil, err
+	}
+	peer := utils.NewUnixPeerAddr(protoUnixgram, "")
+	if addr != nil {
+		peer.Path = addr.Name
+	}
+	if oobn > 0 {
+		utils.ParsePassCredentials(c.oob[:oobn], peer)
+	}
+	return n, peer, nil
+}
+
+func (c *unixgramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if peer, ok := addr.(*utils.UnixPeerAddr); ok {
+		if peer.Path == "" {
+			return 0, fmt.Errorf("unix datagram client has no socket path to answer to")
+		}
+		addr = &net.UnixAddr{Name: peer.Path, Net: protoUnixgram}
+	}
+	return c.UnixConn.WriteTo(b, addr)
+}
+
+// Close the socket and remove its file, the datagram sockets don't unlink on close.
+func (c *unixgramConn) Close() error {
+	err := c.UnixConn.Close()
+	if !isAbstractSocket(c.path) {
+		os.Remove(c.path)
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package plugins
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	utils "github.com/jdamick/dns-forwarder/pkg/utils"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// unixTestServer answers every query and keeps the client addresses seen.
+type unixTestServer struct {
+	mutex sync.Mutex
+	peers []net.Addr
+}
+
+func (u *unixTestServer) start(t *testing.T, s ProtocolServerPlugin) {
+	startTestServer(t, s, func(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+		u.mutex.Lock()
+		u.peers = append(u.peers, QueryMetadata(ctx)["RemoteAddr"].(net.Addr))
+		u.mutex.Unlock()
+		r := new(dns.Msg)
+		r.SetReply(m)
+		return nil, s.Response(ctx, r)
+	})
+}
+
+func (u *unixTestServer) lastPeer() *utils.UnixPeerAddr {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if len(u.peers) == 0 {
+		return nil
+	}
+	peer, _ := u.peers[len(u.peers)-1].(*utils.UnixPeerAddr)
+	return peer
+}
+
+func unixExchange(t *testing.T, conn net.Conn) *dns.Msg {
+	dc := &dns.Conn{Conn: conn}
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	assert.NoError(t, dc.WriteMsg(m))
+	dc.SetReadDeadline(time.Now().Add(time.Second))
+	r, err := dc.ReadMsg()
+	if assert.NoError(t, err) {
+		assert.Equal(t, m.Id, r.Id)
+	}
+	return r
+}
+
+func assertPeerCredentials(t *testing.T, peer *utils.UnixPeerAddr) {
+	if !assert.NotNil(t, peer) || runtime.GOOS != "linux" {
+		return
+	}
+	assert.Equal(t, os.Getpid(), peer.PID)
+	assert.Equal(t, os.Getuid(), peer.UID)
+	assert.Equal(t, os.Getgid(), peer.GID)
+}
+
+func TestServerUnixSockets(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	streamPath, dgramPath := filepath.Join(dir, "dns.sock"), filepath.Join(dir, "dns-dgram.sock")
+
+	// a socket left by a previous run is replaced
+	stale, err := net.Listen("unix", streamPath)
+	assert.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &DO53ServerPlugin{}
+	assert.NoError(s.Configure(context.Background(), map[string]interface{}{
+		"listen": []string{},
+		"listeners": []map[string]interface{}{
+			{"address": "unix://" + streamPath, "mode": "0600"},
+			{"address": "unixgram://" + dgramPath, "mode": "0620"},
+		},
+	}))
+	u := &unixTestServer{}
+	u.start(t, s)
+
+	fi, err := os.Stat(streamPath)
+	if assert.NoError(err) {
+		assert.Equal(os.FileMode(0o600), fi.Mode().Perm())
+	}
+	fi, err = os.Stat(dgramPath)
+	if assert.NoError(err) {
+		assert.Equal(os.FileMode(0o620), fi.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", streamPath)
+	assert.NoError(err)
+	defer conn.Close()
+	unixExchange(t, conn)
+	peer := u.lastPeer()
+	assertPeerCredentials(t, peer)
+	if peer != nil {
+		assert.Equal("unix", peer.Network())
+	}
+
+	// datagram clients bind a path to receive the response
+	clientPath := filepath.Join(dir, "client.sock")
+	dconn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: clientPath, Net: "unixgram"}, &net.UnixAddr{Name: dgramPath, Net: "unixgram"})
+	assert.NoError(err)
+	defer dconn.Close()
+	unixExchange(t, dconn)
+	peer = u.lastPeer()
+	assertPeerCredentials(t, peer)
+	if peer != nil {
+		assert.Equal("unixgram", peer.Network())
+		assert.Equal(clientPath, peer.Path)
+	}
+
+	s.StopServer(context.Background())
+	_, err = os.Stat(dgramPath)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestGnetServerUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+	// gnet lowercases the addresses, t.TempDir has the test name
+	dir, err := os.MkdirTemp("", "gnetdns")
+	assert.NoError(err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "dns.sock")
+
+	s := newTestGnetServer(t, map[string]interface{}{"listen": "unix://" + path})
+	u := &unixTestServer{}
+	u.start(t, s)
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(err)
+	defer conn.Close()
+	unixExchange(t, conn)
+	assertPeerCredentials(t, u.lastPeer())
+
+	// unix datagram sockets are only served by the dns plugin
+	g := newTestGnetServer(t, map[string]interface{}{"listen": "unixgram://" + path + "2"})
+	assert.Error(g.StartServer(context.Background(), nil))
+	g = newTestGnetServer(t, map[string]interface{}{"listen": "unix://" + dir + "/DNS.sock"})
+	assert.Error(g.StartServer(context.Background(), nil))
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "file")
+	assert.NoError(removeStaleSocket(path))
+	assert.NoError(os.WriteFile(path, []byte("data"), 0o600))
+	assert.Error(removeStaleSocket(path))
+}
+
+func TestLookupSocketOwner(t *testing.T) {
+	assert := assert.New(t)
+	uid, gid, err := lookupSocketOwner("1000")
+	assert.NoError(err)
+	assert.Equal(1000, uid)
+	assert.Equal(-1, gid)
+
+	uid, gid, err = lookupSocketOwner(":50")
+	assert.NoError(err)
+	assert.Equal(-1, uid)
+	assert.Equal(50, gid)
+
+	_, _, err = lookupSocketOwner("no-such-user-xyz")
+	assert.Error(err)
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// IPAnonymizer replaces a client address before it's logged, the result has the
+// same family as the address.
+type IPAnonymizer interface {
+	Anonymize(addr netip.Addr) netip.Addr
+}
+
+// TruncateAnonymizer keeps the first V4Bits or V6Bits of the address and zeroes the rest.
+type TruncateAnonymizer struct {
+	V4Bits int
+	V6Bits int
+}
+
+func (t *TruncateAnonymizer) Anonymize(addr netip.Addr) netip.Addr {
+	bits := t.V6Bits
+	if addr.Is4() {
+		bits = t.V4Bits
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return addr
+	}
+	return p.Addr()
+}
+
+// HMACAnonymizer replaces the address by its keyed HMAC-SHA256, so the same
+// client has the same pseudonym until the key rotates. The key of each period
+// is derived from the secret, the instances sharing a secret agree on the
+// pseudonyms. Without a secret the keys are random.
+type HMACAnonymizer struct {
+	secret   []byte
+	rotation time.Duration
+	mutex    sync.RWMutex
+	period   int64
+	key      []byte
+}
+
+// NewHMACAnonymizer returns an anonymizer rotating its key every rotation, 0 never rotates.
+func NewHMACAnonymizer(secret []byte, rotation time.Duration) *HMACAnonymizer {
+	return &HMACAnonymizer{secret: secret, rotation: rotation, period: -1}
+}
+
+func (h *HMACAnonymizer) Anonymize(addr netip.Addr) netip.Addr {
+	mac := hmac.New(sha256.New, h.currentKey(time.Now()))
+	b := addr.AsSlice()
+	mac.Write(b)
+	sum := mac.Sum(nil)
+	anon, _ := netip.AddrFromSlice(sum[:len(b)])
+	return anon
+}
+
+// currentKey returns the key of the period of now, creating it once the period changes.
+func (h *HMACAnonymizer) currentKey(now time.Time) []byte {
+	period := int64(0)
+	if h.rotation > 0 {
+		period = now.UnixNano() / int64(h.rotation)
+	}
+	h.mutex.RLock()
+	key := h.key
+	current := h.period == period
+	h.mutex.RUnlock()
+	if current {
+		return key
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.period != period {
+		if len(h.secret) > 0 {
+			mac := hmac.New(sha256.New, h.secret)
+			mac.Write(binary.BigEndian.AppendUint64(nil, uint64(period)))
+			h.key = mac.Sum(nil)
+		} else {
+			h.key = make([]byte, sha256.Size)
+			rand.Read(h.key)
+		}
+		h.period = period
+	}
+	return h.key
+}
+
+// CryptoPAn is the prefix-preserving anonymization of Xu et al.: two addresses
+// sharing a prefix of n bits are anonymized to addresses sharing n bits too.
+type CryptoPAn struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+}
+
+// CryptoPAnKeySize is the key size, the AES-128 key then the pad secret.
+const CryptoPAnKeySize = 32
+
+var ErrCryptoPAnKeySize = errors.New("crypto-pan key must be 32 bytes")
+
+func NewCryptoPAn(key []byte) (*CryptoPAn, error) {
+	if len(key) != CryptoPAnKeySize {
+		return nil, ErrCryptoPAnKeySize
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAn{block: block}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+func (c *CryptoPAn) Anonymize(addr netip.Addr) netip.Addr {
+	orig := addr.AsSlice()
+	bits := len(orig) * 8
+	var input, output [aes.BlockSize]byte
+	anon := make([]byte, len(orig))
+	for pos := 0; pos < bits; pos++ {
+		// the first pos bits of the address, then the pad
+		input = c.pad
+		whole := pos / 8
+		copy(input[:whole], orig[:whole])
+		if rem := pos % 8; rem > 0 {
+			mask := byte(0xff) << (8 - rem)
+			input[whole] = orig[whole]&mask | c.pad[whole]&^mask
+		}
+		c.block.Encrypt(output[:], input[:])
+		anon[pos/8] |= (output[0] >> 7) << (7 - pos%8)
+	}
+	for i := range anon {
+		anon[i] ^= orig[i]
+	}
+	result, _ := netip.AddrFromSlice(anon)
+	return result
+}
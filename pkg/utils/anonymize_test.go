@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateAnonymizer(t *testing.T) {
+	assert := assert.New(t)
+	a := &TruncateAnonymizer{V4Bits: 24, V6Bits: 48}
+	assert.Equal(netip.MustParseAddr("192.0.2.0"), a.Anonymize(netip.MustParseAddr("192.0.2.123")))
+	assert.Equal(netip.MustParseAddr("2001:db8:1::"), a.Anonymize(netip.MustParseAddr("2001:db8:1:2::5")))
+}
+
+func TestHMACAnonymizer(t *testing.T) {
+	assert := assert.New(t)
+	addr, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	a := NewHMACAnonymizer([]byte("secret"), time.Hour)
+	anon := a.Anonymize(addr)
+	assert.True(anon.Is4())
+	assert.NotEqual(addr, anon)
+	assert.Equal(anon, a.Anonymize(addr))
+	assert.True(a.Anonymize(other).Is6())
+
+	// instances sharing the secret agree, the key changes with the period
+	b := NewHMACAnonymizer([]byte("secret"), time.Hour)
+	assert.Equal(anon, b.Anonymize(addr))
+	now := time.Now()
+	assert.Equal(b.currentKey(now), b.currentKey(now))
+	assert.NotEqual(b.currentKey(now), b.currentKey(now.Add(time.Hour)))
+
+	// random keys
+	assert.NotEqual(anon, NewHMACAnonymizer(nil, 0).Anonymize(addr))
+}
+
+func TestCryptoPAn(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewCryptoPAn([]byte("short"))
+	assert.Equal(ErrCryptoPAnKeySize, err)
+
+	// test vectors of the reference implementation
+	c, err := NewCryptoPAn([]byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16,
+		216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2})
+	assert.NoError(err)
+	for orig, anon := range map[string]string{
+		"128.11.68.132":   "135.242.180.132",
+		"129.118.74.4":    "134.136.186.123",
+		"130.132.252.244": "133.68.164.234",
+		"141.223.7.43":    "141.167.8.160",
+		"141.233.145.108": "141.129.237.235",
+		"152.163.225.39":  "151.140.114.167",
+		"156.29.3.236":    "147.225.12.42",
+		"165.247.96.84":   "162.9.99.234",
+		"166.107.77.190":  "160.132.178.185",
+		"192.102.249.13":  "252.138.62.131",
+	} {
+		assert.Equal(netip.MustParseAddr(anon), c.Anonymize(netip.MustParseAddr(orig)), orig)
+	}
+
+	// the prefixes are preserved for ipv6 too
+	a1 := c.Anonymize(netip.MustParseAddr("2001:db8:1:2::1")).As16()
+	a2 := c.Anonymize(netip.MustParseAddr("2001:db8:1:3::1")).As16()
+	assert.Equal(a1[:7], a2[:7])
+	assert.NotEqual(a1[7], a2[7])
+}
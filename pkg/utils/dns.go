@@ -152,6 +152,9 @@ func DeepCopyAddr(addr net.Addr) net.Addr {
 			Name: addr.Name,
 			Net:  addr.Net,
 		}
+	case *UnixPeerAddr:
+		peer := *addr
+		return &peer
 	case *net.IPAddr:
 		return &net.IPAddr{
 			IP:   append([]byte(nil), addr.IP...),
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// pcapng block types and options
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngOptionEnd        = 0
+	pcapngOptionTSResol    = 9
+	pcapngTSResolNanosecs  = 9
+	pcapngLinkTypeRaw      = 101 // raw IPv4 or IPv6 packets
+	pcapngSectionUnbounded = 0xFFFFFFFFFFFFFFFF
+)
+
+// IP protocols of the synthetic packets.
+const (
+	IPProtoTCP = 6
+	IPProtoUDP = 17
+)
+
+var (
+	ErrPacketTooLarge  = errors.New("packet too large")
+	ErrAddressFamilies = errors.New("source and destination address families differ")
+)
+
+// PcapngHeader returns the start of a pcapng file: a section header and an
+// interface of raw IP packets with nanosecond timestamps.
+func PcapngHeader() []byte {
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, pcapngSectionHeader)
+	b = binary.LittleEndian.AppendUint32(b, 28)
+	b = binary.LittleEndian.AppendUint32(b, pcapngByteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1) // version 1.0
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, pcapngSectionUnbounded)
+	b = binary.LittleEndian.AppendUint32(b, 28)
+
+	b = binary.LittleEndian.AppendUint32(b, pcapngInterface)
+	b = binary.LittleEndian.AppendUint32(b, 32)
+	b = binary.LittleEndian.AppendUint16(b, pcapngLinkTypeRaw)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	b = binary.LittleEndian.AppendUint32(b, 0) // no snap length
+	b = binary.LittleEndian.AppendUint16(b, pcapngOptionTSResol)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = append(b, pcapngTSResolNanosecs, 0, 0, 0)
+	b = binary.LittleEndian.AppendUint16(b, pcapngOptionEnd)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	return binary.LittleEndian.AppendUint32(b, 32)
+}
+
+// AppendPcapngPacket appends an enhanced packet block of the interface of
+// PcapngHeader.
+func AppendPcapngPacket(b []byte, ts time.Time, packet []byte) []byte {
+	padded := (len(packet) + 3) &^ 3
+	size := uint32(32 + padded)
+	nanos := uint64(ts.UnixNano())
+	b = binary.LittleEndian.AppendUint32(b, pcapngEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, size)
+	b = binary.LittleEndian.AppendUint32(b, 0) // interface
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(nanos))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(packet)))
+	b = append(b, packet...)
+	b = append(b, make([]byte, padded-len(packet))...)
+	return binary.LittleEndian.AppendUint32(b, size)
+}
+
+// AppendUDPPacket appends an IP packet carrying the payload in a UDP datagram.
+func AppendUDPPacket(b []byte, src, dst netip.AddrPort, payload []byte) ([]byte, error) {
+	var udp [8]byte
+	binary.BigEndian.PutUint16(udp[0:], src.Port())
+	binary.BigEndian.PutUint16(udp[2:], dst.Port())
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)+len(payload)))
+	return appendIPPacket(b, IPProtoUDP, src, dst, udp[:], payload)
+}
+
+// AppendTCPPacket appends an IP packet carrying the payload in a TCP segment
+// with the PSH and ACK flags.
+func AppendTCPPacket(b []byte, src, dst netip.AddrPort, seq, ack uint32, payload []byte) ([]byte, error) {
+	var tcp [20]byte
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4              // data offset
+	tcp[13] = 0x18                // PSH, ACK
+	tcp[14], tcp[15] = 0xff, 0xff // window
+	return appendIPPacket(b, IPProtoTCP, src, dst, tcp[:], payload)
+}
+
+// appendIPPacket appends the IP header and the transport header, with their
+// checksums, followed by the payload.
+func appendIPPacket(b []byte, proto byte, src, dst netip.AddrPort, transport, payload []byte) ([]byte, error) {
+	srcIP, dstIP := src.Addr(), dst.Addr()
+	if srcIP.Is4() != dstIP.Is4() {
+		return b, ErrAddressFamilies
+	}
+	length := len(transport) + len(payload)
+	if length > 0xffff-20 {
+		return b, ErrPacketTooLarge
+	}
+	start := len(b)
+	if srcIP.Is4() {
+		b = append(b, 0x45, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(20+length))
+		b = append(b, 0, 0, 0x40, 0, 64, proto, 0, 0) // don't fragment, ttl 64
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+		binary.BigEndian.PutUint16(b[start+10:], ^foldChecksum(checksum(0, b[start:])))
+	} else {
+		b = append(b, 0x60, 0, 0, 0)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+		b = append(b, proto, 64)
+		b = append(b, srcIP.AsSlice()...)
+		b = append(b, dstIP.AsSlice()...)
+	}
+	offset := len(b)
+	b = append(b, transport...)
+	b = append(b, payload...)
+
+	// the pseudo header
+	sum := checksum(0, srcIP.AsSlice())
+	sum = checksum(sum, dstIP.AsSlice())
+	sum += uint32(proto) + uint32(length)
+	sum = checksum(sum, b[offset:])
+	csum := ^foldChecksum(sum)
+	if csum == 0 && proto == IPProtoUDP {
+		csum = 0xffff
+	}
+	csumOffset := 16
+	if proto == IPProtoUDP {
+		csumOffset = 6
+	}
+	binary.BigEndian.PutUint16(b[offset+csumOffset:], csum)
+	return b, nil
+}
+
+// checksum adds the 16 bits words of b to the internet checksum sum.
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return uint32(foldChecksum(sum))
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPcapngBlocks(t *testing.T) {
+	assert := assert.New(t)
+	header := PcapngHeader()
+	assert.Len(header, 60)
+	assert.Equal(uint32(pcapngSectionHeader), binary.LittleEndian.Uint32(header))
+	assert.Equal(uint32(pcapngByteOrderMagic), binary.LittleEndian.Uint32(header[8:]))
+	assert.Equal(uint32(pcapngInterface), binary.LittleEndian.Uint32(header[28:]))
+	assert.Equal(uint16(pcapngLinkTypeRaw), binary.LittleEndian.Uint16(header[36:]))
+
+	ts := time.Unix(1700000000, 123456789)
+	block := AppendPcapngPacket(nil, ts, []byte{1, 2, 3, 4, 5})
+	assert.Len(block, 40)
+	assert.Equal(uint32(40), binary.LittleEndian.Uint32(block[4:]))
+	assert.Equal(uint32(40), binary.LittleEndian.Uint32(block[36:]))
+	nanos := uint64(binary.LittleEndian.Uint32(block[12:]))<<32 | uint64(binary.LittleEndian.Uint32(block[16:]))
+	assert.Equal(uint64(ts.UnixNano()), nanos)
+	assert.Equal(uint32(5), binary.LittleEndian.Uint32(block[20:]))
+	assert.Equal([]byte{1, 2, 3, 4, 5, 0, 0, 0}, block[28:36])
+}
+
+func TestSyntheticPackets(t *testing.T) {
+	assert := assert.New(t)
+	payload := []byte("dns message")
+
+	src, dst := netip.MustParseAddrPort("192.0.2.1:5353"), netip.MustParseAddrPort("192.0.2.53:53")
+	p, err := AppendUDPPacket(nil, src, dst, payload)
+	assert.NoError(err)
+	assert.Len(p, 20+8+len(payload))
+	assert.Equal(byte(0x45), p[0])
+	assert.Equal(uint16(len(p)), binary.BigEndian.Uint16(p[2:]))
+	assert.Equal(byte(IPProtoUDP), p[9])
+	assert.Equal(uint16(0xffff), foldChecksum(checksum(0, p[:20])))
+	assert.Equal(uint16(5353), binary.BigEndian.Uint16(p[20:]))
+	assert.Equal(uint16(53), binary.BigEndian.Uint16(p[22:]))
+	assert.Equal(uint16(0xffff), transportChecksum(p[12:16], p[16:20], IPProtoUDP, p[20:]))
+	assert.Equal(payload, p[28:])
+
+	src, dst = netip.MustParseAddrPort("[2001:db8::1]:40000"), netip.MustParseAddrPort("[2001:db8::53]:53")
+	p, err = AppendTCPPacket(nil, src, dst, 1, 100, payload)
+	assert.NoError(err)
+	assert.Len(p, 40+20+len(payload))
+	assert.Equal(byte(0x60), p[0])
+	assert.Equal(uint16(20+len(payload)), binary.BigEndian.Uint16(p[4:]))
+	assert.Equal(byte(IPProtoTCP), p[6])
+	assert.Equal(uint32(1), binary.BigEndian.Uint32(p[44:]))
+	assert.Equal(uint32(100), binary.BigEndian.Uint32(p[48:]))
+	assert.Equal(uint16(0xffff), transportChecksum(p[8:24], p[24:40], IPProtoTCP, p[40:]))
+
+	_, err = AppendUDPPacket(nil, netip.MustParseAddrPort("192.0.2.1:53"), dst, payload)
+	assert.ErrorIs(err, ErrAddressFamilies)
+	_, err = AppendUDPPacket(nil, src, dst, make([]byte, 0x10000))
+	assert.ErrorIs(err, ErrPacketTooLarge)
+}
+
+// transportChecksum sums the segment with its pseudo header, 0xffff when valid.
+func transportChecksum(src, dst []byte, proto byte, segment []byte) uint16 {
+	sum := checksum(0, src)
+	sum = checksum(sum, dst)
+	sum += uint32(proto) + uint32(len(segment))
+	return foldChecksum(checksum(sum, segment))
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Path MTU discovery modes for udp sockets.
+// see: https://github.com/PowerDNS/pdns/issues/7619
+const (
+	// PMTUDefault leaves the system setting.
+	PMTUDefault = "default"
+	// PMTUOmit sends without DF and ignores the path MTU learned from ICMP, so
+	// forged ICMP messages can't force responses into fragments.
+	PMTUOmit = "omit"
+	// PMTUDont sends without DF.
+	PMTUDont = "dont"
+	// PMTUDo always sets DF, datagrams larger than the path MTU are not sent.
+	PMTUDo = "do"
+)
+
+var ErrPMTUUnsupported = errors.New("path MTU discovery mode is not supported on this platform")
+
+func ValidPMTUMode(mode string) error {
+	switch mode {
+	case PMTUDefault, PMTUOmit, PMTUDont, PMTUDo:
+		return nil
+	}
+	return fmt.Errorf("invalid path MTU discovery mode: %v", mode)
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package utils
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+var (
+	pmtuModesV4 = map[string]int{PMTUOmit: unix.IP_PMTUDISC_OMIT, PMTUDont: unix.IP_PMTUDISC_DONT, PMTUDo: unix.IP_PMTUDISC_DO}
+	pmtuModesV6 = map[string]int{PMTUOmit: unix.IPV6_PMTUDISC_OMIT, PMTUDont: unix.IPV6_PMTUDISC_DONT, PMTUDo: unix.IPV6_PMTUDISC_DO}
+)
+
+// SetPMTUDiscovery sets the path MTU discovery mode of a udp socket. Both the IPv4
+// and IPv6 options are set, a dual-stack socket uses the IPv4 one for mapped addresses.
+func SetPMTUDiscovery(fd uintptr, mode string) error {
+	if err := ValidPMTUMode(mode); err != nil || mode == PMTUDefault {
+		return err
+	}
+	err4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, pmtuModesV4[mode])
+	err6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, pmtuModesV6[mode])
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// GetPMTUDiscovery returns the IPv4 and IPv6 path MTU discovery modes of a socket, -1 when not set.
+func GetPMTUDiscovery(fd uintptr) (v4 int, v6 int) {
+	var err error
+	if v4, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER); err != nil {
+		v4 = -1
+	}
+	if v6, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER); err != nil {
+		v6 = -1
+	}
+	return
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestValidPMTUMode(t *testing.T) {
+	assert := assert.New(t)
+	for _, mode := range []string{PMTUDefault, PMTUOmit, PMTUDont, PMTUDo} {
+		assert.NoError(ValidPMTUMode(mode))
+	}
+	assert.Error(ValidPMTUMode("probe"))
+	assert.Error(SetPMTUDiscovery(0, "probe"))
+}
+
+func TestSetPMTUDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		conn, err := net.ListenPacket("udp", addr)
+		if !assert.NoError(err) {
+			continue
+		}
+		raw, _ := conn.(*net.UDPConn).SyscallConn()
+		raw.Control(func(fd uintptr) {
+			assert.NoError(SetPMTUDiscovery(fd, PMTUOmit))
+			v4, v6 := GetPMTUDiscovery(fd)
+			if addr[0] == '[' {
+				assert.Equal(unix.IPV6_PMTUDISC_OMIT, v6)
+			} else {
+				assert.Equal(unix.IP_PMTUDISC_OMIT, v4)
+			}
+
+			assert.NoError(SetPMTUDiscovery(fd, PMTUDo))
+			v4, v6 = GetPMTUDiscovery(fd)
+			if addr[0] == '[' {
+				assert.Equal(unix.IPV6_PMTUDISC_DO, v6)
+			} else {
+				assert.Equal(unix.IP_PMTUDISC_DO, v4)
+			}
+		})
+		conn.Close()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package utils
+
+// SetPMTUDiscovery sets the path MTU discovery mode of a udp socket, only the
+// default mode is supported on this platform.
+func SetPMTUDiscovery(fd uintptr, mode string) error {
+	if err := ValidPMTUMode(mode); err != nil || mode == PMTUDefault {
+		return err
+	}
+	return ErrPMTUUnsupported
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"net/netip"
+)
+
+// PrefixTrie is a binary trie of ip prefixes, with separate roots for IPv4 and IPv6.
+// Lookups walk at most one node per bit of the address.
+type PrefixTrie[T any] struct {
+	v4, v6 *trieNode[T]
+	size   int
+}
+
+type trieNode[T any] struct {
+	children [2]*trieNode[T]
+	values   []T
+}
+
+func NewPrefixTrie[T any]() *PrefixTrie[T] {
+	return &PrefixTrie[T]{v4: &trieNode[T]{}, v6: &trieNode[T]{}}
+}
+
+// Insert adds the value for the prefix, a prefix may hold multiple values.
+func (t *PrefixTrie[T]) Insert(prefix netip.Prefix, val T) {
+	prefix = prefix.Masked()
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+	for i := 0; i < bits; i++ {
+		b := bitAt(bytes, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode[T]{}
+		}
+		node = node.children[b]
+	}
+	node.values = append(node.values, val)
+	t.size++
+}
+
+// Match calls fn for the values of every prefix containing the address, from the
+// shortest prefix to the longest, until fn returns false.
+func (t *PrefixTrie[T]) Match(addr netip.Addr, fn func(T) bool) {
+	if !addr.IsValid() {
+		return
+	}
+	addr = addr.Unmap()
+	node := t.root(addr)
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		for _, v := range node.values {
+			if !fn(v) {
+				return
+			}
+		}
+		if i >= len(bytes)*8 {
+			return
+		}
+		node = node.children[bitAt(bytes, i)]
+	}
+}
+
+// Contains reports if any prefix in the trie contains the address.
+func (t *PrefixTrie[T]) Contains(addr netip.Addr) bool {
+	found := false
+	t.Match(addr, func(T) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// Len is the number of values in the trie.
+func (t *PrefixTrie[T]) Len() int {
+	return t.size
+}
+
+func (t *PrefixTrie[T]) root(addr netip.Addr) *trieNode[T] {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+func bitAt(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixTrieMatch(t *testing.T) {
+	assert := assert.New(t)
+	trie := NewPrefixTrie[string]()
+	trie.Insert(netip.MustParsePrefix("0.0.0.0/0"), "any4")
+	trie.Insert(netip.MustParsePrefix("10.0.0.0/8"), "ten")
+	trie.Insert(netip.MustParsePrefix("10.1.0.0/16"), "ten-one")
+	trie.Insert(netip.MustParsePrefix("10.1.2.3/32"), "host")
+	trie.Insert(netip.MustParsePrefix("2001:db8::/32"), "doc6")
+	trie.Insert(netip.MustParsePrefix("::ffff:192.0.2.0/120"), "mapped")
+	assert.Equal(6, trie.Len())
+
+	match := func(addr string) []string {
+		found := []string{}
+		trie.Match(netip.MustParseAddr(addr), func(v string) bool {
+			found = append(found, v)
+			return true
+		})
+		return found
+	}
+	assert.Equal([]string{"any4", "ten", "ten-one", "host"}, match("10.1.2.3"))
+	assert.Equal([]string{"any4", "ten"}, match("10.2.0.1"))
+	assert.Equal([]string{"any4", "ten", "ten-one"}, match("::ffff:10.1.9.9"))
+	assert.Equal([]string{"any4", "mapped"}, match("192.0.2.55"))
+	assert.Equal([]string{"doc6"}, match("2001:db8::1"))
+	assert.Empty(match("2001:db9::1"))
+
+	assert.True(trie.Contains(netip.MustParseAddr("2001:db8:ffff::1")))
+	assert.False(trie.Contains(netip.MustParseAddr("::1")))
+
+	// stops when asked
+	count := 0
+	trie.Match(netip.MustParseAddr("10.1.2.3"), func(string) bool {
+		count++
+		return false
+	})
+	assert.Equal(1, count)
+}
@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PROXY protocol support, see: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var (
+	ErrNoProxyHeader         = errors.New("no proxy protocol header")
+	ErrProxyHeaderIncomplete = errors.New("incomplete proxy protocol header")
+	ErrInvalidProxyHeader    = errors.New("invalid proxy protocol header")
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+)
+
+// ProxyHeader is a decoded PROXY protocol header.
+// Source and Destination are nil for LOCAL (v2) and UNKNOWN (v1) connections.
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ParseProxyHeader parses a PROXY protocol v1 or v2 header at the start of buf and
+// returns the number of bytes it used. ErrProxyHeaderIncomplete is returned when
+// more data is needed and ErrNoProxyHeader when buf doesn't start with a header.
+func ParseProxyHeader(buf []byte) (*ProxyHeader, int, error) {
+	switch {
+	case hasPrefixOrIsPrefix(buf, proxyV2Signature):
+		if len(buf) < proxyV2HeaderLen {
+			return nil, 0, ErrProxyHeaderIncomplete
+		}
+		return parseProxyV2(buf)
+	case hasPrefixOrIsPrefix(buf, proxyV1Prefix):
+		if len(buf) < len(proxyV1Prefix) {
+			return nil, 0, ErrProxyHeaderIncomplete
+		}
+		return parseProxyV1(buf)
+	default:
+		return nil, 0, ErrNoProxyHeader
+	}
+}
+
+func hasPrefixOrIsPrefix(buf, prefix []byte) bool {
+	if len(buf) < len(prefix) {
+		return bytes.HasPrefix(prefix, buf)
+	}
+	return bytes.HasPrefix(buf, prefix)
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1(buf []byte) (*ProxyHeader, int, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= proxyV1MaxLen {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		return nil, 0, ErrProxyHeaderIncomplete
+	}
+	if end+2 > proxyV1MaxLen {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	hdr := &ProxyHeader{Version: 1}
+	fields := strings.Split(string(buf[:end]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return hdr, end + 2, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, 0, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr.Source, hdr.Destination = src, dst
+	return hdr, end + 2, nil
+}
+
+func parseProxyV1Addr(ip, port string, v4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != v4 {
+		return nil, fmt.Errorf("%w: address %v", ErrInvalidProxyHeader, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: port %v", ErrInvalidProxyHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamInet  = 0x1
+	proxyV2FamInet6 = 0x2
+
+	proxyV2ProtoStream = 0x1
+	proxyV2ProtoDgram  = 0x2
+)
+
+func parseProxyV2(buf []byte) (*ProxyHeader, int, error) {
+	verCmd, famProto := buf[12], buf[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, ErrInvalidProxyHeader
+	}
+	total := proxyV2HeaderLen + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < total {
+		return nil, 0, ErrProxyHeaderIncomplete
+	}
+	hdr := &ProxyHeader{Version: 2}
+	switch verCmd & 0xf {
+	case proxyV2CmdLocal:
+		return hdr, total, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, 0, ErrInvalidProxyHeader
+	}
+
+	payload := buf[proxyV2HeaderLen:total]
+	var src, dst netip.Addr
+	var ports []byte
+	switch famProto >> 4 {
+	case proxyV2FamInet:
+		if len(payload) < 12 {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		src = netip.AddrFrom4([4]byte(payload[0:4]))
+		dst = netip.AddrFrom4([4]byte(payload[4:8]))
+		ports = payload[8:12]
+	case proxyV2FamInet6:
+		if len(payload) < 36 {
+			return nil, 0, ErrInvalidProxyHeader
+		}
+		src = netip.AddrFrom16([16]byte(payload[0:16]))
+		dst = netip.AddrFrom16([16]byte(payload[16:32]))
+		ports = payload[32:36]
+	default:
+		// AF_UNSPEC & AF_UNIX carry no usable client address
+		return hdr, total, nil
+	}
+	srcAddr := netip.AddrPortFrom(src, binary.BigEndian.Uint16(ports[0:2]))
+	dstAddr := netip.AddrPortFrom(dst, binary.BigEndian.Uint16(ports[2:4]))
+
+	switch famProto & 0xf {
+	case proxyV2ProtoStream:
+		hdr.Source, hdr.Destination = net.TCPAddrFromAddrPort(srcAddr), net.TCPAddrFromAddrPort(dstAddr)
+	case proxyV2ProtoDgram:
+		hdr.Source, hdr.Destination = net.UDPAddrFromAddrPort(srcAddr), net.UDPAddrFromAddrPort(dstAddr)
+	}
+	return hdr, total, nil
+}
+
+// ProxyListener wraps a stream listener (tcp or tls) and decodes a PROXY protocol
+// header sent by the trusted sources. The header is optional, connections without
+// it keep their peer address. When Trusted is empty no source is trusted.
+type ProxyListener struct {
+	net.Listener
+	Trusted []netip.Prefix
+}
+
+func (l *ProxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !IsTrustedAddr(c.RemoteAddr(), l.Trusted) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// IsTrustedAddr reports if addr is in one of the prefixes, an empty list trusts nothing.
+func IsTrustedAddr(addr net.Addr, trusted []netip.Prefix) bool {
+	ip, ok := AddrToNetIP(addr)
+	if !ok {
+		return false
+	}
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reads the PROXY header on the first Read, RemoteAddr reports the
+// decoded source address after that.
+type proxyConn struct {
+	net.Conn
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	pending    []byte
+}
+
+// IsProxyConn reports a connection of a ProxyListener expecting a PROXY
+// header, its RemoteAddr is the decoded source after the first Read.
+func IsProxyConn(c net.Conn) bool {
+	_, ok := c.(*proxyConn)
+	return ok
+}
+
+func (c *proxyConn) readHeader() {
+	buf := make([]byte, 0, 256)
+	tmp := make([]byte, 256)
+	for {
+		n, err := c.Conn.Read(tmp)
+		buf = append(buf, tmp[:n]...)
+		hdr, used, perr := ParseProxyHeader(buf)
+		switch {
+		case perr == nil:
+			if hdr.Source != nil {
+				c.remoteAddr = hdr.Source
+			}
+			c.pending = buf[used:]
+			return
+		case errors.Is(perr, ErrNoProxyHeader):
+			c.pending = buf
+			return
+		case !errors.Is(perr, ErrProxyHeaderIncomplete):
+			c.err = perr
+			return
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// AddrToNetIP returns the ip of a udp, tcp or ip address.
+func AddrToNetIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		return netip.Addr{}, false
+	}
+	nip, ok := netip.AddrFromSlice(ip)
+	return nip.Unmap(), ok
+}
+
+// ParsePrefixes parses CIDRs, a plain address is treated as a single host prefix.
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			addr, err := netip.ParseAddr(c)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
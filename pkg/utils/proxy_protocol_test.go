@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(cmd, famProto byte, addrs []byte) []byte {
+	buf := append([]byte{}, proxyV2Signature...)
+	buf = append(buf, 0x20|cmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(addrs)))
+	return append(buf, addrs...)
+}
+
+func TestParseProxyHeaderV1(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 53\r\nquery")
+	hdr, n, err := ParseProxyHeader(buf)
+	assert.NoError(err)
+	assert.Equal(1, hdr.Version)
+	assert.Equal("192.168.0.1:56324", hdr.Source.String())
+	assert.Equal("192.168.0.11:53", hdr.Destination.String())
+	assert.Equal("query", string(buf[n:]))
+
+	hdr, _, err = ParseProxyHeader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 53\r\n"))
+	assert.NoError(err)
+	assert.Equal("[2001:db8::1]:4000", hdr.Source.String())
+
+	hdr, n, err = ParseProxyHeader([]byte("PROXY UNKNOWN\r\n"))
+	assert.NoError(err)
+	assert.Nil(hdr.Source)
+	assert.Equal(15, n)
+
+	_, _, err = ParseProxyHeader([]byte("PROXY TCP4 192.168.0.1"))
+	assert.ErrorIs(err, ErrProxyHeaderIncomplete)
+	_, _, err = ParseProxyHeader([]byte("PRO"))
+	assert.ErrorIs(err, ErrProxyHeaderIncomplete)
+	_, _, err = ParseProxyHeader([]byte("PROXY TCP4 2001:db8::1 192.168.0.11 56324 53\r\n"))
+	assert.ErrorIs(err, ErrInvalidProxyHeader)
+	_, _, err = ParseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 99999 53\r\n"))
+	assert.ErrorIs(err, ErrInvalidProxyHeader)
+}
+
+func TestParseProxyHeaderV2(t *testing.T) {
+	assert := assert.New(t)
+
+	addrs := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x10, 0x00, 0x00, 0x35}
+	buf := append(proxyV2Header(proxyV2CmdProxy, 0x11, addrs), 0xab)
+	hdr, n, err := ParseProxyHeader(buf)
+	assert.NoError(err)
+	assert.Equal(2, hdr.Version)
+	assert.Equal("tcp", hdr.Source.Network())
+	assert.Equal("10.0.0.1:4096", hdr.Source.String())
+	assert.Equal("10.0.0.2:53", hdr.Destination.String())
+	assert.Equal([]byte{0xab}, buf[n:])
+
+	addrs = make([]byte, 36)
+	addrs[15], addrs[31], addrs[35] = 1, 2, 53
+	hdr, _, err = ParseProxyHeader(proxyV2Header(proxyV2CmdProxy, 0x22, addrs))
+	assert.NoError(err)
+	assert.Equal("udp", hdr.Source.Network())
+	assert.Equal("[::1]:0", hdr.Source.String())
+	assert.Equal("[::2]:53", hdr.Destination.String())
+
+	hdr, n, err = ParseProxyHeader(proxyV2Header(proxyV2CmdLocal, 0x00, nil))
+	assert.NoError(err)
+	assert.Nil(hdr.Source)
+	assert.Equal(16, n)
+
+	full := proxyV2Header(proxyV2CmdProxy, 0x11, []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x10, 0x00, 0x00, 0x35})
+	_, _, err = ParseProxyHeader(full[:20])
+	assert.ErrorIs(err, ErrProxyHeaderIncomplete)
+	_, _, err = ParseProxyHeader(full[:5])
+	assert.ErrorIs(err, ErrProxyHeaderIncomplete)
+
+	_, _, err = ParseProxyHeader(proxyV2Header(proxyV2CmdProxy, 0x11, []byte{1, 2, 3}))
+	assert.ErrorIs(err, ErrInvalidProxyHeader)
+	_, _, err = ParseProxyHeader(proxyV2Header(0x5, 0x11, nil))
+	assert.ErrorIs(err, ErrInvalidProxyHeader)
+
+	_, _, err = ParseProxyHeader([]byte{0x00, 0x1c, 0xab, 0xcd})
+	assert.ErrorIs(err, ErrNoProxyHeader)
+}
+
+func TestProxyListener(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	pl := &ProxyListener{Listener: ln, Trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	defer pl.Close()
+
+	for _, tc := range []struct {
+		send   string
+		remote string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 1234 53\r\nhello", "192.0.2.1:1234"},
+		{"hello", ""},
+	} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		assert.NoError(err)
+		_, err = client.Write([]byte(tc.send))
+		assert.NoError(err)
+		client.Close()
+
+		conn, err := pl.Accept()
+		assert.NoError(err)
+		data, err := io.ReadAll(conn)
+		assert.NoError(err)
+		assert.Equal("hello", string(data))
+		if tc.remote != "" {
+			assert.Equal(tc.remote, conn.RemoteAddr().String())
+		} else {
+			assert.Equal(client.LocalAddr().String(), conn.RemoteAddr().String())
+		}
+		conn.Close()
+	}
+}
+
+func TestIsTrustedAddr(t *testing.T) {
+	assert := assert.New(t)
+
+	prefixes, err := ParsePrefixes([]string{"10.0.0.0/8", "2001:db8::1"})
+	assert.NoError(err)
+	assert.True(IsTrustedAddr(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, prefixes))
+	assert.True(IsTrustedAddr(&net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, prefixes))
+	assert.False(IsTrustedAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, prefixes))
+	assert.False(IsTrustedAddr(&net.UnixAddr{Name: "sock"}, prefixes))
+	assert.False(IsTrustedAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, nil))
+
+	_, err = ParsePrefixes([]string{"10.0.0.0/33"})
+	assert.Error(err)
+	_, err = ParsePrefixes([]string{"not-an-ip"})
+	assert.Error(err)
+}
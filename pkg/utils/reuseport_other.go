@@ -0,0 +1,8 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package utils
+
+// SetReusePort is a no-op on this platform, the sockets keep their default behaviour.
+func SetReusePort(fd uintptr) error {
+	return nil
+}
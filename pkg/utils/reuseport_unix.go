@@ -0,0 +1,16 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package utils
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SetReusePort sets SO_REUSEPORT and SO_REUSEADDR, so several sockets or processes
+// can listen on the same address.
+func SetReusePort(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
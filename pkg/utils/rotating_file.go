@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file renamed to path.1, path.2... once it reaches
+// MaxSize, up to MaxBackups old files are kept. Header and Footer are written
+// at the start and the end of every file, a write is never split across files.
+// A non-empty file found when opening is rotated first. With Compress the old
+// files are gzipped to path.1.gz, path.2.gz... in the background.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64 // 0 never rotates
+	MaxBackups int
+	Header     []byte
+	Footer     []byte
+	Compress   bool
+
+	mutex       sync.Mutex
+	file        *os.File
+	size        int64
+	compressing sync.WaitGroup
+}
+
+// Open the file, rotating a previous one.
+func (f *RotatingFile) Open() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file != nil {
+		return nil
+	}
+	if fi, err := os.Stat(f.Path); err == nil && fi.Size() > 0 {
+		if err := f.shift(); err != nil {
+			return err
+		}
+	}
+	return f.create()
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, fs.ErrClosed
+	}
+	if f.MaxSize > 0 && f.size > int64(len(f.Header)) && f.size+int64(len(p)+len(f.Footer)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file and starts a new one.
+func (f *RotatingFile) Rotate() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return fs.ErrClosed
+	}
+	return f.rotate()
+}
+
+// Close writes the footer and closes the file, once the old file is compressed.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.close()
+	f.compressing.Wait()
+	return err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.close(); err != nil {
+		return err
+	}
+	if err := f.shift(); err != nil {
+		return err
+	}
+	return f.create()
+}
+
+func (f *RotatingFile) create() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	f.file, f.size = file, 0
+	if len(f.Header) > 0 {
+		n, err := file.Write(f.Header)
+		f.size += int64(n)
+		return err
+	}
+	return nil
+}
+
+func (f *RotatingFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+	var err error
+	if len(f.Footer) > 0 {
+		_, err = f.file.Write(f.Footer)
+	}
+	err = errors.Join(err, f.file.Close())
+	f.file = nil
+	return err
+}
+
+// shift renames path.N-1 to path.N ... path to path.1, the oldest backup is removed.
+func (f *RotatingFile) shift() error {
+	// the previous file must be compressed before it's renamed
+	f.compressing.Wait()
+	if f.MaxBackups <= 0 {
+		return os.Remove(f.Path)
+	}
+	os.Remove(f.backupPath(f.MaxBackups))
+	for i := f.MaxBackups - 1; i > 0; i-- {
+		if err := os.Rename(f.backupPath(i), f.backupPath(i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if !f.Compress {
+		return os.Rename(f.Path, f.backupPath(1))
+	}
+	uncompressed := fmt.Sprintf("%s.%d", f.Path, 1)
+	if err := os.Rename(f.Path, uncompressed); err != nil {
+		return err
+	}
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+		gzipFile(uncompressed, f.backupPath(1))
+	}()
+	return nil
+}
+
+func (f *RotatingFile) backupPath(n int) string {
+	if f.Compress {
+		return fmt.Sprintf("%s.%d.gz", f.Path, n)
+	}
+	return fmt.Sprintf("%s.%d", f.Path, n)
+}
+
+// gzipFile compresses src to dst and removes src, src is kept on errors.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	err = errors.Join(err, zw.Close(), out.Close())
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
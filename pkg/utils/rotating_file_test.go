@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "log")
+	assert.NoError(os.WriteFile(path, []byte("previous run"), 0o644))
+
+	f := &RotatingFile{Path: path, MaxSize: 20, MaxBackups: 2, Header: []byte("<"), Footer: []byte(">")}
+	assert.NoError(f.Open())
+	for _, w := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd", "eeeeeeee"} {
+		n, err := f.Write([]byte(w))
+		assert.NoError(err)
+		assert.Equal(len(w), n)
+	}
+	assert.NoError(f.Close())
+	_, err := f.Write([]byte("closed"))
+	assert.Error(err)
+
+	read := func(p string) string {
+		b, _ := os.ReadFile(p)
+		return string(b)
+	}
+	// writes are never split across the files
+	assert.Equal("<eeeeeeee>", read(path))
+	assert.Equal("<ccccccccdddddddd>", read(path+".1"))
+	assert.Equal("<aaaaaaaabbbbbbbb>", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "log")
+	f := &RotatingFile{Path: path}
+	assert.NoError(f.Open())
+	f.Write([]byte("first"))
+	assert.NoError(f.Rotate())
+	f.Write([]byte("second"))
+	assert.NoError(f.Close())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("second", string(b))
+	_, err = os.Stat(path + ".1")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "log")
+	f := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 2, Compress: true}
+	assert.NoError(f.Open())
+	for _, w := range []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"} {
+		_, err := f.Write([]byte(w))
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+
+	gunzip := func(p string) string {
+		file, err := os.Open(p)
+		if !assert.NoError(err) {
+			return ""
+		}
+		defer file.Close()
+		zr, err := gzip.NewReader(file)
+		if !assert.NoError(err) {
+			return ""
+		}
+		b, _ := io.ReadAll(zr)
+		return string(b)
+	}
+	b, _ := os.ReadFile(path)
+	assert.Equal("dddddddd", string(b))
+	assert.Equal("cccccccc", gunzip(path+".1.gz"))
+	assert.Equal("bbbbbbbb", gunzip(path+".2.gz"))
+	for _, p := range []string{path + ".1", path + ".3.gz"} {
+		_, err := os.Stat(p)
+		assert.True(os.IsNotExist(err), p)
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import "sync"
+
+// SeriesCache holds the metrics created by label values, so the hot paths look
+// them up without formatting their names or taking the global metrics lock.
+// The label values must be bounded.
+type SeriesCache[K comparable, V any] struct {
+	mutex  sync.RWMutex
+	series map[K]V
+	create func(K) V
+}
+
+func NewSeriesCache[K comparable, V any](create func(K) V) *SeriesCache[K, V] {
+	return &SeriesCache[K, V]{series: make(map[K]V), create: create}
+}
+
+// Get returns the series of the key, created on the first use.
+func (c *SeriesCache[K, V]) Get(key K) V {
+	c.mutex.RLock()
+	v, ok := c.series[key]
+	c.mutex.RUnlock()
+	if ok {
+		return v
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if v, ok = c.series[key]; !ok {
+		v = c.create(key)
+		c.series[key] = v
+	}
+	return v
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeriesCache(t *testing.T) {
+	assert := assert.New(t)
+	type key struct{ a, b string }
+	created := 0
+	c := NewSeriesCache(func(k key) *string {
+		created++
+		name := k.a + "/" + k.b
+		return &name
+	})
+	first := c.Get(key{"x", "y"})
+	assert.Equal("x/y", *first)
+	assert.Same(first, c.Get(key{"x", "y"}))
+	assert.Equal("x/z", *c.Get(key{"x", "z"}))
+	assert.Equal(2, created)
+	assert.Zero(testing.AllocsPerRun(100, func() { c.Get(key{"x", "y"}) }))
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+)
+
+// TopKEntry is a heavy hitter, its Count overestimates the real count by at most Error.
+type TopKEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// SpaceSaving counts the most frequent keys of a stream in bounded memory with
+// the Space-Saving algorithm (Metwally et al.), the keys counted more than
+// 1/capacity of the stream are always kept.
+type SpaceSaving struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*topKItem
+	heap     topKHeap
+}
+
+type topKItem struct {
+	TopKEntry
+	index int
+}
+
+// topKHeap is a min heap of the counts, the first item is replaced by new keys.
+type topKHeap []*topKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topKHeap) Push(x any) {
+	item := x.(*topKItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *topKHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	capacity = max(capacity, 1)
+	return &SpaceSaving{
+		capacity: capacity,
+		items:    make(map[string]*topKItem, capacity),
+		heap:     make(topKHeap, 0, capacity),
+	}
+}
+
+// Add counts n more occurrences of the key.
+func (s *SpaceSaving) Add(key string, n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item, ok := s.items[key]; ok {
+		item.Count += n
+		heap.Fix(&s.heap, item.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		item := &topKItem{TopKEntry: TopKEntry{Key: key, Count: n}}
+		s.items[key] = item
+		heap.Push(&s.heap, item)
+		return
+	}
+	// the least counted key is replaced, its count is the error of the new one
+	item := s.heap[0]
+	delete(s.items, item.Key)
+	item.Key, item.Error = key, item.Count
+	item.Count += n
+	s.items[key] = item
+	heap.Fix(&s.heap, 0)
+}
+
+// Top returns the k most counted keys, the most counted first.
+func (s *SpaceSaving) Top(k int) []TopKEntry {
+	s.mu.Lock()
+	entries := make([]TopKEntry, 0, len(s.heap))
+	for _, item := range s.heap {
+		entries = append(entries, item.TopKEntry)
+	}
+	s.mu.Unlock()
+	sortTopK(entries)
+	return entries[:min(k, len(entries))]
+}
+
+// Reset removes all the keys.
+func (s *SpaceSaving) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.items)
+	s.heap = s.heap[:0]
+}
+
+func sortTopK(entries []TopKEntry) {
+	slices.SortFunc(entries, func(a, b TopKEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+}
+
+// RollingTopK counts the heavy hitters of a rolling window, split in buckets
+// of Space-Saving summaries. Rotate starts a new bucket and forgets the oldest.
+type RollingTopK struct {
+	mu      sync.RWMutex
+	buckets []*SpaceSaving
+	current int
+}
+
+func NewRollingTopK(capacity, buckets int) *RollingTopK {
+	r := &RollingTopK{buckets: make([]*SpaceSaving, max(buckets, 1))}
+	for i := range r.buckets {
+		r.buckets[i] = NewSpaceSaving(capacity)
+	}
+	return r
+}
+
+// Add counts n more occurrences of the key in the current bucket.
+func (r *RollingTopK) Add(key string, n uint64) {
+	r.mu.RLock()
+	bucket := r.buckets[r.current]
+	r.mu.RUnlock()
+	bucket.Add(key, n)
+}
+
+// Rotate starts a new bucket, the oldest one is reset.
+func (r *RollingTopK) Rotate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = (r.current + 1) % len(r.buckets)
+	r.buckets[r.current].Reset()
+}
+
+// Top returns the k most counted keys of the window, the counts and errors
+// of the buckets are summed.
+func (r *RollingTopK) Top(k int) []TopKEntry {
+	r.mu.RLock()
+	buckets := slices.Clone(r.buckets)
+	r.mu.RUnlock()
+	merged := map[string]TopKEntry{}
+	for _, b := range buckets {
+		for _, e := range b.Top(b.capacity) {
+			m := merged[e.Key]
+			m.Key = e.Key
+			m.Count += e.Count
+			m.Error += e.Error
+			merged[e.Key] = m
+		}
+	}
+	entries := make([]TopKEntry, 0, len(merged))
+	for _, e := range merged {
+		entries = append(entries, e)
+	}
+	sortTopK(entries)
+	return entries[:min(k, len(entries))]
+}
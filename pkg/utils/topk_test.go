@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	assert := assert.New(t)
+	s := NewSpaceSaving(10)
+	// heavy hitters among many rare keys
+	for i := 0; i < 1000; i++ {
+		s.Add("a", 1)
+		if i%2 == 0 {
+			s.Add("b", 1)
+		}
+		s.Add(fmt.Sprintf("rare%d", i), 1)
+	}
+	top := s.Top(2)
+	if assert.Len(top, 2) {
+		assert.Equal("a", top[0].Key)
+		assert.Equal("b", top[1].Key)
+		// the counts are overestimated by at most the error
+		assert.GreaterOrEqual(top[0].Count, uint64(1000))
+		assert.LessOrEqual(top[0].Count-top[0].Error, uint64(1000))
+		assert.LessOrEqual(top[1].Count-top[1].Error, uint64(500))
+	}
+	assert.Len(s.Top(100), 10)
+
+	s.Reset()
+	assert.Empty(s.Top(10))
+	s.Add("x", 3)
+	s.Add("y", 3)
+	assert.Equal([]TopKEntry{{Key: "x", Count: 3}, {Key: "y", Count: 3}}, s.Top(10))
+}
+
+func TestRollingTopK(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRollingTopK(10, 2)
+	r.Add("a", 2)
+	r.Rotate()
+	r.Add("a", 1)
+	r.Add("b", 5)
+	assert.Equal([]TopKEntry{{Key: "b", Count: 5}, {Key: "a", Count: 3}}, r.Top(10))
+	assert.Equal([]TopKEntry{{Key: "b", Count: 5}}, r.Top(1))
+
+	// the first bucket is forgotten
+	r.Rotate()
+	assert.Equal([]TopKEntry{{Key: "b", Count: 5}, {Key: "a", Count: 1}}, r.Top(10))
+	r.Rotate()
+	assert.Empty(r.Top(10))
+}
+
+func BenchmarkSpaceSaving(b *testing.B) {
+	s := NewSpaceSaving(1000)
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("name%d.example.com.", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Add(keys[(i*i)%len(keys)], 1)
+	}
+}
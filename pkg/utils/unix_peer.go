@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrPeerCredentialsUnsupported = errors.New("unix socket peer credentials are not supported on this platform")
+
+// UnixPeerAddr is the address of a unix socket client, identified by the
+// credentials of its process when the platform provides them.
+type UnixPeerAddr struct {
+	Net  string // unix or unixgram
+	Path string // socket path of the client, empty when it isn't bound
+	PID  int    // -1 when unknown
+	UID  int    // -1 when unknown
+	GID  int    // -1 when unknown
+}
+
+// NewUnixPeerAddr returns a peer address without credentials.
+func NewUnixPeerAddr(network, path string) *UnixPeerAddr {
+	return &UnixPeerAddr{Net: network, Path: path, PID: -1, UID: -1, GID: -1}
+}
+
+func (a *UnixPeerAddr) Network() string {
+	return a.Net
+}
+
+// String formats the peer as pid=1234,uid=1000,gid=1000 followed by the path when known.
+func (a *UnixPeerAddr) String() string {
+	parts := []string{}
+	for _, id := range []struct {
+		name string
+		val  int
+	}{{"pid", a.PID}, {"uid", a.UID}, {"gid", a.GID}} {
+		if id.val >= 0 {
+			parts = append(parts, id.name+"="+strconv.Itoa(id.val))
+		}
+	}
+	if a.Path != "" {
+		parts = append(parts, "path="+a.Path)
+	}
+	if len(parts) == 0 {
+		return a.Net
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package utils
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// SetPeerCredentials fills in the credentials of the process connected to a
+// unix stream socket, see SO_PEERCRED in unix(7).
+func SetPeerCredentials(fd uintptr, peer *UnixPeerAddr) error {
+	cred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return err
+	}
+	peer.PID, peer.UID, peer.GID = int(cred.Pid), int(cred.Uid), int(cred.Gid)
+	return nil
+}
+
+// EnablePassCredentials makes a unix datagram socket receive the credentials of
+// the sender with every datagram, see SO_PASSCRED in unix(7).
+func EnablePassCredentials(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PASSCRED, 1)
+}
+
+// PassCredentialsSpace is the out of band buffer size needed for the sender credentials.
+var PassCredentialsSpace = unix.CmsgSpace(unix.SizeofUcred)
+
+// ParsePassCredentials fills in the sender credentials from the out of band data of a datagram.
+func ParsePassCredentials(oob []byte, peer *UnixPeerAddr) error {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return err
+	}
+	for i := range msgs {
+		if cred, err := unix.ParseUnixCredentials(&msgs[i]); err == nil {
+			peer.PID, peer.UID, peer.GID = int(cred.Pid), int(cred.Uid), int(cred.Gid)
+			return nil
+		}
+	}
+	return ErrPeerCredentialsUnsupported
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package utils
+
+// SetPeerCredentials is only supported on linux.
+func SetPeerCredentials(fd uintptr, peer *UnixPeerAddr) error {
+	return ErrPeerCredentialsUnsupported
+}
+
+// EnablePassCredentials is only supported on linux.
+func EnablePassCredentials(fd uintptr) error {
+	return ErrPeerCredentialsUnsupported
+}
+
+// PassCredentialsSpace is the out of band buffer size needed for the sender credentials.
+var PassCredentialsSpace = 0
+
+// ParsePassCredentials is only supported on linux.
+func ParsePassCredentials(oob []byte, peer *UnixPeerAddr) error {
+	return ErrPeerCredentialsUnsupported
+}